@@ -4,13 +4,12 @@
 package Block
 
 import (
-	"bytes"
 	"crypto/sha256"
-	"encoding/binary"
-	"encoding/json"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"math/rand"
+	"io"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -22,7 +21,10 @@ import (
 const (
 	ORPHAN_DELTA  = 300
 	MAX_POW_COUNT = 60
+	NONCE_SIZE    = 16 // PoWのNonceのバイト数
 	DIFFICULTY    = "00"
+	bc_version    = "My Block Chain Ver0.1"
+	MAX_DATA_SIZE = 32 * 1024 // 1ブロックのデータの上限(1パケットに収まる大きさ)
 	debug_mode    = false
 )
 
@@ -52,6 +54,17 @@ type BlockChain struct {
 	invalid_blocks []*Block
 	retry_blocks   []*Block
 	mu             sync.Mutex
+	sync           *syncer
+	members        membershipState
+	partition      *partitionMonitor
+	clock          P2P.Clock
+	entropy        io.Reader // PoWのNonceを作る乱数源
+	metrics        chainMetrics
+	adversary      *adversary
+	integrity      integrity
+	blobs          *blobStore
+	done           chan struct{} // Closeで閉じる(定期的な処理を止める)
+	stop_once      sync.Once
 }
 
 
@@ -85,6 +98,25 @@ func (bc *BlockChain) IsMining() bool {
 	return bc.mining
 }
 
+// 時計の設定(Initの前に呼ぶ。設定しなければP2Pネットワークの時計)
+func (bc *BlockChain) SetClock(clock P2P.Clock) {
+	bc.clock = clock
+}
+
+// 乱数源の設定(Initの前に呼ぶ。設定しなければP2Pネットワークの乱数源)
+func (bc *BlockChain) SetEntropy(r io.Reader) {
+	bc.entropy = r
+}
+
+// PoWのNonceの生成(乱数源から16バイト読んで16進にする)
+func (bc *BlockChain) newNonce() (string, error) {
+	b := make([]byte, NONCE_SIZE)
+	if _, err := io.ReadFull(bc.entropy, b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
 // ブロックチェーン管理構造の初期化
 func (bc *BlockChain) Init(p2p *P2P.P2PNetwork, first bool) (*BlockChain, error) {
 	fmt.Println("Block_init")
@@ -93,40 +125,99 @@ func (bc *BlockChain) Init(p2p *P2P.P2PNetwork, first bool) (*BlockChain, error)
 	bc.invalid_blocks = make([]*Block, 0)
 	bc.retry_blocks = make([]*Block, 0)
 	bc.p2p = p2p
+	// 時計と乱数源は、設定されていなければP2Pネットワークと同じものを使う
+	if bc.clock == nil {
+		bc.clock = p2p.Clock()
+	}
+	if bc.entropy == nil {
+		bc.entropy = p2p.Entropy()
+	}
 	bc.initialized = false
 	bc.mining = false
-	bc.Info = "My Block Chain Ver0.1"
+	bc.Info = bc_version
+	bc.sync = newSyncer(bc)
+	bc.partition = newPartitionMonitor(bc)
+	bc.adversary = newAdversary(bc)
+	bc.blobs = newBlobStore()
+	bc.done = make(chan struct{})
+	go bc.partition.run()
+	go bc.checkLoop()
 
 	if first {
-		// genesisブロック
-		genesis_block := new(Block)
-		genesis_block.Timestamp = 0
-		genesis_block.Hight = 0
-		genesis_block.Data = "Genesis Block"
-		genesis_block.hash()
-		bc.blocks = append(bc.blocks, genesis_block)
+		bc.blocks = append(bc.blocks, newGenesisBlock())
 	}
 
 	return bc, nil
 }
 
+// 停止処理
+// 定期的な処理(分断の監視、チェーンの確認)を止める。P2Pネットワークは呼び出し元で止める
+func (bc *BlockChain) Close() error {
+	bc.stop_once.Do(func() { close(bc.done) })
+	return nil
+}
+
+// 時計がd進むまで待つ。途中で停止したらfalseを返す
+func (bc *BlockChain) wait(d time.Duration) bool {
+	select {
+	case <-bc.clock.After(d):
+		return true
+	case <-bc.done:
+		return false
+	}
+}
+
+// genesisブロック
+func newGenesisBlock() *Block {
+	genesis_block := new(Block)
+	genesis_block.Timestamp = 0
+	genesis_block.Hight = 0
+	genesis_block.Data = "Genesis Block"
+	genesis_block.hash()
+	return genesis_block
+}
+
+// チェーンのパラメータ(ネットワークのmagicを作るのに使う)
+// 全ノードで同じにしなければならない値を並べる
+// seedはネットワークごとの乱数(同じ名前の別のネットワークと区別する)
+func ChainParams(network string, seed string, admins []string, members []string) []string {
+	params := []string{network, seed, newGenesisBlock().Hash, DIFFICULTY, bc_version}
+	params = append(params, sortStrings(admins)...)
+	params = append(params, "")
+	return append(params, sortStrings(members)...)
+}
+
+// 鍵の一覧を並べ替える(指定の順番でmagicが変わらないように)
+func sortStrings(keys []string) []string {
+	s := append([]string{}, keys...)
+	sort.Strings(s)
+	return s
+}
+
 // ブロックチェーンの同期
+// ヘッダを先に取得してから、ブロック本体を複数のノードから並行して取得する
+// 進捗はSyncStatusで確認する
 func (bc *BlockChain) SyncBlockChain(hight int) error {
-	/* 隙間のブロックを要求 */
-	bc.RequestBlock(hight)
-	time.Sleep(1 * time.Second)
-	bc.initialized = true
+	go func() {
+		bc.sync.start(hight)
+		bc.Initialized()
+	}()
 	return nil
 }
 
 // 初期化完了し動作可能とする
+// (同期の処理と監視の処理、APIから読まれるのでbc.muの中で書く)
 func (bc *BlockChain) Initialized() error {
+	bc.mu.Lock()
 	bc.initialized = true
+	bc.mu.Unlock()
 	return nil
 }
 
 // 初期化完了し動作可能な状態か確認
 func (bc *BlockChain) IsInitialized() bool {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
 	return bc.initialized
 }
 
@@ -142,11 +233,12 @@ func (bc *BlockChain) Create(data string, pow bool, primary bool) (*Block, error
 	block.Sibling = make([]*Block, 0)
 
 	// 競合、フォークを解消するために、一番長いチェーンの後につなげるようにする
-	last_block := bc.getPrevBlock()
+	// (隠しているブロックがあればその後につなげる)
+	last_block := bc.adversary.parent(bc.getPrevBlock())
 
 	// ブロックの中身を詰める
 	block.Prev = last_block.Hash
-	block.Timestamp = time.Now().UnixNano()
+	block.Timestamp = bc.adversary.timestamp(bc.clock.Now()).UnixNano()
 	block.Data = data
 	block.Hight = last_block.Hight + 1
 
@@ -157,7 +249,11 @@ func (bc *BlockChain) Create(data string, pow bool, primary bool) (*Block, error
 		実験では、あまり終わらないと大変なので、60回(60秒)やってだめなら、とりえず進むことにする。
 		*/
 		for i := 0; i < MAX_POW_COUNT; i++ {
-			block.Nonce = fmt.Sprintf("%x", rand.New(rand.NewSource(block.Timestamp/int64(i+1))))
+			nonce, err := bc.newNonce()
+			if err != nil {
+				return nil, err
+			}
+			block.Nonce = nonce
 			block.PowCount = i
 			block.hash()
 			if debug_mode {
@@ -170,7 +266,7 @@ func (bc *BlockChain) Create(data string, pow bool, primary bool) (*Block, error
 				fmt.Println("Found!!")
 				break
 			}
-			time.Sleep(1 * time.Second)
+			bc.clock.Sleep(1 * time.Second)
 		}
 		if primary == false && !strings.HasPrefix(block.Hash, DIFFICULTY) {
 			return nil, errors.New("Failed to Mine.")
@@ -207,23 +303,27 @@ func (bc *BlockChain) getPrevBlock() *Block {
 }
 
 // ブロックチェーンの整合性確認
+// dataは確認のレベルの名前(空なら既定のレベル)
+// つながりやハッシュが壊れたブロックがあれば、裏で他のノードから修復する
 func (bc *BlockChain) Check(data []byte) error {
+	level, err := ParseVerifyLevel(string(data))
+	if err != nil {
+		return err
+	}
 	fmt.Println("Checking My Block Chain...")
-	bc.mu.Lock()
-	prev := bc.blocks[0]
-	for i := 1; i < len(bc.blocks); i++ {
-		fmt.Println(".")
-		if prev.calcHash() != bc.blocks[i].Prev {
-			fmt.Println("Invalid Block Found!")
-			fmt.Println(prev)
-			bc.invalid_blocks = append(bc.invalid_blocks, prev)
+	report := bc.Verify(level)
+	fmt.Println("... Done", report.Checked, "blocks,", len(report.Invalid), "invalid")
+	if report.OK {
+		return nil
+	}
+	for _, ib := range report.Invalid {
+		if ib.Reason == INVALID_HASH || ib.Reason == INVALID_LINK {
+			go bc.CheckAndRepair()
+			break
 		}
-		prev = bc.blocks[i]
 	}
-	bc.mu.Unlock()
-	fmt.Println("... Done")
 
-	return nil
+	return ErrInvalidChain
 }
 
 
@@ -239,24 +339,30 @@ func (bc *BlockChain) blockAppendSimple(block *Block) error {
 		// つなぐ
 		bc.blocks = append(bc.blocks, block)
 	} else if last_block.Prev == block.Prev {
+		bc.metrics.update(func(m *ChainMetrics) { m.Conflicts++ })
 		if last_block.Timestamp > block.Timestamp {
+			bc.metrics.update(func(m *ChainMetrics) { m.Replaced++ })
 			// 入れ替え＆last_block解放
 			bc.blocks[len(bc.blocks)-1] = block
 			fmt.Println("Purge Block:", last_block)
+			// 外れたデータは後で再投入できるように記録する
+			if last_block.Data != block.Data {
+				bc.partition.abandon(last_block, ABANDON_SIBLING)
+			}
 		}
 	} else if block.Hight > last_block.Hight {
 		// 親がいなければorphanにつなぐ
 		bc.orphan_blocks = append(bc.orphan_blocks, block)
+		bc.metrics.update(func(m *ChainMetrics) { m.Orphaned++ })
 
-		// 隙間があったら、間のブロックの送信を依頼
-		for i := last_block.Hight + 1; i < block.Hight; i++ {
-			/* 隙間のブロックを要求 */
-			bc.RequestBlock(i)
-			time.Sleep(1 * time.Second / 2)
+		// 隙間があったら、同期処理で間のブロックを取得する
+		if block.Hight > last_block.Hight+1 {
+			bc.sync.kick(block.Hight)
 		}
 	} else {
 		// それ以外がチェーンに繋げないので破棄
 		fmt.Println("Purge Block:", block)
+		bc.metrics.update(func(m *ChainMetrics) { m.Stale++ })
 	}
 
 	return nil
@@ -282,9 +388,23 @@ func (bc *BlockChain) AddBlock(block *Block) error {
 	}
 
 	// orphan_blocksに繋がっているものの親が繋がったか確認する
-	last_block := bc.blocks[len(bc.blocks)-1]
-	for i, b := range bc.orphan_blocks {
-		if b.Prev == last_block.Hash {
+	bc.connectOrphans()
+
+	// アンロック
+	bc.mu.Unlock()
+
+	return nil
+}
+
+// orphan_blocksのうち、親がつながったものをチェーンにつなぐ(ロックは呼び出し元で取る)
+func (bc *BlockChain) connectOrphans() {
+	for found := true; found; {
+		found = false
+		last_block := bc.blocks[len(bc.blocks)-1]
+		for i, b := range bc.orphan_blocks {
+			if b.Prev != last_block.Hash {
+				continue
+			}
 			if debug_mode {
 				fmt.Println("retry")
 				fmt.Println("list block before")
@@ -301,27 +421,87 @@ func (bc *BlockChain) AddBlock(block *Block) error {
 				fmt.Println("list block after")
 				bc.DumpChain()
 			}
+			found = true
+			break
 		}
 	}
 
-	// アンロック
-	bc.mu.Unlock()
-
-	return nil
+	// チェーンより低い所に残ったものは捨てる
+	last_block := bc.blocks[len(bc.blocks)-1]
+	orphans := make([]*Block, 0, len(bc.orphan_blocks))
+	for _, b := range bc.orphan_blocks {
+		if b.Hight > last_block.Hight {
+			orphans = append(orphans, b)
+		}
+	}
+	bc.orphan_blocks = orphans
 }
 
-// ブロックを要求
-func (bc *BlockChain) RequestBlock(id int) error {
+// ブロックを要求して応答を待つ
+// 持っていないノードやタイムアウトしたノードの代わりに別のノードに要求し直す
+func (bc *BlockChain) RequestBlock(id int) (*Block, error) {
 	fmt.Println("RequestBlock:", id)
-	bid := make([]byte, 4)
-	binary.LittleEndian.PutUint32(bid, uint32(id))
-	node := []byte(bc.p2p.Self())
-	s_msg := append(bid, node...)
-	fmt.Println(s_msg)
-	bc.p2p.SendOne(P2P.CMD_SENDBLOCK, s_msg)
+	req := bc.p2p.Marshal(&RangeMsg{Start: id, Count: 1})
+	res, err := bc.p2p.Request(P2P.REQ_BLOCK, req, &P2P.RequestOptions{Retries: P2P.REQUEST_RETRY})
+	if err != nil {
+		return nil, err
+	}
+
+	block := new(Block)
+	if err := P2P.Unmarshal(res.Body, block); err != nil {
+		return nil, errors.New("Invalid Block.")
+	}
+	if block.Hight != id || !block.isValid() {
+		return nil, errors.New("Invalid Block: ID=" + strconv.FormatInt(int64(id), 10))
+	}
+
+	return block, nil
+}
+
+// ハッシュ指定でブロックを探す(ロックは呼び出し元で取る)
+func (bc *BlockChain) findBlock(hash string) *Block {
+	for _, b := range bc.blocks {
+		if b.Hash == hash {
+			return b
+		}
+	}
+	for _, b := range bc.orphan_blocks {
+		if b.Hash == hash {
+			return b
+		}
+	}
 	return nil
 }
 
+// ブロックを保持しているか確認
+func (bc *BlockChain) HasBlock(hash string) bool {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	return bc.findBlock(hash) != nil
+}
+
+// インベントリを保持しているか確認
+func (bc *BlockChain) HasInventory(kind int, hash string) bool {
+	if kind != P2P.INV_BLOCK {
+		return false
+	}
+	return bc.HasBlock(hash)
+}
+
+// インベントリの中身を取得
+func (bc *BlockChain) GetInventory(kind int, hash string) (int, []byte) {
+	if kind != P2P.INV_BLOCK {
+		return 0, nil
+	}
+	bc.mu.Lock()
+	block := bc.findBlock(hash)
+	bc.mu.Unlock()
+	if block == nil {
+		return 0, nil
+	}
+	return P2P.CMD_NEWBLOCK, bc.p2p.Marshal(block)
+}
+
 // ハッシュ指定でブロックを取得
 func (bc *BlockChain) GetBlock(hash string) *Block {
 	fmt.Println("GetBlock:", hash)
@@ -413,70 +593,72 @@ func (bc *BlockChain) NewBlock(msg []byte) error {
 
 	// ブロックを取り出す
 	block := new(Block)
-	err := json.Unmarshal(msg, block)
+	err := P2P.Unmarshal(msg, block)
 	if err != nil {
 		fmt.Println("Invalid Block.", err)
-		return errors.New("Invalid Block.")
+		return err
 	}
 	if debug_mode {fmt.Println("block = ", block)}
 
+	return bc.acceptBlock(block)
+}
+
+// ブロックを検証してチェーンにつなぎ、他のノードに通知する
+func (bc *BlockChain) acceptBlock(block *Block) error {
+
+	bc.p2p.Received(P2P.INV_BLOCK, block.Hash)
+
+	// 既に持っているブロックは何もしない
+	if bc.HasBlock(block.Hash) {
+		bc.metrics.update(func(m *ChainMetrics) { m.Duplicates++ })
+		return nil
+	}
+
 	// Check
 	if block.isValid() == false {
-		/* 不正なブロックなのでつながない */
-		return errors.New("Invalid Block: ID=" + strconv.FormatInt(int64(block.Hight), 10))
+		/* 不正なブロックなのでつながない。送信元は減点する */
+		bc.metrics.update(func(m *ChainMetrics) { m.Invalid++ })
+		return P2P.Misbehave(P2P.MIS_INVALID_BLOCK, "ID="+strconv.FormatInt(int64(block.Hight), 10))
+	}
+
+	own := bc.IsAdversaryBlock(block.Hash)
+	if !own {
+		bc.metrics.update(func(m *ChainMetrics) { m.Received++ })
+		bc.checkSkew(block)
 	}
 
 	// チェーンにつなぐ
 	bc.AddBlock(block)
+	bc.membershipChanged(block)
+	bc.blobsChanged(block)
+	if !own {
+		bc.adversary.observe(block)
+	}
+
+	// つながったブロックだけ他のノードに通知する
+	if bc.HasBlock(block.Hash) {
+		bc.p2p.Announce(P2P.INV_BLOCK, block.Hash)
+	}
 
 	return nil
 }
 
-// ブロック送信のアクション
-func (bc *BlockChain) SendBlock(msg []byte) error {
-	fmt.Println("send block action")
+// 高さ指定のブロック要求の処理
+func (bc *BlockChain) ServeBlock(body []byte) ([]byte, error) {
+	fmt.Println("serve block")
 
-	if debug_mode {
-		fmt.Println(msg)
+	req := new(RangeMsg)
+	if err := P2P.Unmarshal(body, req); err != nil {
+		return nil, err
 	}
 
-	// メッセージ解析
-	var block_id uint32
-	buf := bytes.NewReader(msg)
-	err := binary.Read(buf, binary.LittleEndian, &block_id)
-	fmt.Println(err)
-	target := string(msg[4:])
-	fmt.Println(block_id, target)
-
 	// ブロック取得
-	block := bc.GetBlockByIndex(int(block_id))
+	block := bc.GetBlockByIndex(req.Start)
 	if block == nil {
-		fmt.Println("Invalid Block ID")
-		return errors.New("Invalid Block ID:" + strconv.FormatInt(int64(block_id), 10))
-	}
-
-	// 送信先を特定
-	srv := strings.Split(target, ":")
-	port, _ := strconv.Atoi(srv[1])
-	node := bc.p2p.Search(srv[0], uint16(port))
-	if node == nil {
-		fmt.Println("Node NOT Found:" + target)
-		return errors.New("Node NOT Found:" + target)
-	}
-
-	// ブロック送信
-	b, _ := json.Marshal(block)
-
-	if debug_mode {
-		fmt.Println("block = ", block)
-		fmt.Println("b = ", b)
+		return nil, P2P.ErrNotFound
 	}
 
-	// 新しいブロックを要求元サーバに送る
-	s_msg := append([]byte{byte(P2P.CMD_NEWBLOCK)}, b...)
-	node.Send(s_msg)
-
-	return nil
+	return bc.p2p.Marshal(block), nil
 }
 
 // マイニング処理
@@ -505,12 +687,12 @@ func (bc *BlockChain) miningBlock(data []byte, primary bool) error {
 	// マイニング
 	block, err := bc.Create(string(d), true, primary)
 	if err == nil {
-		b, _ := json.Marshal(block)
 		if debug_mode {
-			fmt.Println(b)
+			fmt.Println(block)
 		}
-		// 全ノードに保存要求を送る
-		bc.p2p.Broadcast(P2P.CMD_NEWBLOCK, b, true)
+		// 自分のチェーンにつなぎ、全ノードにはハッシュだけ通知する
+		// (攻撃するノードは設定に従って隠したり、ノードごとに変えたりする)
+		err = bc.adversary.publish(block)
 	}
 
 	bc.mu.Lock()
@@ -521,16 +703,30 @@ func (bc *BlockChain) miningBlock(data []byte, primary bool) error {
 
 // マイニングアクション
 func (bc *BlockChain) MiningBlock(data []byte) error {
+	if len(data) > MAX_DATA_SIZE {
+		return P2P.Malformed("data too large")
+	}
 	return bc.miningBlock(data, false)
 }
 
+// 自ノードだけでマイニングする(他のノードには要求を送らない)
+func (bc *BlockChain) Mine(data []byte) error {
+	if len(data) > MAX_DATA_SIZE {
+		return errors.New("Data too large.")
+	}
+	return bc.miningBlock(data, true)
+}
+
 // データ保存リクエスト
 func (bc *BlockChain) SaveData(data []byte) error {
 
 	fmt.Println("SaveData:", data)
+	if len(data) > MAX_DATA_SIZE {
+		return errors.New("Data too large.")
+	}
 
 	// 全ノードにマイニング要求を送る
-	bc.p2p.Broadcast(P2P.CMD_MININGBLOCK, data, false)
+	bc.p2p.Gossip(P2P.CMD_MININGBLOCK, data, false)
 
 	// 自身のマイニング
 	go bc.miningBlock(data, true)
@@ -539,64 +735,42 @@ func (bc *BlockChain) SaveData(data []byte) error {
 }
 
 // データ書き換えアクション
+// ブロックはその場で書き換えない(訂正は訂正記録のブロックで行う)
+// 古いノードからの書き換え要求は拒否するだけで、何もしない
+// (誰でも送れるメッセージなので、受信をきっかけにチェーン全体の確認や修復はしない)
 func (bc *BlockChain) ModifyData(msg []byte) error {
 
 	fmt.Println("ModifyData:", msg)
 
-	// get hight
-	var hight uint32
-	buf := bytes.NewReader(msg)
-	err := binary.Read(buf, binary.LittleEndian, &hight)
+	req := new(ModifyMsg)
+	err := P2P.Unmarshal(msg, req)
 	if err != nil {
-		return errors.New("Invalid request.")
-	}
-
-	// get data
-	data := string(msg[4:])
-	if debug_mode {
-		fmt.Println(data)
-	}
-
-	block := new(Block)
-	target := bc.GetBlockByIndex(int(hight))
-	if target == nil {
-		return errors.New("No target Block: ID=" + strconv.FormatInt(int64(hight), 10))
-	}
-
-	// ブロックの内容をコピー
-	*block = *target
-
-	// 無理やりデータを変更&チェック
-	block.Data = data
-	fmt.Println(block)
-	if block.isValid() == false {
-	   // 不正なブロックなので、書き換えをやめる
-		fmt.Println("Invalid Block!:", block)
-		return errors.New("Invalid Block: ID=" + strconv.FormatInt(int64(block.Hight), 10))
-	} else {
-		// データを書き換え
-		*target = *block
-		// 一応全体チェックをかける
-		d := make([]byte, 4)
-		bc.Check(d)
+		return err
 	}
+	fmt.Println("Refuse to modify block in place: ID=", req.Hight)
 
-	return nil
+	return ErrImmutable
 }
 
-// データ書き換えリクエスト
-func (bc *BlockChain) Modify(hight int, data string) error {
+// データ訂正リクエスト
+// 自ノードの鍵で署名した訂正記録を新しいブロックとして追加する
+func (bc *BlockChain) Modify(hight int, data string, reason string) error {
 
-	fmt.Println("Modify:", hight, data)
+	fmt.Println("Modify:", hight, data, reason)
 
-	// メッセージ組み立て
-	idx := make([]byte, 4)
-	binary.LittleEndian.PutUint32(idx, uint32(hight))
-	s_msg := append(idx, data...)
-	fmt.Println("s_msg = ", s_msg)
-
-	// 全ノードにデータ書き換え要求を送る
-	bc.p2p.Broadcast(P2P.CMD_MODIFYDATA, s_msg, true)
+	id := bc.p2p.Identity()
+	if id == nil {
+		return errors.New("No identity to sign the amendment.")
+	}
+	if hight < 1 {
+		return ErrNotAmendable
+	}
+	target := bc.GetBlockByIndex(hight)
+	if target == nil {
+		return errors.New("No target Block: ID=" + strconv.Itoa(hight))
+	}
+	tx := &AmendmentTx{Hight: hight, Hash: target.Hash, Data: data, Reason: reason}
+	tx.Sign(id)
 
-	return nil
+	return bc.SubmitAmendment(tx)
 }
@@ -0,0 +1,480 @@
+/*
+  My Block Chain: Block Chain adversary module
+*/
+package Block
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"../P2P"
+)
+
+/*
+攻撃するノード
+	学習用に、ノードごとに次の不正な振る舞いを選べる。通常は正直(honest)に振る舞う。
+
+	selfish    見つけたブロックを隠して自分だけで伸ばす。他のノードのブロックで
+	           追いつかれそうになったら公開して、他のノードの仕事を無駄にする。
+	withhold   見つけたブロックを隠したまま公開しない。Releaseで公開する。
+	equivocate 同じ高さの違うブロックを2つ作り、ノードごとに違う方を送る。
+	timestamp  ブロックの時刻をずらす(過去にすると兄弟ブロックとの競争に勝つ)。
+	spam       ブロックを作るたびに、不正なブロックを全ノードに送りつける。
+	rewrite    計算力の過半数を持つ想定で、指定した高さから先を書き換えた
+	           長いチェーンを一気に作って公開する(1回だけ)。
+
+	隠したブロックの公開や書き換えは、分岐点からの入れ替え(reorg)で自分のチェーンに
+	入れてから通知する。他のノードは分断の修復と同じ仕組みで長いチェーンに入れ替える。
+	攻撃の影響は正直なノードのMetricsで確認する。
+*/
+const (
+	ADV_HONEST     = "honest"
+	ADV_SELFISH    = "selfish"
+	ADV_WITHHOLD   = "withhold"
+	ADV_EQUIVOCATE = "equivocate"
+	ADV_TIMESTAMP  = "timestamp"
+	ADV_SPAM       = "spam"
+	ADV_REWRITE    = "rewrite"
+
+	DEFAULT_TIME_SHIFT = -3600 // timestampで時刻をずらす秒数の既定値
+	DEFAULT_SPAM       = 10    // spamで1回に送る不正なブロックの数の既定値
+	MAX_SPAM           = 1000
+	REWRITE_TRIES      = 4096 // rewriteで1ブロックあたりに待たずに試すNonceの数
+)
+
+var ErrInvalidAdversary = errors.New("Invalid adversary config.")
+
+// 攻撃の設定
+type AdversaryConfig struct {
+	Mode        string `json:"mode"`
+	TimeShift   int64  `json:"time_shift_sec,omitempty"` // timestamp: ずらす秒数(負なら過去)
+	Spam        int    `json:"spam,omitempty"`           // spam: 1回に送る不正なブロックの数
+	AltData     string `json:"alt_data,omitempty"`       // equivocate: 2つ目のブロックのデータ
+	RewriteFrom int    `json:"rewrite_from,omitempty"`   // rewrite: 書き換える最初の高さ
+	RewriteData string `json:"rewrite_data,omitempty"`   // rewrite: 書き換え後のデータ
+}
+
+// 攻撃の統計情報
+type AdversaryStats struct {
+	Config        AdversaryConfig `json:"config"`
+	Mined         int             `json:"mined"`         // 攻撃中に作ったブロック
+	Hidden        int             `json:"hidden"`        // 隠しているブロック
+	Published     int             `json:"published"`     // 隠してから公開したブロック
+	Discarded     int             `json:"discarded"`     // 追い越されて捨てた隠しブロック
+	Equivocations int             `json:"equivocations"` // 違うブロックを送った回数
+	Spammed       int             `json:"spammed"`       // 送りつけた不正なブロック
+	Rewritten     int             `json:"rewritten"`     // 書き換えて作ったブロック
+	OnChain       int             `json:"on_chain"`      // 作ったブロックのうち自分のチェーンにあるもの
+}
+
+// 攻撃の状態
+type adversary struct {
+	bc      *BlockChain
+	mu      sync.Mutex
+	config  AdversaryConfig
+	hidden  []*Block        // 隠しているチェーン(高さの昇順)
+	own     map[string]bool // 攻撃中に作ったブロックのハッシュ
+	rewrote bool
+	stats   AdversaryStats
+}
+
+// 攻撃の状態の初期化
+func newAdversary(bc *BlockChain) *adversary {
+	adv := new(adversary)
+	adv.bc = bc
+	adv.config.Mode = ADV_HONEST
+	adv.own = make(map[string]bool)
+	return adv
+}
+
+// 攻撃の設定の検証(省略された値は既定値にする)
+func (c *AdversaryConfig) Validate() error {
+	switch c.Mode {
+	case "":
+		c.Mode = ADV_HONEST
+	case ADV_HONEST, ADV_SELFISH, ADV_WITHHOLD, ADV_EQUIVOCATE:
+	case ADV_TIMESTAMP:
+		if c.TimeShift == 0 {
+			c.TimeShift = DEFAULT_TIME_SHIFT
+		}
+	case ADV_SPAM:
+		if c.Spam == 0 {
+			c.Spam = DEFAULT_SPAM
+		}
+	case ADV_REWRITE:
+		if c.RewriteFrom < 1 || c.RewriteData == "" {
+			return ErrInvalidAdversary
+		}
+	default:
+		return ErrInvalidAdversary
+	}
+	if c.Spam < 0 || c.Spam > MAX_SPAM || len(c.AltData) > MAX_DATA_SIZE || len(c.RewriteData) > MAX_DATA_SIZE {
+		return ErrInvalidAdversary
+	}
+	return nil
+}
+
+// 攻撃の設定の変更
+// 隠しているブロックがあれば、正直に戻す時に公開する
+func (bc *BlockChain) SetAdversary(config AdversaryConfig) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	adv := bc.adversary
+	adv.mu.Lock()
+	adv.config = config
+	adv.rewrote = false
+	hiding := config.Mode == ADV_SELFISH || config.Mode == ADV_WITHHOLD
+	adv.mu.Unlock()
+	fmt.Println("Adversary mode:", config.Mode)
+
+	if !hiding {
+		bc.ReleaseHidden()
+	}
+	return nil
+}
+
+// 攻撃の統計情報
+func (bc *BlockChain) AdversaryStats() AdversaryStats {
+	adv := bc.adversary
+	adv.mu.Lock()
+	st := adv.stats
+	st.Config = adv.config
+	st.Hidden = len(adv.hidden)
+	own := make(map[string]bool)
+	for hash := range adv.own {
+		own[hash] = true
+	}
+	adv.mu.Unlock()
+
+	bc.mu.Lock()
+	for _, b := range bc.blocks {
+		if own[b.Hash] {
+			st.OnChain++
+		}
+	}
+	bc.mu.Unlock()
+	return st
+}
+
+// 攻撃中に作ったブロックか
+func (bc *BlockChain) IsAdversaryBlock(hash string) bool {
+	adv := bc.adversary
+	adv.mu.Lock()
+	defer adv.mu.Unlock()
+	return adv.own[hash]
+}
+
+// 隠しているブロックを全て公開する
+func (bc *BlockChain) ReleaseHidden() int {
+	adv := bc.adversary
+	adv.mu.Lock()
+	hidden := adv.hidden
+	adv.hidden = nil
+	adv.mu.Unlock()
+
+	if len(hidden) == 0 {
+		return 0
+	}
+	return adv.release(hidden)
+}
+
+// 攻撃の設定
+func (adv *adversary) mode() AdversaryConfig {
+	adv.mu.Lock()
+	defer adv.mu.Unlock()
+	return adv.config
+}
+
+// 新しいブロックの親(隠しているチェーンがあればその先端)
+func (adv *adversary) parent(public *Block) *Block {
+	adv.mu.Lock()
+	defer adv.mu.Unlock()
+	if len(adv.hidden) > 0 && adv.hidden[len(adv.hidden)-1].Hight >= public.Hight {
+		return adv.hidden[len(adv.hidden)-1]
+	}
+	return public
+}
+
+// 新しいブロックの時刻
+func (adv *adversary) timestamp(now time.Time) time.Time {
+	c := adv.mode()
+	if c.Mode != ADV_TIMESTAMP {
+		return now
+	}
+	return now.Add(time.Duration(c.TimeShift) * time.Second)
+}
+
+// 作ったブロックを攻撃の設定に従って公開する
+func (adv *adversary) publish(block *Block) error {
+	bc := adv.bc
+	c := adv.mode()
+	if c.Mode == ADV_HONEST {
+		return bc.acceptBlock(block)
+	}
+
+	adv.mu.Lock()
+	adv.own[block.Hash] = true
+	adv.stats.Mined++
+	adv.mu.Unlock()
+
+	switch c.Mode {
+	case ADV_SELFISH, ADV_WITHHOLD:
+		adv.mu.Lock()
+		adv.hidden = append(adv.hidden, block)
+		adv.mu.Unlock()
+		fmt.Println("Adversary: hide block", block.Hight, block.Hash)
+		return nil
+	case ADV_EQUIVOCATE:
+		return adv.equivocate(block, c)
+	case ADV_SPAM:
+		err := bc.acceptBlock(block)
+		adv.spam(block, c.Spam)
+		return err
+	case ADV_REWRITE:
+		adv.mu.Lock()
+		done := adv.rewrote
+		adv.rewrote = true
+		adv.mu.Unlock()
+		if done {
+			return bc.acceptBlock(block)
+		}
+		return adv.rewrite(block, c)
+	}
+	return bc.acceptBlock(block)
+}
+
+// 他のノードのブロックがつながった時の処理(selfish)
+// 隠しているチェーンの差が縮んだら公開して、他のノードの先端を無駄にする
+func (adv *adversary) observe(block *Block) {
+	if adv.mode().Mode != ADV_SELFISH {
+		return
+	}
+	public, _ := adv.bc.tip()
+
+	adv.mu.Lock()
+	if len(adv.hidden) == 0 {
+		adv.mu.Unlock()
+		return
+	}
+	lead := adv.hidden[len(adv.hidden)-1].Hight - public
+	var release []*Block
+	switch {
+	case lead < 0:
+		// 追い越されたので捨てる
+		adv.stats.Discarded += len(adv.hidden)
+		fmt.Println("Adversary: discard", len(adv.hidden), "hidden blocks")
+		adv.hidden = nil
+	case lead <= 1:
+		// 同じ長さか1つだけ長いなら全て公開する
+		release = adv.hidden
+		adv.hidden = nil
+	default:
+		// 十分に長いので、相手と同じ高さまでだけ公開する
+		n := 0
+		for n < len(adv.hidden) && adv.hidden[n].Hight <= public {
+			n++
+		}
+		release = adv.hidden[:n]
+		adv.hidden = adv.hidden[n:]
+	}
+	adv.mu.Unlock()
+
+	if len(release) > 0 {
+		adv.release(release)
+	}
+}
+
+// 隠していたブロックを自分のチェーンに入れて通知する
+func (adv *adversary) release(blocks []*Block) int {
+	bc := adv.bc
+	_, hash := bc.tip()
+
+	if blocks[0].Prev == hash {
+		// 先端の続きなのでそのままつなぐ
+		for _, b := range blocks {
+			bc.acceptBlock(b)
+		}
+	} else {
+		// 分岐しているので入れ替える(相手の方が長ければ捨てる)
+		report, removed, err := bc.reorg(blocks)
+		if err != nil {
+			adv.mu.Lock()
+			adv.stats.Discarded += len(blocks)
+			adv.mu.Unlock()
+			fmt.Println("Adversary: discard", len(blocks), "hidden blocks:", err)
+			return 0
+		}
+		for _, b := range removed {
+			bc.partition.abandon(b, ABANDON_REORG)
+		}
+		bc.membershipChanged(append(removed, blocks...)...)
+		bc.blobsChanged(append(removed, blocks...)...)
+		fmt.Println("Adversary: reorg fork", report.Fork, "removed", report.Removed, "added", report.Added)
+		for _, b := range blocks {
+			bc.p2p.Announce(P2P.INV_BLOCK, b.Hash)
+		}
+	}
+
+	adv.mu.Lock()
+	adv.stats.Published += len(blocks)
+	adv.mu.Unlock()
+	fmt.Println("Adversary: publish", len(blocks), "blocks")
+	return len(blocks)
+}
+
+// 同じ親を持つ別のブロックを作り、ノードごとに違う方を送る
+func (adv *adversary) equivocate(block *Block, c AdversaryConfig) error {
+	bc := adv.bc
+	alt_data := c.AltData
+	if alt_data == "" {
+		alt_data = "alt:" + block.Data
+	}
+	bc.mu.Lock()
+	parent := bc.findBlock(block.Prev)
+	bc.mu.Unlock()
+	if parent == nil {
+		return bc.acceptBlock(block)
+	}
+	alt, err := adv.forge(parent, alt_data, block.Timestamp+1)
+	if err != nil {
+		return err
+	}
+	adv.mu.Lock()
+	adv.own[alt.Hash] = true
+	adv.stats.Mined++
+	adv.stats.Equivocations++
+	adv.mu.Unlock()
+
+	// 自分のチェーンには1つ目をつなぎ、通知はしない
+	bc.AddBlock(block)
+	i := 0
+	for _, node := range bc.p2p.List() {
+		if node.Self {
+			continue
+		}
+		b := block
+		if i%2 == 1 {
+			b = alt
+		}
+		i++
+		if err := bc.p2p.Push(node, P2P.INV_BLOCK, b.Hash, P2P.CMD_NEWBLOCK, bc.p2p.Marshal(b)); err != nil {
+			fmt.Println("send error:", node, err)
+		}
+	}
+	fmt.Println("Adversary: equivocate", block.Hight, block.Hash, alt.Hash)
+	return nil
+}
+
+// 不正なブロック(ハッシュが中身と合わない)を全ノードに送る
+func (adv *adversary) spam(block *Block, count int) {
+	bc := adv.bc
+	sent := 0
+	for i := 0; i < count; i++ {
+		bad := *block
+		bad.Child = nil
+		bad.Sibling = nil
+		bad.Data = block.Data + "!" + strconv.Itoa(i)
+		bad.hash()
+		bad.PowCount++
+		msg := bc.p2p.Marshal(&bad)
+		for _, node := range bc.p2p.List() {
+			if node.Self {
+				continue
+			}
+			if err := bc.p2p.Push(node, P2P.INV_BLOCK, bad.Hash, P2P.CMD_NEWBLOCK, msg); err == nil {
+				sent++
+			}
+		}
+	}
+	adv.mu.Lock()
+	adv.stats.Spammed += sent
+	adv.mu.Unlock()
+	fmt.Println("Adversary: spam", sent, "invalid blocks")
+}
+
+// 指定した高さから先を書き換えたチェーンを作って公開する
+// 元のチェーンより1つ長くなるように、最後に新しいブロックを付ける
+func (adv *adversary) rewrite(block *Block, c AdversaryConfig) error {
+	bc := adv.bc
+	bc.mu.Lock()
+	if c.RewriteFrom >= len(bc.blocks) {
+		bc.mu.Unlock()
+		return bc.acceptBlock(block)
+	}
+	parent := bc.blocks[c.RewriteFrom-1]
+	old := append([]*Block{}, bc.blocks[c.RewriteFrom:]...)
+	bc.mu.Unlock()
+
+	data := make([]string, 0, len(old)+1)
+	data = append(data, c.RewriteData)
+	for _, b := range old[1:] {
+		data = append(data, b.Data)
+	}
+	data = append(data, block.Data)
+
+	blocks := make([]*Block, 0, len(data))
+	ts := bc.clock.Now().UnixNano()
+	for _, d := range data {
+		b, err := adv.forge(parent, d, ts)
+		if err != nil {
+			return err
+		}
+		blocks = append(blocks, b)
+		parent = b
+		ts++
+	}
+
+	adv.mu.Lock()
+	for _, b := range blocks {
+		adv.own[b.Hash] = true
+	}
+	adv.stats.Rewritten += len(blocks)
+	adv.mu.Unlock()
+	fmt.Println("Adversary: rewrite from", c.RewriteFrom, "with", len(blocks), "blocks")
+
+	if adv.release(blocks) == 0 {
+		return errors.New("Rewrite failed.")
+	}
+	return nil
+}
+
+// 手元のブロックを直接書き換える(記憶装置の破損や改ざんの再現用)
+// ハッシュは計算し直さないので、整合性の確認で見つかり、他のノードから修復される
+func (bc *BlockChain) Corrupt(hight int, data string) error {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	if hight < 0 || hight >= len(bc.blocks) {
+		return errors.New("No target Block: ID=" + strconv.Itoa(hight))
+	}
+	fmt.Println("Corrupt block:", hight)
+	bc.blocks[hight].Data = data
+	return nil
+}
+
+// 待たずにPoWを計算してブロックを作る(計算力が大きいノードの想定)
+func (adv *adversary) forge(parent *Block, data string, ts int64) (*Block, error) {
+	b := new(Block)
+	b.Child = make([]*Block, 0)
+	b.Sibling = make([]*Block, 0)
+	b.Prev = parent.Hash
+	b.Hight = parent.Hight + 1
+	b.Timestamp = ts
+	b.Data = data
+	for i := 0; i < REWRITE_TRIES; i++ {
+		nonce, err := adv.bc.newNonce()
+		if err != nil {
+			return nil, err
+		}
+		b.Nonce = nonce
+		b.PowCount = i
+		if strings.HasPrefix(b.hash(), DIFFICULTY) {
+			break
+		}
+	}
+	return b, nil
+}
@@ -0,0 +1,230 @@
+/*
+  My Block Chain: amendment record module
+*/
+package Block
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"../P2P"
+)
+
+/*
+データの訂正
+
+	チェーンに載ったブロックは書き換えない(書き換えるとハッシュが合わなくなり、
+	そのノードのチェーンが壊れるだけで、他のノードとも食い違う)。
+	データを訂正する時は、訂正する高さとそのブロックのハッシュ、訂正後のデータ、
+	理由を書いた訂正記録を作成者の鍵で署名して、新しいブロックとして追加する。
+
+	同じ高さへの訂正が複数あれば、チェーンの後ろにあるものが有効になる。
+	問い合わせ(Effective)は元のデータと訂正の履歴、最後に有効な値を返す。
+
+	訂正できるのは種類の無いただのデータだけ(参加ノードの変更や訂正記録は訂正できない)。
+	参加ノードの制限がある場合は、その高さで参加ノードか管理者の鍵で署名すること。
+	条件を満たさない訂正記録はブロックに入っていても無視する。
+*/
+const (
+	RECORD_AMENDMENT = "amendment"
+)
+
+var ErrNotAmendable = errors.New("Block is not amendable.")
+var ErrImmutable = errors.New("Blocks can not be modified. Submit an amendment.")
+
+// 訂正記録
+type AmendmentTx struct {
+	Type   string `json:"type"`
+	Hight  int    `json:"hight"`  // 訂正するブロックの高さ
+	Hash   string `json:"hash"`   // 訂正するブロックのハッシュ
+	Data   string `json:"data"`   // 訂正後のデータ
+	Reason string `json:"reason"` // 訂正の理由
+	Author string `json:"author"` // 署名した鍵
+	Sig    string `json:"sig"`
+}
+
+// 署名対象
+func (tx *AmendmentTx) signedBytes() []byte {
+	return []byte(RECORD_AMENDMENT + "|" + strconv.Itoa(tx.Hight) + "|" + tx.Hash + "|" +
+		strconv.Quote(tx.Data) + "|" + strconv.Quote(tx.Reason) + "|" + tx.Author)
+}
+
+// 作成者の鍵で署名
+func (tx *AmendmentTx) Sign(author *P2P.Identity) {
+	tx.Type = RECORD_AMENDMENT
+	tx.Author = author.Key()
+	tx.Sig = hex.EncodeToString(author.Sign(tx.signedBytes()))
+}
+
+// 形式と署名の確認(対象のブロックは確認しない)
+func (tx *AmendmentTx) verify() error {
+	if tx.Type != RECORD_AMENDMENT {
+		return errors.New("Not an amendment record.")
+	}
+	if tx.Hight < 1 {
+		return ErrNotAmendable
+	}
+	if tx.Reason == "" {
+		return errors.New("Amendment without reason.")
+	}
+	author, err := hex.DecodeString(tx.Author)
+	if err != nil || len(author) != ed25519.PublicKeySize {
+		return errors.New("Invalid author key.")
+	}
+	sig, err := hex.DecodeString(tx.Sig)
+	if err != nil || !ed25519.Verify(author, tx.signedBytes(), sig) {
+		return errors.New("Invalid amendment signature.")
+	}
+	return nil
+}
+
+// チェーンのi番目のブロックの訂正記録を確認する
+// stateはその高さでの参加ノードの一覧(制限が無ければnil)
+func checkAmendment(state *Membership, blocks []*Block, i int) (*AmendmentTx, error) {
+	tx := new(AmendmentTx)
+	if err := json.Unmarshal([]byte(blocks[i].Data), tx); err != nil {
+		return nil, err
+	}
+	if err := tx.verify(); err != nil {
+		return nil, err
+	}
+	if tx.Hight >= i {
+		return nil, errors.New("Amendment target is not before the record.")
+	}
+	target := blocks[tx.Hight]
+	if target.Hash != tx.Hash {
+		return nil, errors.New("Amendment target hash mismatch: " + tx.Hash)
+	}
+	if recordType(target.Data) != "" {
+		return nil, ErrNotAmendable
+	}
+	if state != nil && !state.Members[tx.Author] && !state.Admins[tx.Author] {
+		return nil, errors.New("Amendment author is not a member.")
+	}
+	return tx, nil
+}
+
+// 訂正の履歴
+type Amendment struct {
+	Hight     int    `json:"hight"` // 訂正記録のブロックの高さ
+	Hash      string `json:"hash"`
+	Data      string `json:"data"`
+	Reason    string `json:"reason"`
+	Author    string `json:"author"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// 訂正を反映したデータ
+type EffectiveData struct {
+	Hight      int         `json:"hight"`
+	Hash       string      `json:"hash"`
+	Original   string      `json:"original"`
+	Data       string      `json:"data"` // 最後に有効な値
+	Amended    bool        `json:"amended"`
+	Amendments []Amendment `json:"amendments"`
+}
+
+// チェーン全体の有効な訂正記録を対象の高さごとに集める
+func (bc *BlockChain) amendments() ([]*Block, map[int][]Amendment) {
+	bc.mu.Lock()
+	blocks := append([]*Block{}, bc.blocks...)
+	bc.mu.Unlock()
+
+	var state *Membership
+	bc.members.mu.Lock()
+	if bc.members.enabled {
+		state = bc.members.genesis.copy()
+	}
+	bc.members.mu.Unlock()
+
+	result := make(map[int][]Amendment)
+	for i, b := range blocks {
+		if recordType(b.Data) == RECORD_AMENDMENT {
+			if tx, err := checkAmendment(state, blocks, i); err == nil {
+				result[tx.Hight] = append(result[tx.Hight], Amendment{
+					Hight:     i,
+					Hash:      b.Hash,
+					Data:      tx.Data,
+					Reason:    tx.Reason,
+					Author:    tx.Author,
+					Timestamp: b.Timestamp,
+				})
+			}
+		}
+		if state != nil {
+			state.applyBlock(b)
+		}
+	}
+	return blocks, result
+}
+
+// 訂正を反映したデータ
+func newEffectiveData(b *Block, amendments []Amendment) EffectiveData {
+	e := EffectiveData{
+		Hight:      b.Hight,
+		Hash:       b.Hash,
+		Original:   b.Data,
+		Data:       b.Data,
+		Amendments: make([]Amendment, 0),
+	}
+	if len(amendments) > 0 {
+		e.Data = amendments[len(amendments)-1].Data
+		e.Amended = true
+		e.Amendments = amendments
+	}
+	return e
+}
+
+// 指定した高さのデータの、訂正を反映した値
+func (bc *BlockChain) Effective(hight int) (*EffectiveData, error) {
+	blocks, amendments := bc.amendments()
+	if hight < 1 || hight >= len(blocks) {
+		return nil, errors.New("No target Block: ID=" + strconv.Itoa(hight))
+	}
+	if recordType(blocks[hight].Data) != "" {
+		return nil, ErrNotAmendable
+	}
+	e := newEffectiveData(blocks[hight], amendments[hight])
+	return &e, nil
+}
+
+// 全てのデータの、訂正を反映した値(記録は除く)
+func (bc *BlockChain) EffectiveAll() []EffectiveData {
+	blocks, amendments := bc.amendments()
+	result := make([]EffectiveData, 0, len(blocks))
+	for _, b := range blocks {
+		if b.Hight == 0 || recordType(b.Data) != "" {
+			continue
+		}
+		result = append(result, newEffectiveData(b, amendments[b.Hight]))
+	}
+	return result
+}
+
+// 訂正記録を受け付けてブロックに記録する
+func (bc *BlockChain) SubmitAmendment(tx *AmendmentTx) error {
+	if err := tx.verify(); err != nil {
+		return err
+	}
+	target := bc.GetBlockByIndex(tx.Hight)
+	if target == nil {
+		return errors.New("No target Block: ID=" + strconv.Itoa(tx.Hight))
+	}
+	if target.Hash != tx.Hash {
+		return errors.New("Amendment target hash mismatch: " + tx.Hash)
+	}
+	if recordType(target.Data) != "" {
+		return ErrNotAmendable
+	}
+	if m := bc.Membership(-1); m != nil && !m.Members[tx.Author] && !m.Admins[tx.Author] {
+		return errors.New("Amendment author is not a member.")
+	}
+	b, err := json.Marshal(tx)
+	if err != nil {
+		return err
+	}
+	return bc.SaveData(b)
+}
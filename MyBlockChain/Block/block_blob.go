@@ -0,0 +1,496 @@
+/*
+  My Block Chain: off-chain blob store module
+*/
+package Block
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+
+	"../P2P"
+)
+
+/*
+チェーンの外に置くデータ
+
+	個人情報のように消す必要があるデータは、チェーンには載せられない
+	(ブロックは書き換えられないので、一度載せると消せない)。
+	データ本体は各ノードのハッシュ指定の保存領域(blob)に置き、チェーンには
+	本体のハッシュと大きさ、持ち主の鍵を書いた保存記録だけを載せる。
+
+	本体は保存したノードが持ち、他のノードは要求された時に、持っているノード
+	(DHTのプロバイダ、見つからなければ接続中の全ノード)から取り寄せる。
+	取り寄せた本体はハッシュがチェーンの記録と一致する場合だけ受け取る。
+
+	消す時は、持ち主(参加ノードの制限がある場合は管理者も)の鍵で署名した
+	消去記録をチェーンに載せる。消去記録がつながったノードは本体を消して、
+	誰がいつ何のために消したかを墓標(Tombstone)として残す。
+	消したデータは他のノードにも渡さず、同じデータを保存し直すこともできない。
+	チェーンにはハッシュしか残らないので、消してもチェーンは壊れない。
+*/
+const (
+	RECORD_BLOB    = "blob"
+	RECORD_ERASURE = "erasure"
+
+	MAX_BLOB_SIZE = 48 * 1024 // 本体の上限(1メッセージに収まる大きさ)
+)
+
+var (
+	ErrErased   = errors.New("Blob is erased.")
+	ErrNoBlob   = errors.New("Blob is not committed on the chain.")
+	ErrNotOwner = errors.New("Not the owner of the blob.")
+)
+
+// チェーンに載せる保存記録
+type BlobRef struct {
+	Type  string `json:"type"`
+	Hash  string `json:"hash"`  // 本体のSHA-256(16進)
+	Size  int    `json:"size"`  // 本体の大きさ
+	Owner string `json:"owner"` // 消去できる鍵
+}
+
+// 形式の確認
+func (ref *BlobRef) verify() error {
+	if ref.Type != RECORD_BLOB {
+		return errors.New("Not a blob record.")
+	}
+	if !validBlobHash(ref.Hash) {
+		return errors.New("Invalid blob hash.")
+	}
+	if ref.Size <= 0 || ref.Size > MAX_BLOB_SIZE {
+		return errors.New("Invalid blob size.")
+	}
+	if !validKey(ref.Owner) {
+		return errors.New("Invalid owner key.")
+	}
+	return nil
+}
+
+// 消去記録
+type ErasureTx struct {
+	Type   string `json:"type"`
+	Hash   string `json:"hash"`   // 消す本体のハッシュ
+	Reason string `json:"reason"` // 消す理由
+	Author string `json:"author"` // 署名した鍵
+	Sig    string `json:"sig"`
+}
+
+// 署名対象
+func (tx *ErasureTx) signedBytes() []byte {
+	return []byte(RECORD_ERASURE + "|" + tx.Hash + "|" + strconv.Quote(tx.Reason) + "|" + tx.Author)
+}
+
+// 消去する鍵で署名
+func (tx *ErasureTx) Sign(author *P2P.Identity) {
+	tx.Type = RECORD_ERASURE
+	tx.Author = author.Key()
+	tx.Sig = hex.EncodeToString(author.Sign(tx.signedBytes()))
+}
+
+// 形式と署名の確認(消す権限は確認しない)
+func (tx *ErasureTx) verify() error {
+	if tx.Type != RECORD_ERASURE {
+		return errors.New("Not an erasure record.")
+	}
+	if !validBlobHash(tx.Hash) {
+		return errors.New("Invalid blob hash.")
+	}
+	if tx.Reason == "" {
+		return errors.New("Erasure without reason.")
+	}
+	if !validKey(tx.Author) {
+		return errors.New("Invalid author key.")
+	}
+	author, _ := hex.DecodeString(tx.Author)
+	sig, err := hex.DecodeString(tx.Sig)
+	if err != nil || !ed25519.Verify(author, tx.signedBytes(), sig) {
+		return errors.New("Invalid erasure signature.")
+	}
+	return nil
+}
+
+// 消したデータの墓標
+type Tombstone struct {
+	Hash     string `json:"hash"`
+	Size     int    `json:"size"`
+	Owner    string `json:"owner"`
+	Hight    int    `json:"hight"` // 消去記録のブロックの高さ
+	Reason   string `json:"reason"`
+	Author   string `json:"author"`
+	Held     bool   `json:"held"` // 消した時に本体を持っていたか
+	ErasedAt int64  `json:"erased_at"`
+}
+
+// チェーンの外に置いたデータの状態
+type BlobInfo struct {
+	Hash   string     `json:"hash"`
+	Size   int        `json:"size"`
+	Owner  string     `json:"owner"`
+	Hight  int        `json:"hight"` // 保存記録のブロックの高さ
+	Held   bool       `json:"held"`  // 本体を持っているか
+	Erased *Tombstone `json:"erased,omitempty"`
+}
+
+// ハッシュ指定の保存領域
+type blobStore struct {
+	mu         sync.Mutex
+	blobs      map[string][]byte
+	tombstones map[string]*Tombstone
+}
+
+func newBlobStore() *blobStore {
+	return &blobStore{blobs: make(map[string][]byte), tombstones: make(map[string]*Tombstone)}
+}
+
+// 本体のハッシュ(チェーンに載せる値)
+func BlobHash(payload []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(payload))
+}
+
+// ハッシュの形式の確認
+func validBlobHash(hash string) bool {
+	b, err := hex.DecodeString(hash)
+	return err == nil && len(b) == sha256.Size && hash == hex.EncodeToString(b)
+}
+
+// 鍵の形式の確認
+func validKey(key string) bool {
+	b, err := hex.DecodeString(key)
+	return err == nil && len(b) == ed25519.PublicKeySize
+}
+
+// チェーンのi番目より前にある、最初の保存記録
+func findBlobRef(blocks []*Block, i int, hash string) *BlobRef {
+	for j := 1; j < i; j++ {
+		if recordType(blocks[j].Data) != RECORD_BLOB {
+			continue
+		}
+		ref := new(BlobRef)
+		if json.Unmarshal([]byte(blocks[j].Data), ref) != nil || ref.verify() != nil {
+			continue
+		}
+		if ref.Hash == hash {
+			return ref
+		}
+	}
+	return nil
+}
+
+// チェーンのi番目のブロックの保存記録を確認する
+func checkBlobRef(blocks []*Block, i int) (*BlobRef, error) {
+	ref := new(BlobRef)
+	if err := json.Unmarshal([]byte(blocks[i].Data), ref); err != nil {
+		return nil, err
+	}
+	return ref, ref.verify()
+}
+
+// チェーンのi番目のブロックの消去記録を確認する
+// stateはその高さでの参加ノードの一覧(制限が無ければnil)
+func checkErasure(state *Membership, blocks []*Block, i int) (*ErasureTx, *BlobRef, error) {
+	tx := new(ErasureTx)
+	if err := json.Unmarshal([]byte(blocks[i].Data), tx); err != nil {
+		return nil, nil, err
+	}
+	if err := tx.verify(); err != nil {
+		return nil, nil, err
+	}
+	ref := findBlobRef(blocks, i, tx.Hash)
+	if ref == nil {
+		return nil, nil, ErrNoBlob
+	}
+	if tx.Author != ref.Owner && (state == nil || !state.Admins[tx.Author]) {
+		return nil, nil, ErrNotOwner
+	}
+	return tx, ref, nil
+}
+
+// チェーン上の保存記録と消去記録
+type blobIndex struct {
+	refs   map[string]*BlobRef
+	hights map[string]int
+	erased map[string]*Tombstone
+}
+
+// チェーン全体から保存記録と有効な消去記録を集める
+func (bc *BlockChain) blobIndex() *blobIndex {
+	bc.mu.Lock()
+	blocks := append([]*Block{}, bc.blocks...)
+	bc.mu.Unlock()
+
+	var state *Membership
+	bc.members.mu.Lock()
+	if bc.members.enabled {
+		state = bc.members.genesis.copy()
+	}
+	bc.members.mu.Unlock()
+
+	idx := &blobIndex{refs: make(map[string]*BlobRef), hights: make(map[string]int), erased: make(map[string]*Tombstone)}
+	for i, b := range blocks {
+		switch recordType(b.Data) {
+		case RECORD_BLOB:
+			if ref, err := checkBlobRef(blocks, i); err == nil && idx.refs[ref.Hash] == nil {
+				idx.refs[ref.Hash] = ref
+				idx.hights[ref.Hash] = i
+			}
+		case RECORD_ERASURE:
+			if tx, ref, err := checkErasure(state, blocks, i); err == nil && idx.erased[tx.Hash] == nil {
+				idx.erased[tx.Hash] = &Tombstone{
+					Hash:   tx.Hash,
+					Size:   ref.Size,
+					Owner:  ref.Owner,
+					Hight:  i,
+					Reason: tx.Reason,
+					Author: tx.Author,
+				}
+			}
+		}
+		if state != nil {
+			state.applyBlock(b)
+		}
+	}
+	return idx
+}
+
+// チェーンに載った消去記録に従って本体を消し、墓標を残す
+func (bc *BlockChain) purgeErased(idx *blobIndex) {
+	bs := bc.blobs
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	for hash, t := range idx.erased {
+		if bs.tombstones[hash] != nil {
+			continue
+		}
+		_, t.Held = bs.blobs[hash]
+		t.ErasedAt = bc.clock.Now().UnixNano()
+		delete(bs.blobs, hash)
+		bs.tombstones[hash] = t
+		fmt.Println("Erased blob:", hash, "by", t.Author, "at", t.Hight, t.Reason)
+	}
+}
+
+// チェーンに消去記録がつながったら本体を消す
+func (bc *BlockChain) blobsChanged(blocks ...*Block) {
+	for _, b := range blocks {
+		if recordType(b.Data) == RECORD_ERASURE {
+			bc.purgeErased(bc.blobIndex())
+			return
+		}
+	}
+}
+
+// 消したデータの墓標
+func (bc *BlockChain) tombstone(hash string) *Tombstone {
+	bc.blobs.mu.Lock()
+	defer bc.blobs.mu.Unlock()
+	return bc.blobs.tombstones[hash]
+}
+
+// 本体を保存して、チェーンに保存記録を載せる
+// 持ち主が空なら自ノードの鍵を持ち主にする
+func (bc *BlockChain) PutBlob(payload []byte, owner string) (*BlobRef, error) {
+	if len(payload) == 0 || len(payload) > MAX_BLOB_SIZE {
+		return nil, errors.New("Invalid blob size.")
+	}
+	if owner == "" {
+		owner = bc.p2p.Key()
+	}
+	if !validKey(owner) {
+		return nil, errors.New("Invalid owner key.")
+	}
+	hash := BlobHash(payload)
+
+	idx := bc.blobIndex()
+	bc.purgeErased(idx)
+	if bc.tombstone(hash) != nil {
+		return nil, ErrErased
+	}
+	bc.blobs.mu.Lock()
+	bc.blobs.blobs[hash] = payload
+	bc.blobs.mu.Unlock()
+	go bc.provideBlob(hash)
+
+	// 既に載っていれば、その記録を使う
+	if ref := idx.refs[hash]; ref != nil {
+		return ref, nil
+	}
+	ref := &BlobRef{Type: RECORD_BLOB, Hash: hash, Size: len(payload), Owner: owner}
+	b, err := json.Marshal(ref)
+	if err != nil {
+		return nil, err
+	}
+	return ref, bc.SaveData(b)
+}
+
+// 本体を持っていることをDHTに登録する
+func (bc *BlockChain) provideBlob(hash string) {
+	if _, err := bc.p2p.Provide(hash); err != nil {
+		fmt.Println("Provide blob error:", hash, err)
+	}
+}
+
+// 本体を取得する(手元に無ければ他のノードから取り寄せる)
+// 消したデータは墓標とErrErasedを返す
+func (bc *BlockChain) GetBlob(hash string) ([]byte, *Tombstone, error) {
+	if !validBlobHash(hash) {
+		return nil, nil, errors.New("Invalid blob hash.")
+	}
+	if t := bc.tombstone(hash); t != nil {
+		return nil, t, ErrErased
+	}
+	bc.blobs.mu.Lock()
+	payload, ok := bc.blobs.blobs[hash]
+	bc.blobs.mu.Unlock()
+	if ok {
+		return payload, nil, nil
+	}
+
+	idx := bc.blobIndex()
+	if idx.erased[hash] != nil {
+		bc.purgeErased(idx)
+		return nil, bc.tombstone(hash), ErrErased
+	}
+	if idx.refs[hash] == nil {
+		return nil, nil, ErrNoBlob
+	}
+	payload, err := bc.fetchBlob(hash)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	bc.blobs.mu.Lock()
+	if t := bc.blobs.tombstones[hash]; t != nil {
+		// 取り寄せている間に消された
+		bc.blobs.mu.Unlock()
+		return nil, t, ErrErased
+	}
+	bc.blobs.blobs[hash] = payload
+	bc.blobs.mu.Unlock()
+	go bc.provideBlob(hash)
+	return payload, nil, nil
+}
+
+// 他のノードから本体を取り寄せる
+// プロバイダが見つからなければ接続中の全ノードに順に問い合わせる
+func (bc *BlockChain) fetchBlob(hash string) ([]byte, error) {
+	peers := make([]string, 0)
+	if provs, err := bc.p2p.FindProviders(hash); err == nil {
+		for _, n := range provs {
+			if n.Addr() != bc.p2p.Self() {
+				peers = append(peers, n.Addr())
+			}
+		}
+	}
+	if len(peers) == 0 {
+		peers = bc.p2p.Peers()
+	}
+
+	last_err := P2P.ErrNoPeer
+	for _, peer := range peers {
+		res, err := bc.p2p.Request(P2P.REQ_BLOB, []byte(hash), &P2P.RequestOptions{Peers: []string{peer}})
+		if err != nil {
+			last_err = err
+			continue
+		}
+		if BlobHash(res.Body) != hash {
+			fmt.Println("Blob hash mismatch from", res.From, hash)
+			last_err = errors.New("Blob hash mismatch.")
+			continue
+		}
+		fmt.Println("Fetched blob:", hash, "from", res.From)
+		return res.Body, nil
+	}
+	return nil, last_err
+}
+
+// 本体の要求の処理(消したデータや持っていないデータは渡さない)
+func (bc *BlockChain) ServeBlob(body []byte) ([]byte, error) {
+	hash := string(body)
+	fmt.Println("serve blob", hash)
+
+	bc.blobs.mu.Lock()
+	payload, ok := bc.blobs.blobs[hash]
+	bc.blobs.mu.Unlock()
+	if !ok || bc.blobIndex().erased[hash] != nil {
+		return nil, P2P.ErrNotFound
+	}
+	return payload, nil
+}
+
+// 消去記録を受け付けてブロックに記録する
+func (bc *BlockChain) SubmitErasure(tx *ErasureTx) error {
+	if err := tx.verify(); err != nil {
+		return err
+	}
+	idx := bc.blobIndex()
+	ref := idx.refs[tx.Hash]
+	if ref == nil {
+		return ErrNoBlob
+	}
+	if idx.erased[tx.Hash] != nil {
+		return ErrErased
+	}
+	if tx.Author != ref.Owner {
+		if m := bc.Membership(-1); m == nil || !m.Admins[tx.Author] {
+			return ErrNotOwner
+		}
+	}
+	b, err := json.Marshal(tx)
+	if err != nil {
+		return err
+	}
+	return bc.SaveData(b)
+}
+
+// 自ノードの鍵で署名した消去記録を載せる
+func (bc *BlockChain) Erase(hash string, reason string) error {
+	id := bc.p2p.Identity()
+	if id == nil {
+		return errors.New("No identity to sign the erasure.")
+	}
+	tx := &ErasureTx{Hash: hash, Reason: reason}
+	tx.Sign(id)
+	return bc.SubmitErasure(tx)
+}
+
+// チェーンに載った全ての保存記録の状態
+func (bc *BlockChain) Blobs() []BlobInfo {
+	idx := bc.blobIndex()
+	bc.purgeErased(idx)
+
+	bc.blobs.mu.Lock()
+	defer bc.blobs.mu.Unlock()
+	result := make([]BlobInfo, 0, len(idx.refs))
+	for hash, ref := range idx.refs {
+		_, held := bc.blobs.blobs[hash]
+		info := BlobInfo{Hash: hash, Size: ref.Size, Owner: ref.Owner, Hight: idx.hights[hash], Held: held}
+		if t := bc.blobs.tombstones[hash]; t != nil {
+			c := *t
+			info.Erased = &c
+		}
+		result = append(result, info)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Hight < result[j].Hight })
+	return result
+}
+
+// 墓標の一覧
+func (bc *BlockChain) Tombstones() []Tombstone {
+	bc.purgeErased(bc.blobIndex())
+
+	bc.blobs.mu.Lock()
+	defer bc.blobs.mu.Unlock()
+	result := make([]Tombstone, 0, len(bc.blobs.tombstones))
+	for _, t := range bc.blobs.tombstones {
+		result = append(result, *t)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Hight < result[j].Hight })
+	return result
+}
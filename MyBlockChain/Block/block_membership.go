@@ -0,0 +1,331 @@
+/*
+  My Block Chain: permissioned membership module
+*/
+package Block
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"../P2P"
+)
+
+/*
+参加ノードの管理
+
+	参加できるノードの鍵の一覧は、管理者の鍵で署名したトランザクションを
+	ブロックに記録して変更する。チェーンの先頭から順に適用するので、
+	どのノードでも同じ高さでは同じ一覧になる。
+
+	管理者と最初の参加ノードはチェーンのパラメータ(起動オプション)で与える。
+	全ノードで同じ値にすること。管理者を指定しない場合は誰でも参加できる。
+
+	署名や通番が正しくないトランザクションはブロックに入っていても無視する。
+*/
+const (
+	RECORD_MEMBERSHIP = "membership"
+
+	// 操作
+	MEMBER_ADD    = "add"
+	MEMBER_REMOVE = "remove"
+	ADMIN_ADD     = "add_admin"
+	ADMIN_REMOVE  = "remove_admin"
+
+	MEMBERSHIP_CACHE = 256 // 計算済みの状態を残す高さの数
+)
+
+var ErrNotAdmin = errors.New("Not an admin key.")
+
+// チェーンに記録するデータの種類
+// 種類の無いデータはただの文字列として扱う
+type Record struct {
+	Type string `json:"type"`
+}
+
+// データの種類を取得
+func recordType(data string) string {
+	if !strings.HasPrefix(data, "{") {
+		return ""
+	}
+	r := new(Record)
+	if err := json.Unmarshal([]byte(data), r); err != nil {
+		return ""
+	}
+	return r.Type
+}
+
+// 参加ノードの変更トランザクション
+type MembershipTx struct {
+	Type  string `json:"type"`
+	Op    string `json:"op"`
+	Key   string `json:"key"`   // 対象の鍵(16進)
+	Seq   int    `json:"seq"`   // 変更の通番(直前の状態の通番+1)
+	Admin string `json:"admin"` // 署名した管理者の鍵
+	Sig   string `json:"sig"`
+}
+
+// 署名対象
+func (tx *MembershipTx) signedBytes() []byte {
+	return []byte(RECORD_MEMBERSHIP + "|" + tx.Op + "|" + tx.Key + "|" + strconv.Itoa(tx.Seq) + "|" + tx.Admin)
+}
+
+// 管理者の鍵で署名
+func (tx *MembershipTx) Sign(admin *P2P.Identity) {
+	tx.Type = RECORD_MEMBERSHIP
+	tx.Admin = admin.Key()
+	tx.Sig = hex.EncodeToString(admin.Sign(tx.signedBytes()))
+}
+
+// 形式と署名の確認(管理者かどうかは確認しない)
+func (tx *MembershipTx) verify() error {
+	if tx.Type != RECORD_MEMBERSHIP {
+		return errors.New("Not a membership record.")
+	}
+	switch tx.Op {
+	case MEMBER_ADD, MEMBER_REMOVE, ADMIN_ADD, ADMIN_REMOVE:
+	default:
+		return errors.New("Invalid membership op:" + tx.Op)
+	}
+	key, err := hex.DecodeString(tx.Key)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return errors.New("Invalid node key.")
+	}
+	admin, err := hex.DecodeString(tx.Admin)
+	if err != nil || len(admin) != ed25519.PublicKeySize {
+		return errors.New("Invalid admin key.")
+	}
+	sig, err := hex.DecodeString(tx.Sig)
+	if err != nil || !ed25519.Verify(admin, tx.signedBytes(), sig) {
+		return errors.New("Invalid membership signature.")
+	}
+	return nil
+}
+
+// ある高さでの参加ノードの一覧
+type Membership struct {
+	Hight   int             `json:"hight"`
+	Seq     int             `json:"seq"`
+	Admins  map[string]bool `json:"admins"`
+	Members map[string]bool `json:"members"`
+}
+
+// 初期状態(チェーンのパラメータ)
+func newMembership(admins []string, members []string) *Membership {
+	m := &Membership{Hight: -1, Admins: make(map[string]bool), Members: make(map[string]bool)}
+	for _, k := range admins {
+		m.Admins[k] = true
+	}
+	for _, k := range members {
+		m.Members[k] = true
+	}
+	return m
+}
+
+// 複製
+func (m *Membership) copy() *Membership {
+	c := newMembership(nil, nil)
+	c.Hight = m.Hight
+	c.Seq = m.Seq
+	for k := range m.Admins {
+		c.Admins[k] = true
+	}
+	for k := range m.Members {
+		c.Members[k] = true
+	}
+	return c
+}
+
+// トランザクションを適用できるか確認
+func (m *Membership) check(tx *MembershipTx) error {
+	if err := tx.verify(); err != nil {
+		return err
+	}
+	if !m.Admins[tx.Admin] {
+		return ErrNotAdmin
+	}
+	if tx.Seq != m.Seq+1 {
+		return errors.New("Invalid membership seq: expected " + strconv.Itoa(m.Seq+1))
+	}
+	if tx.Op == ADMIN_REMOVE && len(m.Admins) == 1 && m.Admins[tx.Key] {
+		return errors.New("Could not remove the last admin.")
+	}
+	return nil
+}
+
+// トランザクションを適用
+func (m *Membership) apply(tx *MembershipTx) error {
+	if err := m.check(tx); err != nil {
+		return err
+	}
+	switch tx.Op {
+	case MEMBER_ADD:
+		m.Members[tx.Key] = true
+	case MEMBER_REMOVE:
+		delete(m.Members, tx.Key)
+	case ADMIN_ADD:
+		m.Admins[tx.Key] = true
+	case ADMIN_REMOVE:
+		delete(m.Admins, tx.Key)
+	}
+	m.Seq = tx.Seq
+	return nil
+}
+
+// ブロックのデータを適用(参加ノードの変更でなければ何もしない)
+func (m *Membership) applyBlock(b *Block) {
+	m.Hight = b.Hight
+	if recordType(b.Data) != RECORD_MEMBERSHIP {
+		return
+	}
+	tx := new(MembershipTx)
+	if err := json.Unmarshal([]byte(b.Data), tx); err != nil {
+		return
+	}
+	if err := m.apply(tx); err != nil {
+		fmt.Println("Ignore membership record: ID=", b.Hight, err)
+	}
+}
+
+// 参加ノード管理の状態
+type membershipState struct {
+	mu      sync.Mutex
+	enabled bool
+	genesis *Membership
+	cache   map[int]*membershipSnapshot // 計算済みの高さごとの状態
+}
+
+// 計算済みの状態
+type membershipSnapshot struct {
+	hash string // その高さのブロックのハッシュ(チェーンが変わったら使わない)
+	m    *Membership
+}
+
+// 参加ノードの制限を有効にする(チェーンのパラメータ)
+// 管理者が空なら制限しない
+func (bc *BlockChain) SetMembership(admins []string, members []string) error {
+	for _, k := range append(append([]string{}, admins...), members...) {
+		b, err := hex.DecodeString(k)
+		if err != nil || len(b) != ed25519.PublicKeySize {
+			return errors.New("Invalid key:" + k)
+		}
+	}
+	if len(admins) == 0 {
+		return nil
+	}
+
+	bc.members.mu.Lock()
+	bc.members.enabled = true
+	bc.members.genesis = newMembership(admins, members)
+	bc.members.cache = make(map[int]*membershipSnapshot)
+	bc.members.mu.Unlock()
+
+	bc.p2p.SetMembership(bc.IsMember)
+	if !bc.IsMember(bc.p2p.Key()) {
+		fmt.Println("Warning: this node is not a member.")
+	}
+	return nil
+}
+
+// 指定した高さでの参加ノードの一覧(負の値なら最新)
+func (bc *BlockChain) Membership(hight int) *Membership {
+	bc.members.mu.Lock()
+	defer bc.members.mu.Unlock()
+
+	if !bc.members.enabled {
+		return nil
+	}
+
+	// チェーンが入れ替わっても途中で変わらないよう、
+	// 再計算に必要な記録はロックを取ったままコピーする
+	bc.mu.Lock()
+	if len(bc.blocks) == 0 {
+		bc.mu.Unlock()
+		return bc.members.genesis.copy()
+	}
+	if hight < 0 || hight >= len(bc.blocks) {
+		hight = len(bc.blocks) - 1
+	}
+	hash := bc.blocks[hight].Hash
+
+	// その高さ以下で、チェーンと一致する一番近い計算済みの状態から再計算する
+	base, from := bc.members.genesis, 0
+	for h, s := range bc.members.cache {
+		if h <= hight && h >= from && s.hash == bc.blocks[h].Hash {
+			base, from = s.m, h+1
+		}
+	}
+	records := make([]Block, 0)
+	for _, b := range bc.blocks[from : hight+1] {
+		if recordType(b.Data) == RECORD_MEMBERSHIP {
+			records = append(records, Block{Hight: b.Hight, Data: b.Data})
+		}
+	}
+	bc.mu.Unlock()
+
+	m := base.copy()
+	for i := range records {
+		m.applyBlock(&records[i])
+	}
+	m.Hight = hight
+	bc.members.remember(hight, hash, m)
+	return m
+}
+
+// 計算した状態を記録する(上限を超えたら一番低い高さのものを捨てる)
+func (ms *membershipState) remember(hight int, hash string, m *Membership) {
+	ms.cache[hight] = &membershipSnapshot{hash: hash, m: m.copy()}
+	if len(ms.cache) <= MEMBERSHIP_CACHE {
+		return
+	}
+	lowest := hight
+	for h := range ms.cache {
+		if h < lowest {
+			lowest = h
+		}
+	}
+	delete(ms.cache, lowest)
+}
+
+// 最新の状態で参加ノードか確認
+func (bc *BlockChain) IsMember(key string) bool {
+	m := bc.Membership(-1)
+	if m == nil {
+		return true
+	}
+	return m.Members[key]
+}
+
+// 参加ノードの変更を受け付けてブロックに記録する
+func (bc *BlockChain) SubmitMembership(tx *MembershipTx) error {
+	m := bc.Membership(-1)
+	if m == nil {
+		return errors.New("Membership is not enabled.")
+	}
+	if err := m.check(tx); err != nil {
+		return err
+	}
+	b, err := json.Marshal(tx)
+	if err != nil {
+		return err
+	}
+	return bc.SaveData(b)
+}
+
+// チェーンに参加ノードの変更がつながったら、外れたノードを切断する
+func (bc *BlockChain) membershipChanged(blocks ...*Block) {
+	if !bc.members.enabled {
+		return
+	}
+	for _, b := range blocks {
+		if recordType(b.Data) == RECORD_MEMBERSHIP {
+			bc.p2p.EnforceMembership()
+			return
+		}
+	}
+}
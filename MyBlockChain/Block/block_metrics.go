@@ -0,0 +1,76 @@
+/*
+  My Block Chain: Block Chain metrics module
+*/
+package Block
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+チェーンの統計情報
+	受け取ったブロックをどう扱ったか(つないだ、捨てた、入れ替えた)を数える。
+	攻撃するノード(block_adversary.go)の影響は、正直なノードのこの値に表れる。
+		不正なブロックの送りつけ     → Invalid
+		ノードごとに違うブロックを送る → Conflicts, Replaced
+		時刻の改ざん                 → Skewed, Replaced
+		隠したブロックの公開、書き換え → Reorgs, Reorged, Abandoned
+*/
+const (
+	MAX_TIME_SKEW = 10 * time.Minute // 受け取った時刻とこれ以上ずれたブロックを数える
+)
+
+// チェーンの統計情報
+type ChainMetrics struct {
+	Hight      int `json:"hight"`
+	Received   int `json:"received"`   // 受け取った正しいブロック
+	Duplicates int `json:"duplicates"` // 既に持っていたブロック
+	Invalid    int `json:"invalid"`    // 検証に失敗したブロック
+	Orphaned   int `json:"orphaned"`   // 親が無くて待たせたブロック
+	Stale      int `json:"stale"`      // チェーンにつなげずに捨てたブロック
+	Conflicts  int `json:"conflicts"`  // 先端と同じ親を持つ別のブロック
+	Replaced   int `json:"replaced"`   // 先端を兄弟ブロックに入れ替えた数
+	Reorgs     int `json:"reorgs"`     // 分岐点からの入れ替えの数
+	Reorged    int `json:"reorged"`    // 入れ替えで外れたブロックの数
+	MaxReorg   int `json:"max_reorg"`  // 一度の入れ替えで外れたブロックの最大
+	Skewed     int `json:"skewed"`     // 時刻が大きくずれたブロック
+	Abandoned  int `json:"abandoned"`  // チェーンから外れて、まだ載っていないデータ
+}
+
+// 統計情報の集計
+type chainMetrics struct {
+	mu sync.Mutex
+	m  ChainMetrics
+}
+
+// 統計情報の更新
+func (cm *chainMetrics) update(fn func(m *ChainMetrics)) {
+	cm.mu.Lock()
+	fn(&cm.m)
+	cm.mu.Unlock()
+}
+
+// 受け取ったブロックの時刻のずれを確認する
+func (bc *BlockChain) checkSkew(block *Block) {
+	skew := time.Duration(block.Timestamp - bc.clock.Now().UnixNano())
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > MAX_TIME_SKEW {
+		bc.metrics.update(func(m *ChainMetrics) { m.Skewed++ })
+	}
+}
+
+// 統計情報の取得
+func (bc *BlockChain) Metrics() ChainMetrics {
+	hight, _ := bc.tip()
+	abandoned := len(bc.partition.pending())
+
+	bc.metrics.mu.Lock()
+	defer bc.metrics.mu.Unlock()
+	m := bc.metrics.m
+	m.Hight = hight
+	m.Abandoned = abandoned
+	return m
+}
@@ -0,0 +1,750 @@
+/*
+  My Block Chain: Block Chain partition detection module
+*/
+package Block
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"../P2P"
+)
+
+/*
+ネットワーク分断の検出と修復
+	定期的に全ノードとチェーンの先端(tip)を交換する。tipには高さを飛ばしながら
+	さかのぼったヘッダの一覧(locator)を付け、受け取った側は自分のチェーンと
+	一致する所から共通の祖先(分岐点)を求める。
+
+	応答が続けて無いノードは到達不能とし、到達不能なノードがいる間は分断中とする。
+	到達できるノードのチェーンが分岐していれば、長い方(同じ長さなら分岐後の最初の
+	ブロックが古い方)を正しいチェーンとし、こちらが負けていれば分岐点から先を
+	相手のチェーンに入れ替える(reorg)。
+	入れ替えで外れたブロックのデータは、新しいチェーンに無ければ記録しておき、
+	APIから再投入できる。
+*/
+const (
+	PARTITION_INTERVAL = 5 * time.Second
+	TIP_TIMEOUT        = 2 * time.Second
+	UNREACHABLE_FAILS  = 3    // 続けて応答が無ければ到達不能とみなす
+	LOCATOR_DENSE      = 10   // locatorで1つずつさかのぼる数
+	MAX_LOCATOR        = 64   // locatorのヘッダ数
+	MAX_REORG_DEPTH    = 1000 // 入れ替えるブロック数の上限
+	MAX_ABANDONED      = 1024
+	RESUBMIT_TIMEOUT   = 90 * time.Second
+
+	PARTITION_OK       = "connected"
+	PARTITION_SPLIT    = "partitioned" // 一部のノードに届かない
+	PARTITION_ISOLATED = "isolated"    // どのノードにも届かない
+	PARTITION_DIVERGED = "diverged"    // 届くノードとチェーンが分岐している
+	PARTITION_HEALING  = "healing"
+
+	ABANDON_SIBLING = "sibling" // 兄弟ブロックとの入れ替え
+	ABANDON_REORG   = "reorg"   // 分岐点からの入れ替え
+)
+
+// tip交換のメッセージ
+type TipMsg struct {
+	Tip     Header   `json:"tip"`
+	Locator []Header `json:"locator"` // 先端から高さの降順
+}
+
+// 他ノードのtip
+type PeerTip struct {
+	Addr      string `json:"addr"`
+	Hight     int    `json:"hight"`
+	Hash      string `json:"hash"`
+	Fork      int    `json:"fork"` // 共通の祖先の高さ(-1なら共通のブロックが無い)
+	Diverged  bool   `json:"diverged"`
+	Reachable bool   `json:"reachable"`
+	Fails     int    `json:"fails"`
+	LastSeen  int64  `json:"last_seen"`
+}
+
+// チェーンから外れたデータ
+type AbandonedData struct {
+	Hight     int    `json:"hight"`
+	Hash      string `json:"hash"`
+	Data      string `json:"data"`
+	Timestamp int64  `json:"timestamp"`
+	Reason    string `json:"reason"`
+	At        int64  `json:"at"`
+}
+
+// チェーンの入れ替えの記録
+type ReorgReport struct {
+	Peer      string `json:"peer"`
+	Fork      int    `json:"fork"`
+	OldTip    Header `json:"old_tip"`
+	NewTip    Header `json:"new_tip"`
+	Removed   int    `json:"removed"`
+	Added     int    `json:"added"`
+	Abandoned int    `json:"abandoned"`
+	At        int64  `json:"at"`
+}
+
+// 分断の状態
+type PartitionStatus struct {
+	State        string          `json:"state"`
+	Majority     bool            `json:"majority"` // 自ノードを含めて過半数のノードに届くか
+	Hight        int             `json:"hight"`
+	Hash         string          `json:"hash"`
+	Peers        int             `json:"peers"`
+	Reachable    int             `json:"reachable"`
+	Since        int64           `json:"since,omitempty"` // 分断を検出した時刻
+	Partitions   int             `json:"partitions"`
+	Heals        int             `json:"heals"`
+	Reorgs       int             `json:"reorgs"`
+	LastReorg    *ReorgReport    `json:"last_reorg,omitempty"`
+	PeerTips     []PeerTip       `json:"peer_tips"`
+	Abandoned    []AbandonedData `json:"abandoned"`
+	Resubmitting int             `json:"resubmitting"`
+}
+
+// 分断の監視
+type partitionMonitor struct {
+	bc           *BlockChain
+	mu           sync.Mutex
+	peers        map[string]*PeerTip
+	since        time.Time
+	partitions   int
+	heals        int
+	reorgs       int
+	last_reorg   *ReorgReport
+	healing      bool
+	abandoned    []AbandonedData
+	resubmitting int
+}
+
+// 分断の監視の初期化
+func newPartitionMonitor(bc *BlockChain) *partitionMonitor {
+	pm := new(partitionMonitor)
+	pm.bc = bc
+	pm.peers = make(map[string]*PeerTip)
+	pm.abandoned = make([]AbandonedData, 0)
+	return pm
+}
+
+// 監視ループ
+func (pm *partitionMonitor) run() {
+	for pm.bc.wait(PARTITION_INTERVAL) {
+		if pm.bc.IsInitialized() {
+			pm.exchange()
+		}
+	}
+}
+
+// 全ノードとtipを交換し、分岐していれば修復する
+func (pm *partitionMonitor) exchange() {
+	bc := pm.bc
+	tm := bc.tipMsg()
+	if tm == nil {
+		return
+	}
+	body := bc.p2p.Marshal(tm)
+
+	peers := bc.p2p.Peers()
+	replies := make(map[string]*TipMsg)
+	mu := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for _, peer := range peers {
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+			msg, err := pm.requestTip(peer, body)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			replies[peer] = msg
+			mu.Unlock()
+		}(peer)
+	}
+	wg.Wait()
+
+	// 一番長いチェーンを持つノードから修復する
+	best := ""
+	for _, peer := range peers {
+		msg, ok := replies[peer]
+		if !ok {
+			pm.unreachable(peer)
+			continue
+		}
+		if pm.observe(peer, msg) && (best == "" || msg.Tip.Hight > replies[best].Tip.Hight) {
+			best = peer
+		}
+	}
+	pm.forget(peers)
+	pm.detect()
+
+	if best != "" {
+		if err := pm.heal(best, replies[best]); err != nil {
+			fmt.Println("Heal failed:", best, err)
+		}
+	}
+}
+
+// ノードにtipを要求する
+func (pm *partitionMonitor) requestTip(peer string, body []byte) (*TipMsg, error) {
+	res, err := pm.bc.p2p.Request(P2P.REQ_TIP, body, &P2P.RequestOptions{
+		Timeout: TIP_TIMEOUT,
+		Peers:   []string{peer},
+	})
+	if err != nil {
+		return nil, err
+	}
+	msg := new(TipMsg)
+	if err := P2P.Unmarshal(res.Body, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// 同期中に分岐が見つかったノードとtipを交換して修復する
+func (pm *partitionMonitor) healPeer(peer string) {
+	tm := pm.bc.tipMsg()
+	if tm == nil {
+		return
+	}
+	msg, err := pm.requestTip(peer, pm.bc.p2p.Marshal(tm))
+	if err != nil {
+		pm.unreachable(peer)
+		return
+	}
+	if !pm.observe(peer, msg) {
+		return
+	}
+	if err := pm.heal(peer, msg); err != nil {
+		fmt.Println("Heal failed:", peer, err)
+	}
+}
+
+// tipを受け取ったノードを記録する。修復が必要ならtrueを返す
+func (pm *partitionMonitor) observe(peer string, msg *TipMsg) bool {
+	bc := pm.bc
+	hight, hash := bc.tip()
+	fork := bc.forkPoint(msg.Locator)
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	pt, ok := pm.peers[peer]
+	if !ok {
+		pt = &PeerTip{Addr: peer}
+		pm.peers[peer] = pt
+	}
+	if !pt.Reachable {
+		fmt.Println("Peer rejoined:", peer)
+	}
+	pt.Hight = msg.Tip.Hight
+	pt.Hash = msg.Tip.Hash
+	pt.Fork = fork
+	pt.Diverged = fork < 0 || (fork < hight && fork < msg.Tip.Hight)
+	pt.Reachable = true
+	pt.Fails = 0
+	pt.LastSeen = pm.bc.clock.Now().UnixNano()
+
+	if fork < 0 || msg.Tip.Hash == hash {
+		return false
+	}
+	return msg.Tip.Hight > hight || (pt.Diverged && msg.Tip.Hight == hight)
+}
+
+// 応答が無かったノードを記録する
+func (pm *partitionMonitor) unreachable(peer string) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	pt, ok := pm.peers[peer]
+	if !ok {
+		pt = &PeerTip{Addr: peer, Fork: -1, Reachable: true}
+		pm.peers[peer] = pt
+	}
+	pt.Fails++
+	if pt.Fails >= UNREACHABLE_FAILS {
+		if pt.Reachable {
+			fmt.Println("Peer unreachable:", peer)
+		}
+		pt.Reachable = false
+	}
+}
+
+// 接続していないノードを忘れる
+func (pm *partitionMonitor) forget(peers []string) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	current := make(map[string]bool)
+	for _, peer := range peers {
+		current[peer] = true
+	}
+	for peer := range pm.peers {
+		if !current[peer] {
+			delete(pm.peers, peer)
+		}
+	}
+}
+
+// 分断の始まりと終わりを記録する
+func (pm *partitionMonitor) detect() {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	unreachable := 0
+	for _, pt := range pm.peers {
+		if !pt.Reachable {
+			unreachable++
+		}
+	}
+	if unreachable > 0 && pm.since.IsZero() {
+		pm.since = pm.bc.clock.Now()
+		pm.partitions++
+		fmt.Println("Partition detected:", unreachable, "of", len(pm.peers), "peers unreachable")
+	} else if unreachable == 0 && !pm.since.IsZero() {
+		fmt.Println("Partition healed:", pm.bc.clock.Now().Sub(pm.since).Round(time.Second))
+		pm.since = time.Time{}
+		pm.heals++
+	}
+}
+
+// 相手のチェーンの方が良ければ、分岐点から先を入れ替える
+func (pm *partitionMonitor) heal(peer string, msg *TipMsg) error {
+	pm.mu.Lock()
+	if pm.healing {
+		pm.mu.Unlock()
+		return nil
+	}
+	pm.healing = true
+	pm.mu.Unlock()
+	defer func() {
+		pm.mu.Lock()
+		pm.healing = false
+		pm.mu.Unlock()
+	}()
+
+	bc := pm.bc
+	fork := bc.forkPoint(msg.Locator)
+	if fork < 0 {
+		return errors.New("No common block.")
+	}
+	hight, _ := bc.tip()
+	if fork >= hight {
+		// こちらのチェーンの先に伸びているだけなので通常の同期で足りる
+		bc.sync.kick(msg.Tip.Hight)
+		return nil
+	}
+	if msg.Tip.Hight < hight {
+		return nil
+	}
+
+	// 分岐点から先のヘッダを取得し、一致する所は飛ばす
+	headers, err := pm.fetchHeaders(peer, fork, msg.Tip.Hight)
+	if err != nil {
+		return err
+	}
+	bc.mu.Lock()
+	i := 0
+	for i < len(headers) && headers[i].Hight < len(bc.blocks) && bc.blocks[headers[i].Hight].Hash == headers[i].Hash {
+		i++
+	}
+	headers = headers[i:]
+	better := len(headers) > 0 && bc.isBetter(headers[0], headers[len(headers)-1].Hight)
+	bc.mu.Unlock()
+	if !better {
+		return nil
+	}
+
+	blocks, err := pm.fetchBodies(peer, headers)
+	if err != nil {
+		return err
+	}
+	report, removed, err := bc.reorg(blocks)
+	if err != nil {
+		return err
+	}
+	report.Peer = peer
+	for _, b := range removed {
+		pm.abandon(b, ABANDON_REORG)
+	}
+	bc.membershipChanged(append(removed, blocks...)...)
+	bc.blobsChanged(append(removed, blocks...)...)
+
+	pm.mu.Lock()
+	pm.reorgs++
+	pm.last_reorg = report
+	pm.mu.Unlock()
+	fmt.Println("Reorg:", peer, "fork", report.Fork, "removed", report.Removed, "added", report.Added, "abandoned", report.Abandoned)
+
+	// 入れ替えた後に伸びた分は通常の同期で取得する
+	if msg.Tip.Hight > report.NewTip.Hight {
+		bc.sync.kick(msg.Tip.Hight)
+	}
+	return nil
+}
+
+// 分岐点から先のヘッダを取得する
+func (pm *partitionMonitor) fetchHeaders(peer string, fork int, tip int) ([]Header, error) {
+	bc := pm.bc
+	bc.mu.Lock()
+	prev := bc.blocks[fork].Hash
+	bc.mu.Unlock()
+
+	headers := make([]Header, 0)
+	next := fork + 1
+	for next <= tip {
+		if len(headers) >= MAX_REORG_DEPTH {
+			return nil, errors.New("Fork too deep.")
+		}
+		msg, err := bc.sync.requestHeaders(peer, next)
+		if err != nil {
+			return nil, err
+		}
+		if err := validateHeaders(msg.Headers, next, prev); err != nil {
+			if err != errHeadersDiverged {
+				bc.p2p.Penalize(peer, P2P.MIS_BAD_HEADERS, err.Error())
+			}
+			return nil, err
+		}
+		if len(msg.Headers) == 0 {
+			break
+		}
+		headers = append(headers, msg.Headers...)
+		next += len(msg.Headers)
+		prev = msg.Headers[len(msg.Headers)-1].Hash
+	}
+	return headers, nil
+}
+
+// ヘッダに一致するブロック本体を取得する
+func (pm *partitionMonitor) fetchBodies(peer string, headers []Header) ([]*Block, error) {
+	bc := pm.bc
+	base := headers[0].Hight
+	blocks := make([]*Block, 0, len(headers))
+	results := make(chan *bodyResult, 1)
+
+	for len(blocks) < len(headers) {
+		start := base + len(blocks)
+		count := len(headers) - len(blocks)
+		if count > BODY_BATCH {
+			count = BODY_BATCH
+		}
+		bc.sync.requestBodies(&bodyRequest{start: start, count: count, peer: peer}, results)
+		res := <-results
+		if res.err != nil {
+			return nil, res.err
+		}
+		n := 0
+		for _, b := range res.blocks {
+			i := b.Hight - base
+			if i != len(blocks) {
+				continue
+			}
+			if b.Hash != headers[i].Hash || !b.isValid() {
+				bc.p2p.Penalize(peer, P2P.MIS_INVALID_BLOCK, "heal body ID="+strconv.Itoa(b.Hight))
+				return nil, errors.New("Invalid block from peer.")
+			}
+			blocks = append(blocks, b)
+			n++
+		}
+		if n == 0 {
+			return nil, errors.New("No blocks from peer.")
+		}
+	}
+	return blocks, nil
+}
+
+// 外れたブロックのデータを記録する
+func (pm *partitionMonitor) abandon(b *Block, reason string) {
+	if b.Data == "" {
+		return
+	}
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	for _, a := range pm.abandoned {
+		if a.Data == b.Data {
+			return
+		}
+	}
+	if len(pm.abandoned) >= MAX_ABANDONED {
+		pm.abandoned = pm.abandoned[1:]
+	}
+	pm.abandoned = append(pm.abandoned, AbandonedData{
+		Hight:     b.Hight,
+		Hash:      b.Hash,
+		Data:      b.Data,
+		Timestamp: b.Timestamp,
+		Reason:    reason,
+		At:        pm.bc.clock.Now().UnixNano(),
+	})
+}
+
+// チェーンに載っているデータ
+// (bc.muの中でabandonを呼ぶので、pm.muを持ったまま呼ばないこと)
+func (bc *BlockChain) dataOnChain() map[string]bool {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	on_chain := make(map[string]bool, len(bc.blocks))
+	for _, b := range bc.blocks {
+		on_chain[b.Data] = true
+	}
+	return on_chain
+}
+
+// 外れたデータのうち、まだチェーンに無いもの(同じデータは1つにまとめる)
+func missingData(list []AbandonedData, on_chain map[string]bool) []AbandonedData {
+	seen := make(map[string]bool)
+	missing := make([]AbandonedData, 0)
+	for _, a := range list {
+		if !on_chain[a.Data] && !seen[a.Data] {
+			seen[a.Data] = true
+			missing = append(missing, a)
+		}
+	}
+	return missing
+}
+
+// 外れたデータのうち、まだチェーンに無いもの
+// 状態の取得用なので一覧は変えない(コピーを返す)
+func (pm *partitionMonitor) pending() []AbandonedData {
+	on_chain := pm.bc.dataOnChain()
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	return missingData(pm.abandoned, on_chain)
+}
+
+// 再投入するデータを一覧から取り出す
+// チェーンに載ったものはここで捨てる(確認と取り出しは同じロックの中で行う)
+func (pm *partitionMonitor) take() []AbandonedData {
+	on_chain := pm.bc.dataOnChain()
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	missing := missingData(pm.abandoned, on_chain)
+	pm.abandoned = make([]AbandonedData, 0)
+	pm.resubmitting += len(missing)
+	return missing
+}
+
+// チェーンの先端とlocator
+func (bc *BlockChain) tipMsg() *TipMsg {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	if len(bc.blocks) == 0 {
+		return nil
+	}
+	last := len(bc.blocks) - 1
+	tm := &TipMsg{Tip: bc.blocks[last].header(), Locator: make([]Header, 0)}
+	step := 1
+	for h := last; h > 0 && len(tm.Locator) < MAX_LOCATOR-1; h -= step {
+		tm.Locator = append(tm.Locator, bc.blocks[h].header())
+		if len(tm.Locator) >= LOCATOR_DENSE {
+			step *= 2
+		}
+	}
+	tm.Locator = append(tm.Locator, bc.blocks[0].header())
+	return tm
+}
+
+// locatorのうち自分のチェーンと一致する一番高いブロックの高さ(無ければ-1)
+func (bc *BlockChain) forkPoint(locator []Header) int {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	for _, h := range locator {
+		if h.Hight >= 0 && h.Hight < len(bc.blocks) && bc.blocks[h.Hight].Hash == h.Hash {
+			return h.Hight
+		}
+	}
+	return -1
+}
+
+// 分岐後の最初のブロックがfirstで先端の高さがtipのチェーンの方が良いか(ロックは呼び出し元で取る)
+// 長い方を選び、同じ長さなら分岐後の最初のブロックが古い方を選ぶ
+func (bc *BlockChain) isBetter(first Header, tip int) bool {
+	last := len(bc.blocks) - 1
+	if tip != last {
+		return tip > last
+	}
+	if first.Hight > last {
+		return false
+	}
+	ours := bc.blocks[first.Hight]
+	if first.Timestamp != ours.Timestamp {
+		return first.Timestamp < ours.Timestamp
+	}
+	return first.Hash < ours.Hash
+}
+
+// 分岐点から先をblocksに入れ替える
+// 外れたブロックのうち、データが新しいチェーンに無いものを返す
+func (bc *BlockChain) reorg(blocks []*Block) (*ReorgReport, []*Block, error) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	fork := blocks[0].Hight - 1
+	if fork < 0 || fork >= len(bc.blocks) || bc.blocks[fork].Hash != blocks[0].Prev {
+		return nil, nil, errors.New("Chain changed while healing.")
+	}
+	if !bc.isBetter(blocks[0].header(), blocks[len(blocks)-1].Hight) {
+		return nil, nil, errors.New("Chain changed while healing.")
+	}
+
+	report := &ReorgReport{
+		Fork:   fork,
+		OldTip: bc.blocks[len(bc.blocks)-1].header(),
+		NewTip: blocks[len(blocks)-1].header(),
+		Added:  len(blocks),
+		At:     bc.clock.Now().UnixNano(),
+	}
+	old := bc.blocks[fork+1:]
+	report.Removed = len(old)
+
+	on_chain := make(map[string]bool)
+	for _, b := range blocks {
+		on_chain[b.Data] = true
+	}
+	removed := make([]*Block, 0)
+	for _, b := range old {
+		if !on_chain[b.Data] {
+			removed = append(removed, b)
+		}
+	}
+	report.Abandoned = len(removed)
+	bc.metrics.update(func(m *ChainMetrics) {
+		m.Reorgs++
+		m.Reorged += len(old)
+		if len(old) > m.MaxReorg {
+			m.MaxReorg = len(old)
+		}
+	})
+
+	bc.blocks = append(bc.blocks[:fork+1:fork+1], blocks...)
+	bc.connectOrphans()
+
+	return report, removed, nil
+}
+
+// tip交換の要求の処理
+// 要求にも送信元のtipが入っているので、こちらも分岐を確認する
+func (bc *BlockChain) ServeTip(from *P2P.Node, body []byte) ([]byte, error) {
+	msg := new(TipMsg)
+	if err := P2P.Unmarshal(body, msg); err != nil {
+		return nil, err
+	}
+	tm := bc.tipMsg()
+	if tm == nil {
+		return nil, P2P.ErrNotFound
+	}
+	peer := from.Addr()
+	if bc.partition.observe(peer, msg) {
+		go func() {
+			if err := bc.partition.heal(peer, msg); err != nil {
+				fmt.Println("Heal failed:", peer, err)
+			}
+		}()
+	}
+	return bc.p2p.Marshal(tm), nil
+}
+
+// 分断の状態を取得
+func (bc *BlockChain) PartitionStatus() PartitionStatus {
+	pm := bc.partition
+	hight, hash := -1, ""
+	if tm := bc.tipMsg(); tm != nil {
+		hight, hash = tm.Tip.Hight, tm.Tip.Hash
+	}
+	abandoned := pm.pending()
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	st := PartitionStatus{
+		Hight:        hight,
+		Hash:         hash,
+		Peers:        len(pm.peers),
+		Partitions:   pm.partitions,
+		Heals:        pm.heals,
+		Reorgs:       pm.reorgs,
+		LastReorg:    pm.last_reorg,
+		PeerTips:     make([]PeerTip, 0, len(pm.peers)),
+		Abandoned:    abandoned,
+		Resubmitting: pm.resubmitting,
+	}
+	diverged := 0
+	for _, pt := range pm.peers {
+		st.PeerTips = append(st.PeerTips, *pt)
+		if pt.Reachable {
+			st.Reachable++
+			if pt.Diverged {
+				diverged++
+			}
+		}
+	}
+	if !pm.since.IsZero() {
+		st.Since = pm.since.UnixNano()
+	}
+	st.Majority = 2*(st.Reachable+1) > st.Peers+1
+
+	switch {
+	case pm.healing:
+		st.State = PARTITION_HEALING
+	case st.Peers > 0 && st.Reachable == 0:
+		st.State = PARTITION_ISOLATED
+	case st.Reachable < st.Peers:
+		st.State = PARTITION_SPLIT
+	case diverged > 0:
+		st.State = PARTITION_DIVERGED
+	default:
+		st.State = PARTITION_OK
+	}
+	return st
+}
+
+// すぐに全ノードとtipを交換して修復する
+func (bc *BlockChain) Heal() PartitionStatus {
+	bc.partition.exchange()
+	return bc.PartitionStatus()
+}
+
+// 外れたデータを再投入する
+// マイニングは1つずつしかできないので、裏で順番に投入してチェーンに載るのを待つ
+func (bc *BlockChain) ResubmitAbandoned() int {
+	list := bc.partition.take()
+	go func() {
+		for _, a := range list {
+			bc.resubmit(a)
+		}
+	}()
+	return len(list)
+}
+
+// データを1つ再投入して、チェーンに載るのを待つ
+func (bc *BlockChain) resubmit(a AbandonedData) {
+	pm := bc.partition
+	deadline := bc.clock.Now().Add(RESUBMIT_TIMEOUT)
+	for bc.IsMining() && bc.clock.Now().Before(deadline) {
+		bc.clock.Sleep(time.Second)
+	}
+	if bc.GetBlockByData([]byte(a.Data)) == nil {
+		fmt.Println("Resubmit:", a.Hight, a.Hash)
+		bc.SaveData([]byte(a.Data))
+		for bc.GetBlockByData([]byte(a.Data)) == nil && bc.clock.Now().Before(deadline) {
+			bc.clock.Sleep(time.Second)
+		}
+	}
+
+	pm.mu.Lock()
+	pm.resubmitting--
+	pm.mu.Unlock()
+	if bc.GetBlockByData([]byte(a.Data)) == nil {
+		// 載らなかったので戻しておく
+		fmt.Println("Resubmit failed:", a.Hight, a.Hash)
+		pm.mu.Lock()
+		pm.abandoned = append(pm.abandoned, a)
+		pm.mu.Unlock()
+	}
+}
@@ -0,0 +1,303 @@
+/*
+  My Block Chain: Block Chain integrity check and repair module
+*/
+package Block
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+整合性の確認と修復
+	チェーンの全ブロックについて、中身から計算したハッシュと記録されたハッシュ、
+	前のブロックのハッシュとのつながりを確認する(block_verify.goのhashレベル)。
+
+	壊れたブロックが見つかったら、その高さの範囲のヘッダを全ノードに要求し、
+	過半数のノードが同じハッシュを返した場合だけ、そのハッシュのブロック本体を
+	取得して手元のブロックと入れ替える。過半数がそろわなければ入れ替えない
+	(少数のノードが嘘をついても直せないかわりに壊されない)。
+	入れ替えは記録して、APIから確認できる。
+	合意したブロックが手元の前後のブロックとつながらない場合は、手元のチェーンが
+	過半数と分岐しているので1つずつは入れ替えず、分断の修復(reorg)に任せる。
+
+	修復は定期的な確認の時と、CheckAndRepairを呼んだ時(POST /check/repair)に行う。
+	CheckChain(GET /check)は確認だけで、修復はしない。
+*/
+const (
+	CHECK_INTERVAL = time.Minute
+	MAX_REPAIR_LOG = 256
+)
+
+var errRepairDiverged = errors.New("Majority chain diverges from ours.")
+
+// 検証に失敗したブロック
+type InvalidBlock struct {
+	Hight  int    `json:"hight"`
+	Hash   string `json:"hash"`
+	Reason string `json:"reason"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// ブロックの入れ替えの記録
+type RepairRecord struct {
+	Hight   int    `json:"hight"`
+	OldHash string `json:"old_hash"`
+	NewHash string `json:"new_hash"`
+	Peer    string `json:"peer"`  // 本体を取得したノード
+	Votes   int    `json:"votes"` // 同じハッシュを返したノードの数
+	Peers   int    `json:"peers"` // 問い合わせたノードの数
+	At      int64  `json:"at"`
+}
+
+// 修復できなかったブロック
+type RepairFailure struct {
+	Hight  int    `json:"hight"`
+	Reason string `json:"reason"`
+}
+
+// 整合性の確認の結果
+type IntegrityReport struct {
+	Level    string          `json:"level"`
+	Hight    int             `json:"hight"`
+	Checked  int             `json:"checked"`
+	OK       bool            `json:"ok"`
+	Invalid  []InvalidBlock  `json:"invalid"`
+	Repaired []RepairRecord  `json:"repaired"`
+	Failed   []RepairFailure `json:"failed"`
+	At       int64           `json:"at"`
+}
+
+// 修復の状態
+type integrity struct {
+	mu        sync.Mutex
+	repairing bool
+	last      *IntegrityReport
+	log       []RepairRecord
+}
+
+// 定期的な確認のループ
+func (bc *BlockChain) checkLoop() {
+	for bc.wait(CHECK_INTERVAL) {
+		if bc.IsInitialized() {
+			bc.CheckAndRepair()
+		}
+	}
+}
+
+// チェーンの整合性を確認する(修復はしない)
+// 壊れたブロックはinvalid_blocksに記録する
+func (bc *BlockChain) CheckChain() IntegrityReport {
+	report := bc.Verify(VERIFY_HASH)
+
+	bc.mu.Lock()
+	invalid := make([]*Block, 0)
+	for _, ib := range report.Invalid {
+		if ib.Hight < len(bc.blocks) {
+			invalid = append(invalid, bc.blocks[ib.Hight])
+		}
+	}
+	bc.invalid_blocks = invalid
+	bc.mu.Unlock()
+	return report
+}
+
+// 整合性を確認して、壊れていれば過半数のノードが合意するブロックで修復する
+func (bc *BlockChain) CheckAndRepair() IntegrityReport {
+	report := bc.CheckChain()
+	if report.OK {
+		bc.setLastReport(&report)
+		return report
+	}
+	for _, ib := range report.Invalid {
+		fmt.Println("Invalid Block Found!:", ib.Hight, ib.Reason, ib.Hash)
+	}
+
+	ig := &bc.integrity
+	ig.mu.Lock()
+	if ig.repairing {
+		ig.mu.Unlock()
+		return report
+	}
+	ig.repairing = true
+	ig.mu.Unlock()
+
+	bc.repair(&report)
+
+	ig.mu.Lock()
+	ig.repairing = false
+	ig.mu.Unlock()
+
+	// 修復した後の状態を確認し直す
+	after := bc.CheckChain()
+	report.OK = after.OK
+	bc.setLastReport(&report)
+	return report
+}
+
+// 最後の確認の結果を記録する
+func (bc *BlockChain) setLastReport(report *IntegrityReport) {
+	ig := &bc.integrity
+	ig.mu.Lock()
+	ig.last = report
+	ig.mu.Unlock()
+}
+
+// 最後の確認の結果と修復の記録
+func (bc *BlockChain) RepairLog() (*IntegrityReport, []RepairRecord) {
+	ig := &bc.integrity
+	ig.mu.Lock()
+	defer ig.mu.Unlock()
+	return ig.last, append([]RepairRecord{}, ig.log...)
+}
+
+// 壊れたブロックを修復する
+// つながりが壊れている場合は、前のブロックが壊れている可能性もあるので両方を確認する
+func (bc *BlockChain) repair(report *IntegrityReport) {
+	targets := make(map[int]bool)
+	for _, ib := range report.Invalid {
+		targets[ib.Hight] = true
+		if ib.Reason == INVALID_LINK {
+			targets[ib.Hight-1] = true
+		}
+	}
+	hights := make([]int, 0, len(targets))
+	for h := range targets {
+		hights = append(hights, h)
+	}
+	sort.Ints(hights)
+
+	peers := bc.p2p.Peers()
+	if len(peers) == 0 {
+		for _, h := range hights {
+			report.Failed = append(report.Failed, RepairFailure{Hight: h, Reason: "no peers"})
+		}
+		return
+	}
+	votes := bc.collectVotes(peers, hights[0], hights[len(hights)-1])
+
+	for i, h := range hights {
+		rec, err := bc.repairBlock(h, votes[h], len(peers))
+		if err == errRepairDiverged {
+			// 残りは分断の修復で入れ替わっている(あとで確認し直す)
+			for _, rest := range hights[i:] {
+				report.Failed = append(report.Failed, RepairFailure{Hight: rest, Reason: err.Error()})
+			}
+			break
+		}
+		if err != nil {
+			fmt.Println("Repair failed:", h, err)
+			report.Failed = append(report.Failed, RepairFailure{Hight: h, Reason: err.Error()})
+			continue
+		}
+		if rec == nil {
+			// 手元のブロックが過半数と一致していた
+			continue
+		}
+		fmt.Println("Repaired block:", rec.Hight, rec.OldHash, "->", rec.NewHash, "from", rec.Peer, "votes", rec.Votes, "of", rec.Peers)
+		report.Repaired = append(report.Repaired, *rec)
+
+		ig := &bc.integrity
+		ig.mu.Lock()
+		if len(ig.log) >= MAX_REPAIR_LOG {
+			ig.log = ig.log[1:]
+		}
+		ig.log = append(ig.log, *rec)
+		ig.mu.Unlock()
+	}
+}
+
+// 各ノードにlowからhighまでのヘッダを要求し、高さごとにハッシュを返したノードを集める
+func (bc *BlockChain) collectVotes(peers []string, low int, high int) map[int]map[string][]string {
+	votes := make(map[int]map[string][]string)
+	for h := low; h <= high; h++ {
+		votes[h] = make(map[string][]string)
+	}
+	for _, peer := range peers {
+		next := low
+		for next <= high {
+			msg, err := bc.sync.requestHeaders(peer, next)
+			if err != nil || len(msg.Headers) == 0 {
+				break
+			}
+			for _, hd := range msg.Headers {
+				if hd.Hight >= low && hd.Hight <= high {
+					votes[hd.Hight][hd.Hash] = append(votes[hd.Hight][hd.Hash], peer)
+				}
+			}
+			next += len(msg.Headers)
+		}
+	}
+	return votes
+}
+
+// 1つのブロックを過半数のノードが合意するブロックに入れ替える
+// 手元のブロックが合意と一致していればnilを返す
+func (bc *BlockChain) repairBlock(hight int, votes map[string][]string, peers int) (*RepairRecord, error) {
+	// 過半数のノードが返したハッシュ
+	agreed := ""
+	for hash, voters := range votes {
+		if 2*len(voters) > peers {
+			agreed = hash
+		}
+	}
+	if agreed == "" {
+		return nil, errors.New("No majority.")
+	}
+
+	bc.mu.Lock()
+	if hight >= len(bc.blocks) {
+		bc.mu.Unlock()
+		return nil, errors.New("Chain changed while repairing.")
+	}
+	old := bc.blocks[hight]
+	bc.mu.Unlock()
+	if old.Hash == agreed && old.Hash == old.calcHash() {
+		return nil, nil
+	}
+
+	// 合意したノードから本体を取得する
+	results := make(chan *bodyResult, 1)
+	for _, peer := range votes[agreed] {
+		bc.sync.requestBodies(&bodyRequest{start: hight, count: 1, peer: peer}, results)
+		res := <-results
+		if res.err != nil || len(res.blocks) == 0 {
+			continue
+		}
+		b := res.blocks[0]
+		if b.Hight != hight || b.Hash != agreed || !b.isValid() {
+			continue
+		}
+
+		bc.mu.Lock()
+		if hight >= len(bc.blocks) || bc.blocks[hight] != old {
+			bc.mu.Unlock()
+			return nil, errors.New("Chain changed while repairing.")
+		}
+		// 前後のブロックとつながらなければ、過半数のチェーンに入れ替える
+		if (hight > 0 && b.Prev != bc.blocks[hight-1].Hash) || (hight+1 < len(bc.blocks) && bc.blocks[hight+1].Prev != b.Hash) {
+			bc.mu.Unlock()
+			fmt.Println("Repair diverged:", hight, "heal from", peer)
+			bc.partition.healPeer(peer)
+			return nil, errRepairDiverged
+		}
+		b.Child = old.Child
+		b.Sibling = old.Sibling
+		bc.blocks[hight] = b
+		bc.mu.Unlock()
+
+		return &RepairRecord{
+			Hight:   hight,
+			OldHash: old.Hash,
+			NewHash: b.Hash,
+			Peer:    peer,
+			Votes:   len(votes[agreed]),
+			Peers:   peers,
+			At:      bc.clock.Now().UnixNano(),
+		}, nil
+	}
+	return nil, errors.New("No valid block from peers.")
+}
@@ -0,0 +1,621 @@
+/*
+  My Block Chain: Block Chain synchronization module
+*/
+package Block
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"../P2P"
+)
+
+const (
+	SYNC_IDLE    = "idle"
+	SYNC_HEADERS = "headers"
+	SYNC_BODIES  = "bodies"
+	SYNC_DONE    = "done"
+	SYNC_FAILED  = "failed"
+
+	MAX_HEADERS           = 200   // 1メッセージのヘッダ数
+	BODY_BATCH            = 16    // 1要求のブロック数
+	MAX_SYNC_PAYLOAD      = 60000 // 1メッセージの最大サイズ
+	MAX_INFLIGHT_PER_PEER = 4
+	MAX_SYNC_RETRY        = 5
+	HEADER_TIMEOUT        = 2 * time.Second
+	BODY_TIMEOUT          = 3 * time.Second
+)
+
+// ブロックヘッダ
+type Header struct {
+	Hight     int    `json:"hight"`
+	Prev      string `json:"prev"`
+	Hash      string `json:"hash"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// 範囲要求のメッセージ
+type RangeMsg struct {
+	Start int `json:"start"`
+	Count int `json:"count"`
+}
+
+// ヘッダ応答のメッセージ
+type HeadersMsg struct {
+	Tip     int      `json:"tip"`
+	Start   int      `json:"start"`
+	Headers []Header `json:"headers"`
+}
+
+// ブロック応答のメッセージ
+type BlocksMsg struct {
+	Start  int      `json:"start"`
+	Blocks []*Block `json:"blocks"`
+}
+
+// 同期の進捗
+type SyncStatus struct {
+	State      string `json:"state"`
+	Target     int    `json:"target"`
+	Height     int    `json:"height"`
+	Headers    int    `json:"headers"`
+	Downloaded int    `json:"downloaded"`
+	Peers      int    `json:"peers"`
+	Inflight   int    `json:"inflight"` // 応答待ちのブロック本体の要求数
+	Retries    int    `json:"retries"`
+	StartedAt  int64  `json:"started_at"`
+	ElapsedMs  int64  `json:"elapsed_ms"`
+	Error      string `json:"error,omitempty"`
+}
+
+// ブロック本体の要求
+type bodyRequest struct {
+	start int
+	count int
+	peer  string
+	tries int
+	tried map[string]bool
+}
+
+// ブロック本体の取得結果
+type bodyResult struct {
+	req    *bodyRequest
+	blocks []*Block
+	err    error
+}
+
+// 同期処理の状態機械
+type syncer struct {
+	bc      *BlockChain
+	mu      sync.Mutex
+	running bool
+	status  SyncStatus
+	started time.Time
+}
+
+// ブロックのヘッダ
+func (b *Block) header() Header {
+	return Header{Hight: b.Hight, Prev: b.Prev, Hash: b.Hash, Timestamp: b.Timestamp}
+}
+
+// 同期処理の初期化
+func newSyncer(bc *BlockChain) *syncer {
+	s := new(syncer)
+	s.bc = bc
+	s.status.State = SYNC_IDLE
+	return s
+}
+
+// 同期を開始する。既に同期中ならfalseを返す
+func (s *syncer) start(target int) bool {
+	s.mu.Lock()
+	if s.running {
+		s.mu.Unlock()
+		return false
+	}
+	s.running = true
+	s.started = s.bc.clock.Now()
+	s.status = SyncStatus{State: SYNC_HEADERS, Target: target, StartedAt: s.started.UnixNano()}
+	s.mu.Unlock()
+
+	err := s.run()
+
+	s.mu.Lock()
+	if err != nil {
+		fmt.Println("Sync failed:", err)
+		s.status.State = SYNC_FAILED
+		s.status.Error = err.Error()
+	} else {
+		s.status.State = SYNC_DONE
+	}
+	s.status.Inflight = 0
+	s.status.ElapsedMs = int64(s.bc.clock.Now().Sub(s.started) / time.Millisecond)
+	s.running = false
+	s.mu.Unlock()
+
+	return true
+}
+
+// 同期中でなければ、裏で同期を始める
+func (s *syncer) kick(target int) {
+	s.mu.Lock()
+	running := s.running
+	s.mu.Unlock()
+	if !running {
+		go s.start(target)
+	}
+}
+
+// 進捗の更新
+func (s *syncer) update(fn func(st *SyncStatus)) {
+	s.mu.Lock()
+	fn(&s.status)
+	s.status.ElapsedMs = int64(s.bc.clock.Now().Sub(s.started) / time.Millisecond)
+	s.mu.Unlock()
+}
+
+// 進捗の取得
+func (s *syncer) get() SyncStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.status
+	if s.running {
+		st.ElapsedMs = int64(s.bc.clock.Now().Sub(s.started) / time.Millisecond)
+	}
+	return st
+}
+
+// 同期処理本体
+func (s *syncer) run() error {
+	bc := s.bc
+
+	base, base_hash := bc.tip()
+	s.update(func(st *SyncStatus) { st.Height = base })
+
+	// 全ノードにヘッダを要求し、一番長いチェーンを持つノードを探す
+	replies := s.collectHeaders(base + 1)
+	tips := make(map[string]int)
+	for peer, msg := range replies {
+		tips[peer] = msg.Tip
+	}
+	s.update(func(st *SyncStatus) { st.Peers = len(tips) })
+
+	candidates := peersByTip(tips)
+	if len(candidates) == 0 || tips[candidates[0]] <= base {
+		// 同期済み
+		fmt.Println("Sync: already up to date", base)
+		return nil
+	}
+	s.update(func(st *SyncStatus) {
+		if st.Target < tips[candidates[0]] {
+			st.Target = tips[candidates[0]]
+		}
+	})
+
+	// ヘッダの取得と検証
+	headers := make([]Header, 0)
+	next := base + 1
+	prev := base_hash
+	diverged := ""
+	msg := replies[candidates[0]]
+	for len(candidates) > 0 {
+		best := candidates[0]
+		if msg == nil {
+			msg, _ = s.requestHeaders(best, next)
+		}
+		if msg != nil {
+			if err := validateHeaders(msg.Headers, next, prev); err == errHeadersDiverged {
+				// 別の分岐を伸ばしているだけなので減点しない(修復は分断の監視に任せる)
+				if diverged == "" {
+					diverged = best
+				}
+				msg = nil
+			} else if err != nil {
+				s.bc.p2p.Penalize(best, P2P.MIS_BAD_HEADERS, err.Error())
+				msg = nil
+			}
+		}
+		if msg == nil {
+			// このノードは諦めて次のノードに聞く
+			fmt.Println("Sync: drop header peer", best)
+			candidates = candidates[1:]
+			msg = nil
+			s.update(func(st *SyncStatus) { st.Retries++ })
+			continue
+		}
+		if len(msg.Headers) == 0 {
+			break
+		}
+		headers = append(headers, msg.Headers...)
+		next += len(msg.Headers)
+		prev = msg.Headers[len(msg.Headers)-1].Hash
+		s.update(func(st *SyncStatus) { st.Headers = len(headers) })
+		if next > tips[best] {
+			break
+		}
+		msg = nil
+	}
+	if len(headers) == 0 {
+		if diverged != "" {
+			fmt.Println("Sync: diverged from", diverged)
+			go bc.partition.healPeer(diverged)
+			return errHeadersDiverged
+		}
+		return errors.New("No valid headers.")
+	}
+
+	// ブロック本体を複数ノードから並行して取得
+	s.update(func(st *SyncStatus) { st.State = SYNC_BODIES })
+	return s.downloadBodies(base, headers, tips)
+}
+
+// 全ノードに同時にヘッダを要求する
+func (s *syncer) collectHeaders(start int) map[string]*HeadersMsg {
+	replies := make(map[string]*HeadersMsg)
+	mu := sync.Mutex{}
+	wg := sync.WaitGroup{}
+
+	for _, node := range s.bc.p2p.List() {
+		if node.Self {
+			continue
+		}
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+			msg, err := s.requestHeaders(peer, start)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			replies[peer] = msg
+			mu.Unlock()
+		}(node.Addr())
+	}
+	wg.Wait()
+
+	return replies
+}
+
+// 指定ノードにヘッダを要求して応答を待つ
+func (s *syncer) requestHeaders(peer string, start int) (*HeadersMsg, error) {
+	req := s.bc.p2p.Marshal(&RangeMsg{Start: start, Count: MAX_HEADERS})
+	res, err := s.bc.p2p.Request(P2P.REQ_HEADERS, req, &P2P.RequestOptions{
+		Timeout: HEADER_TIMEOUT,
+		Retries: P2P.REQUEST_RETRY,
+		Peers:   []string{peer},
+	})
+	if err != nil {
+		s.update(func(st *SyncStatus) { st.Retries++ })
+		return nil, err
+	}
+	msg := new(HeadersMsg)
+	if err := P2P.Unmarshal(res.Body, msg); err != nil || msg.Start != start {
+		return nil, errors.New("Invalid headers message.")
+	}
+	return msg, nil
+}
+
+// 指定ノードにブロック本体を要求する
+func (s *syncer) requestBodies(r *bodyRequest, results chan *bodyResult) {
+	req := s.bc.p2p.Marshal(&RangeMsg{Start: r.start, Count: r.count})
+	res, err := s.bc.p2p.Request(P2P.REQ_BLOCKS, req, &P2P.RequestOptions{
+		Timeout: BODY_TIMEOUT,
+		Peers:   []string{r.peer},
+	})
+	if err != nil {
+		results <- &bodyResult{req: r, err: err}
+		return
+	}
+	msg := new(BlocksMsg)
+	if err := P2P.Unmarshal(res.Body, msg); err != nil {
+		results <- &bodyResult{req: r, err: errors.New("Invalid blocks message.")}
+		return
+	}
+	results <- &bodyResult{req: r, blocks: msg.Blocks}
+}
+
+// ブロック本体の並行取得
+func (s *syncer) downloadBodies(base int, headers []Header, tips map[string]int) error {
+	bc := s.bc
+	last := base + len(headers)
+
+	// 取得範囲の分割
+	pending := make(map[int]*bodyRequest)
+	for start := base + 1; start <= last; start += BODY_BATCH {
+		count := BODY_BATCH
+		if start+count-1 > last {
+			count = last - start + 1
+		}
+		pending[start] = &bodyRequest{start: start, count: count, tried: make(map[string]bool)}
+	}
+
+	bodies := make(map[int]*Block)
+	appended := base
+	peers := peersByTip(tips)
+	inflight := make(map[string]int) // ノードごとの応答待ちの要求数
+	outstanding := 0                 // 応答待ちの要求の合計
+	results := make(chan *bodyResult, len(pending))
+	rr := 0
+
+	for appended < last {
+		// 未割り当ての範囲をノードに割り当てる
+		for _, start := range sortedKeys(pending) {
+			r := pending[start]
+			if r.peer != "" {
+				continue
+			}
+			peer := pickPeer(peers, tips, inflight, r, &rr)
+			if peer == "" {
+				continue
+			}
+			r.peer = peer
+			inflight[peer]++
+			outstanding++
+			go s.requestBodies(r, results)
+		}
+		s.update(func(st *SyncStatus) { st.Inflight = outstanding })
+
+		if len(inflight) == 0 {
+			return errors.New("No peer to download blocks.")
+		}
+
+		res := <-results
+		r := res.req
+		inflight[r.peer]--
+		if inflight[r.peer] <= 0 {
+			delete(inflight, r.peer)
+		}
+		outstanding--
+		s.update(func(st *SyncStatus) { st.Inflight = outstanding })
+		if res.err != nil {
+			// 別のノードに出し直す
+			fmt.Println("Sync: request failed", r.peer, r.start, r.count, res.err)
+			r.tried[r.peer] = true
+			r.peer = ""
+			r.tries++
+			s.update(func(st *SyncStatus) { st.Retries++ })
+			if r.tries > MAX_SYNC_RETRY {
+				return errors.New("Too many retries.")
+			}
+			continue
+		}
+
+		for _, b := range res.blocks {
+			i := b.Hight - base - 1
+			if i < 0 || i >= len(headers) || bodies[b.Hight] != nil {
+				continue
+			}
+			// ヘッダと一致し、ハッシュが正しいものだけ受け取る
+			if b.Hash != headers[i].Hash || !b.isValid() {
+				fmt.Println("Sync: invalid body", r.peer, b.Hight)
+				s.bc.p2p.Penalize(r.peer, P2P.MIS_INVALID_BLOCK, "sync body ID="+strconv.Itoa(b.Hight))
+				continue
+			}
+			bodies[b.Hight] = b
+		}
+		s.shrinkPending(pending, bodies, r)
+
+		// 揃った所までチェーンにつなぐ
+		batch := make([]*Block, 0)
+		for h := appended + 1; bodies[h] != nil; h++ {
+			batch = append(batch, bodies[h])
+			delete(bodies, h)
+		}
+		if len(batch) > 0 {
+			if err := bc.appendSynced(batch); err != nil {
+				return err
+			}
+			bc.membershipChanged(batch...)
+			bc.blobsChanged(batch...)
+			appended += len(batch)
+			s.update(func(st *SyncStatus) {
+				st.Downloaded += len(batch)
+				st.Height = appended
+			})
+		}
+	}
+
+	return nil
+}
+
+// 受け取った分を要求から外す
+func (s *syncer) shrinkPending(pending map[int]*bodyRequest, bodies map[int]*Block, r *bodyRequest) {
+	first := -1
+	for h := r.start; h < r.start+r.count; h++ {
+		if bodies[h] == nil {
+			first = h
+			break
+		}
+	}
+	delete(pending, r.start)
+	if first < 0 {
+		return
+	}
+
+	// メッセージサイズの都合などで途中までしか来なかったので残りを出し直す
+	if first == r.start {
+		r.tried[r.peer] = true
+		r.tries++
+	}
+	r.count -= first - r.start
+	r.start = first
+	r.peer = ""
+	pending[first] = r
+}
+
+// 割り当て先のノードを選ぶ
+func pickPeer(peers []string, tips map[string]int, inflight map[string]int, r *bodyRequest, rr *int) string {
+	fallback := ""
+	for i := 0; i < len(peers); i++ {
+		peer := peers[(*rr+i)%len(peers)]
+		if tips[peer] < r.start+r.count-1 || inflight[peer] >= MAX_INFLIGHT_PER_PEER {
+			continue
+		}
+		if r.tried[peer] {
+			// 失敗したノードは他にいなければ使う
+			if fallback == "" {
+				fallback = peer
+			}
+			continue
+		}
+		*rr = (*rr + i + 1) % len(peers)
+		return peer
+	}
+	return fallback
+}
+
+// チェーンの長い順にノードを並べる
+func peersByTip(tips map[string]int) []string {
+	peers := make([]string, 0, len(tips))
+	for peer := range tips {
+		peers = append(peers, peer)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		if tips[peers[i]] != tips[peers[j]] {
+			return tips[peers[i]] > tips[peers[j]]
+		}
+		return peers[i] < peers[j]
+	})
+	return peers
+}
+
+// 要求範囲を開始位置順に並べる
+func sortedKeys(pending map[int]*bodyRequest) []int {
+	keys := make([]int, 0, len(pending))
+	for k := range pending {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	return keys
+}
+
+// ヘッダの先頭が手元のチェーンにつながらない(分岐している)
+var errHeadersDiverged = errors.New("Headers do not link to our chain.")
+
+// ヘッダのつながりを検証
+// ヘッダ列の中でつながっていなければ送ったノードの不正。
+// 先頭がprevにつながらないだけならerrHeadersDivergedを返す(正直なノードでも起きる)
+func validateHeaders(headers []Header, start int, prev string) error {
+	for i, h := range headers {
+		if h.Hight != start+i {
+			return errors.New("Header height mismatch.")
+		}
+		if i > 0 && h.Prev != headers[i-1].Hash {
+			return errors.New("Header chain broken.")
+		}
+	}
+	if len(headers) > 0 && headers[0].Prev != prev {
+		return errHeadersDiverged
+	}
+	return nil
+}
+
+// チェーンの最後のブロック
+func (bc *BlockChain) tip() (int, string) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	last := bc.blocks[len(bc.blocks)-1]
+	return last.Hight, last.Hash
+}
+
+// チェーンの最後のブロックの高さとハッシュ
+func (bc *BlockChain) Tip() (int, string) {
+	return bc.tip()
+}
+
+// チェーンの全ブロックのヘッダ
+func (bc *BlockChain) Headers() []Header {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	headers := make([]Header, 0, len(bc.blocks))
+	for _, b := range bc.blocks {
+		headers = append(headers, b.header())
+	}
+	return headers
+}
+
+// 同期したブロックをチェーンにつなぐ
+func (bc *BlockChain) appendSynced(blocks []*Block) error {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	for _, b := range blocks {
+		if b.Hight < len(bc.blocks) && bc.blocks[b.Hight].Hash == b.Hash {
+			// 既につながっている
+			continue
+		}
+		last_block := bc.blocks[len(bc.blocks)-1]
+		if b.Prev != last_block.Hash {
+			// 同期中に別のブロックがつながった
+			return errors.New("Chain changed while syncing.")
+		}
+		bc.blocks = append(bc.blocks, b)
+	}
+	bc.connectOrphans()
+
+	return nil
+}
+
+// 同期の進捗を取得
+func (bc *BlockChain) SyncStatus() SyncStatus {
+	return bc.sync.get()
+}
+
+// ヘッダ要求の処理
+func (bc *BlockChain) ServeHeaders(body []byte) ([]byte, error) {
+	fmt.Println("serve headers")
+
+	req := new(RangeMsg)
+	if err := P2P.Unmarshal(body, req); err != nil {
+		return nil, err
+	}
+	if req.Count <= 0 || req.Count > MAX_HEADERS {
+		req.Count = MAX_HEADERS
+	}
+
+	res := &HeadersMsg{Start: req.Start, Headers: make([]Header, 0)}
+	bc.mu.Lock()
+	res.Tip = bc.blocks[len(bc.blocks)-1].Hight
+	for h := req.Start; h >= 0 && h < len(bc.blocks) && h < req.Start+req.Count; h++ {
+		res.Headers = append(res.Headers, bc.blocks[h].header())
+	}
+	bc.mu.Unlock()
+
+	return bc.p2p.Marshal(res), nil
+}
+
+// ブロック範囲要求の処理
+func (bc *BlockChain) ServeBlocks(body []byte) ([]byte, error) {
+	fmt.Println("serve blocks")
+
+	req := new(RangeMsg)
+	if err := P2P.Unmarshal(body, req); err != nil {
+		return nil, err
+	}
+	if req.Count <= 0 || req.Count > BODY_BATCH {
+		req.Count = BODY_BATCH
+	}
+
+	// メッセージサイズに収まる所まで詰める
+	res := &BlocksMsg{Start: req.Start, Blocks: make([]*Block, 0)}
+	size := 0
+	bc.mu.Lock()
+	for h := req.Start; h >= 0 && h < len(bc.blocks) && h < req.Start+req.Count; h++ {
+		b := bc.p2p.Marshal(bc.blocks[h])
+		if len(res.Blocks) > 0 && size+len(b) > MAX_SYNC_PAYLOAD {
+			break
+		}
+		size += len(b)
+		res.Blocks = append(res.Blocks, bc.blocks[h])
+	}
+	bc.mu.Unlock()
+	if len(res.Blocks) == 0 {
+		return nil, P2P.ErrNotFound
+	}
+
+	return bc.p2p.Marshal(res), nil
+}
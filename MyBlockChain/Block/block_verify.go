@@ -0,0 +1,178 @@
+/*
+  My Block Chain: Block Chain verifier module
+*/
+package Block
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+/*
+チェーンの検証
+	確認の深さ(レベル)を選んでチェーンの全ブロックを検証し、失敗した高さと理由を
+	全て報告(IntegrityReport)に並べる。上のレベルは下のレベルの確認も全て行う。
+
+	link       前のブロックのハッシュとつながっているか
+	hash       中身から計算したハッシュと記録されたハッシュが一致するか
+	pow        ハッシュがPoWの条件(DIFFICULTY)を満たすか(genesisは除く)
+	consensus  ブロックを受け付ける規則を全て満たすか
+	           (genesisが正しい、高さが連続、データの大きさ、時刻が親より後で未来でない)
+	state      先頭から状態(参加ノードの一覧)を再計算し、適用できない記録が無いか
+	           (訂正記録は対象のブロックのハッシュ、署名、作成者も確認する)
+	           (消去記録は保存記録があるか、署名が持ち主か管理者かも確認する)
+
+	primaryのマイニングはPoWの条件を満たさなくてもブロックを作るので、
+	powより上のレベルではそのブロックも失敗として報告する。
+*/
+const (
+	VERIFY_LINK = iota + 1
+	VERIFY_HASH
+	VERIFY_POW
+	VERIFY_CONSENSUS
+	VERIFY_STATE
+
+	DEFAULT_VERIFY_LEVEL = VERIFY_HASH
+
+	// 失敗の理由
+	INVALID_LINK    = "link"      // 前のブロックのハッシュとつながらない
+	INVALID_HASH    = "hash"      // 中身から計算したハッシュと合わない
+	INVALID_POW     = "pow"       // PoWの条件を満たさない
+	INVALID_GENESIS = "genesis"   // genesisブロックが違う
+	INVALID_HIGHT   = "hight"     // 高さが連続していない
+	INVALID_SIZE    = "size"      // データが大きすぎる
+	INVALID_TIME    = "timestamp" // 時刻が親より前か、未来すぎる
+	INVALID_STATE   = "state"     // 状態に適用できない記録
+)
+
+var ErrInvalidLevel = errors.New("Invalid verify level.")
+var ErrInvalidChain = errors.New("Invalid chain.")
+
+// レベルの名前
+var verify_levels = []string{"", "link", "hash", "pow", "consensus", "state"}
+
+// 名前からレベルを取得(空なら既定のレベル)
+func ParseVerifyLevel(name string) (int, error) {
+	if name == "" {
+		return DEFAULT_VERIFY_LEVEL, nil
+	}
+	for level, n := range verify_levels {
+		if level > 0 && n == strings.ToLower(name) {
+			return level, nil
+		}
+	}
+	return 0, ErrInvalidLevel
+}
+
+// レベルの名前の一覧
+func VerifyLevels() []string {
+	return append([]string{}, verify_levels[1:]...)
+}
+
+// 指定したレベルでチェーンを検証する(修復はしない)
+func (bc *BlockChain) Verify(level int) IntegrityReport {
+	if level < VERIFY_LINK || level > VERIFY_STATE {
+		level = DEFAULT_VERIFY_LEVEL
+	}
+	bc.mu.Lock()
+	blocks := append([]*Block{}, bc.blocks...)
+	bc.mu.Unlock()
+
+	report := IntegrityReport{
+		Level:    verify_levels[level],
+		Hight:    len(blocks) - 1,
+		Checked:  len(blocks),
+		Invalid:  make([]InvalidBlock, 0),
+		Repaired: make([]RepairRecord, 0),
+		Failed:   make([]RepairFailure, 0),
+		At:       bc.clock.Now().UnixNano(),
+	}
+	fail := func(b *Block, i int, reason string, detail string) {
+		report.Invalid = append(report.Invalid, InvalidBlock{Hight: i, Hash: b.Hash, Reason: reason, Detail: detail})
+	}
+
+	var state *Membership
+	if level >= VERIFY_STATE {
+		bc.members.mu.Lock()
+		if bc.members.enabled {
+			state = bc.members.genesis.copy()
+		}
+		bc.members.mu.Unlock()
+	}
+	limit := bc.clock.Now().Add(MAX_TIME_SKEW).UnixNano()
+
+	for i, b := range blocks {
+		if i > 0 && b.Prev != blocks[i-1].Hash {
+			fail(b, i, INVALID_LINK, "prev "+b.Prev+" != "+blocks[i-1].Hash)
+		}
+		if level >= VERIFY_HASH && b.Hash != b.calcHash() {
+			fail(b, i, INVALID_HASH, "calculated "+b.calcHash())
+		}
+		if level >= VERIFY_POW && i > 0 && !strings.HasPrefix(b.Hash, DIFFICULTY) {
+			fail(b, i, INVALID_POW, "hash does not start with "+DIFFICULTY)
+		}
+		if level >= VERIFY_CONSENSUS {
+			bc.verifyConsensus(blocks, i, limit, fail)
+		}
+		if level >= VERIFY_STATE {
+			if err := replayBlock(state, blocks, i); err != nil {
+				fail(b, i, INVALID_STATE, err.Error())
+			}
+		}
+	}
+	report.OK = len(report.Invalid) == 0
+	return report
+}
+
+// ブロックを受け付ける規則の確認
+func (bc *BlockChain) verifyConsensus(blocks []*Block, i int, limit int64, fail func(*Block, int, string, string)) {
+	b := blocks[i]
+	if i == 0 {
+		if b.Hash != newGenesisBlock().Hash {
+			fail(b, i, INVALID_GENESIS, "unexpected genesis block")
+		}
+		return
+	}
+	if b.Hight != i {
+		fail(b, i, INVALID_HIGHT, "hight "+strconv.Itoa(b.Hight))
+	}
+	if len(b.Data) > MAX_DATA_SIZE {
+		fail(b, i, INVALID_SIZE, strconv.Itoa(len(b.Data))+" bytes")
+	}
+	if b.Timestamp <= blocks[i-1].Timestamp {
+		fail(b, i, INVALID_TIME, "not after parent")
+	} else if b.Timestamp > limit {
+		fail(b, i, INVALID_TIME, "in the future")
+	}
+}
+
+// 状態を1ブロック進める(参加ノードの制限が無ければstateはnil)
+func replayBlock(state *Membership, blocks []*Block, i int) error {
+	b := blocks[i]
+	if state != nil {
+		state.Hight = b.Hight
+	}
+	switch recordType(b.Data) {
+	case RECORD_MEMBERSHIP:
+		if state == nil {
+			return nil
+		}
+		tx := new(MembershipTx)
+		if err := json.Unmarshal([]byte(b.Data), tx); err != nil {
+			return err
+		}
+		return state.apply(tx)
+	case RECORD_AMENDMENT:
+		_, err := checkAmendment(state, blocks, i)
+		return err
+	case RECORD_BLOB:
+		_, err := checkBlobRef(blocks, i)
+		return err
+	case RECORD_ERASURE:
+		_, _, err := checkErasure(state, blocks, i)
+		return err
+	}
+	return nil
+}
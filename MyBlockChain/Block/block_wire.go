@@ -0,0 +1,233 @@
+/*
+  My Block Chain: Block wire format module
+*/
+package Block
+
+import (
+	"../P2P"
+)
+
+// データ書き換え要求のメッセージ
+type ModifyMsg struct {
+	Hight int    `json:"hight"`
+	Data  string `json:"data"`
+}
+
+// バイナリ形式に変換
+func (b *Block) EncodeWire(w *P2P.Writer) {
+	w.Varint(int64(b.Hight))
+	w.Hash(b.Prev)
+	w.Hash(b.Hash)
+	w.String(b.Nonce)
+	w.Varint(int64(b.PowCount))
+	w.String(b.Data)
+	w.Varint(b.Timestamp)
+}
+
+// バイナリ形式から変換
+func (b *Block) DecodeWire(r *P2P.Reader) {
+	b.Hight = int(r.Varint())
+	b.Prev = r.Hash()
+	b.Hash = r.Hash()
+	b.Nonce = r.String()
+	b.PowCount = int(r.Varint())
+	b.Data = r.String()
+	b.Timestamp = r.Varint()
+}
+
+// バイナリ形式に変換
+func (h *Header) EncodeWire(w *P2P.Writer) {
+	w.Varint(int64(h.Hight))
+	w.Hash(h.Prev)
+	w.Hash(h.Hash)
+	w.Varint(h.Timestamp)
+}
+
+// バイナリ形式から変換
+func (h *Header) DecodeWire(r *P2P.Reader) {
+	h.Hight = int(r.Varint())
+	h.Prev = r.Hash()
+	h.Hash = r.Hash()
+	h.Timestamp = r.Varint()
+}
+
+// バイナリ形式に変換
+func (m *RangeMsg) EncodeWire(w *P2P.Writer) {
+	w.Varint(int64(m.Start))
+	w.Varint(int64(m.Count))
+}
+
+// バイナリ形式から変換
+func (m *RangeMsg) DecodeWire(r *P2P.Reader) {
+	m.Start = int(r.Varint())
+	m.Count = int(r.Varint())
+}
+
+// バイナリ形式に変換
+// 高さは連番なので先頭だけ送れば足りるが、検証のため各ヘッダに残す
+func (m *HeadersMsg) EncodeWire(w *P2P.Writer) {
+	w.Varint(int64(m.Tip))
+	w.Varint(int64(m.Start))
+	w.Uvarint(uint64(len(m.Headers)))
+	for i := range m.Headers {
+		m.Headers[i].EncodeWire(w)
+	}
+}
+
+// バイナリ形式から変換
+func (m *HeadersMsg) DecodeWire(r *P2P.Reader) {
+	m.Tip = int(r.Varint())
+	m.Start = int(r.Varint())
+	n := r.Count()
+	m.Headers = make([]Header, n)
+	for i := 0; i < n && r.Err() == nil; i++ {
+		m.Headers[i].DecodeWire(r)
+	}
+}
+
+// バイナリ形式に変換
+func (m *BlocksMsg) EncodeWire(w *P2P.Writer) {
+	w.Varint(int64(m.Start))
+	w.Uvarint(uint64(len(m.Blocks)))
+	for _, b := range m.Blocks {
+		b.EncodeWire(w)
+	}
+}
+
+// バイナリ形式から変換
+func (m *BlocksMsg) DecodeWire(r *P2P.Reader) {
+	m.Start = int(r.Varint())
+	n := r.Count()
+	m.Blocks = make([]*Block, 0, n)
+	for i := 0; i < n && r.Err() == nil; i++ {
+		b := new(Block)
+		b.DecodeWire(r)
+		m.Blocks = append(m.Blocks, b)
+	}
+}
+
+// バイナリ形式に変換
+func (m *ModifyMsg) EncodeWire(w *P2P.Writer) {
+	w.Varint(int64(m.Hight))
+	w.String(m.Data)
+}
+
+// バイナリ形式から変換
+func (m *ModifyMsg) DecodeWire(r *P2P.Reader) {
+	m.Hight = int(r.Varint())
+	m.Data = r.String()
+}
+
+// バイナリ形式に変換
+func (m *TipMsg) EncodeWire(w *P2P.Writer) {
+	m.Tip.EncodeWire(w)
+	w.Uvarint(uint64(len(m.Locator)))
+	for i := range m.Locator {
+		m.Locator[i].EncodeWire(w)
+	}
+}
+
+// バイナリ形式から変換
+func (m *TipMsg) DecodeWire(r *P2P.Reader) {
+	m.Tip.DecodeWire(r)
+	n := r.Count()
+	m.Locator = make([]Header, n)
+	for i := 0; i < n && r.Err() == nil; i++ {
+		m.Locator[i].DecodeWire(r)
+	}
+}
+
+// ブロックの検証(形式のみ。ハッシュの検証はisValidで行う)
+func (b *Block) Validate() error {
+	if b.Hight < 0 {
+		return P2P.Malformed("hight")
+	}
+	if b.Hash == "" {
+		return P2P.Malformed("hash")
+	}
+	if len(b.Data) > MAX_DATA_SIZE {
+		return P2P.Malformed("data too large")
+	}
+	return nil
+}
+
+// ヘッダの検証
+func (h *Header) Validate() error {
+	if h.Hight < 0 || h.Hash == "" {
+		return P2P.Malformed("header")
+	}
+	return nil
+}
+
+// 範囲指定の検証
+func (m *RangeMsg) Validate() error {
+	if m.Start < 0 {
+		return P2P.Malformed("start")
+	}
+	if m.Count <= 0 || m.Count > MAX_HEADERS {
+		return P2P.Malformed("count")
+	}
+	return nil
+}
+
+// ヘッダ応答の検証
+func (m *HeadersMsg) Validate() error {
+	if m.Start < 0 || m.Tip < 0 {
+		return P2P.Malformed("range")
+	}
+	if len(m.Headers) > MAX_HEADERS {
+		return P2P.Malformed("too many headers")
+	}
+	for i := range m.Headers {
+		if err := m.Headers[i].Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ブロック応答の検証
+func (m *BlocksMsg) Validate() error {
+	if m.Start < 0 {
+		return P2P.Malformed("start")
+	}
+	if len(m.Blocks) > MAX_HEADERS {
+		return P2P.Malformed("too many blocks")
+	}
+	for _, b := range m.Blocks {
+		if b == nil {
+			return P2P.Malformed("block")
+		}
+		if err := b.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tip交換の検証
+func (m *TipMsg) Validate() error {
+	if err := m.Tip.Validate(); err != nil {
+		return err
+	}
+	if len(m.Locator) > MAX_LOCATOR {
+		return P2P.Malformed("too many locator headers")
+	}
+	for i := range m.Locator {
+		if err := m.Locator[i].Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// データ書き換え要求の検証
+func (m *ModifyMsg) Validate() error {
+	if m.Hight < 0 {
+		return P2P.Malformed("hight")
+	}
+	if len(m.Data) > MAX_DATA_SIZE {
+		return P2P.Malformed("data too large")
+	}
+	return nil
+}
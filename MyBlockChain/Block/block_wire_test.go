@@ -0,0 +1,157 @@
+/*
+  My Block Chain: Block decoder fuzz tests
+*/
+package Block
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"../P2P"
+)
+
+/*
+ネットワークから受け取るBlockパッケージのメッセージと記録のファズテスト
+	go test -run=^$ -fuzz=FuzzUnmarshal ./Block/
+	go test -run=^$ -fuzz=FuzzRecord ./Block/
+
+	メッセージ(ブロック、範囲要求、ヘッダ、ブロック応答、tip、書き換え要求)は
+	P2P.Unmarshal(中でValidateを呼ぶ)で解析し、失敗は*DecodeErrorで返すこと。
+	チェーンに載る記録(参加ノードの変更、訂正、保存、消去)は他のノードが作った
+	ブロックのデータなので、検証(replayBlock)でpanicしないこと。
+*/
+
+const fuzz_hash = "00112233445566778899aabbccddeeff00112233445566778899aabbccddeeff"
+
+// 種類ごとの正しいメッセージ(シード)
+func fuzzMessages() []P2P.Codec {
+	h := Header{Hight: 1, Prev: fuzz_hash, Hash: fuzz_hash, Timestamp: 1}
+	b := &Block{Hight: 1, Prev: fuzz_hash, Hash: fuzz_hash, Timestamp: 1, Data: "data"}
+	return []P2P.Codec{
+		b,
+		&RangeMsg{Start: 1, Count: MAX_HEADERS},
+		&HeadersMsg{Tip: 1, Start: 1, Headers: []Header{h}},
+		&BlocksMsg{Start: 1, Blocks: []*Block{b}},
+		&TipMsg{Tip: h, Locator: []Header{h}},
+		&ModifyMsg{Hight: 1, Data: "data"},
+	}
+}
+
+// 種類の番号から受け取るメッセージを作る
+func fuzzTarget(kind uint8) P2P.Codec {
+	switch kind % 6 {
+	case 0:
+		return new(Block)
+	case 1:
+		return new(RangeMsg)
+	case 2:
+		return new(HeadersMsg)
+	case 3:
+		return new(BlocksMsg)
+	case 4:
+		return new(TipMsg)
+	}
+	return new(ModifyMsg)
+}
+
+// バイナリ形式
+func fuzzEncode(v P2P.Codec) []byte {
+	w := P2P.NewWriter()
+	v.EncodeWire(w)
+	return w.Data()
+}
+
+func FuzzUnmarshal(f *testing.F) {
+	for i, m := range fuzzMessages() {
+		f.Add(uint8(i), fuzzEncode(m))
+		if b, err := json.Marshal(m); err == nil {
+			f.Add(uint8(i), b)
+		}
+	}
+	f.Fuzz(func(t *testing.T, kind uint8, data []byte) {
+		v := fuzzTarget(kind)
+		err := P2P.Unmarshal(data, v)
+		if err != nil {
+			if !P2P.IsDecodeError(err) {
+				t.Fatalf("not a decode error: %T %v", err, err)
+			}
+			return
+		}
+		if b, ok := v.(*Block); ok {
+			b.isValid()
+		}
+		again := fuzzTarget(kind)
+		if err := P2P.Unmarshal(fuzzEncode(v), again); err != nil {
+			t.Fatalf("re-encoded message rejected: %v", err)
+		}
+	})
+}
+
+// 記録を検証するチェーン(genesis、ただのデータ、保存記録)
+func fuzzChain(t testing.TB, owner *P2P.Identity) []*Block {
+	blob := []byte("blob")
+	ref, err := json.Marshal(&BlobRef{Type: RECORD_BLOB, Hash: BlobHash(blob), Size: len(blob), Owner: owner.Key()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks := []*Block{newGenesisBlock()}
+	for _, data := range []string{"data", string(ref)} {
+		prev := blocks[len(blocks)-1]
+		b := &Block{Hight: prev.Hight + 1, Prev: prev.Hash, Timestamp: prev.Timestamp + 1, Data: data}
+		b.hash()
+		blocks = append(blocks, b)
+	}
+	return blocks
+}
+
+// チェーンの最後に記録を追加したもの
+func withRecord(blocks []*Block, data string) []*Block {
+	b := &Block{Hight: len(blocks), Prev: blocks[len(blocks)-1].Hash, Data: data}
+	return append(append([]*Block{}, blocks...), b)
+}
+
+// 種類ごとの正しい記録(シード)
+func fuzzRecords(t testing.TB, admin *P2P.Identity, blocks []*Block) []string {
+	other, err := P2P.NewIdentityFrom(bytes.NewReader(bytes.Repeat([]byte{1}, 64)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	member := &MembershipTx{Op: MEMBER_ADD, Key: other.Key(), Seq: 1}
+	member.Sign(admin)
+	amend := &AmendmentTx{Hight: 1, Hash: blocks[1].Hash, Data: "fixed", Reason: "typo"}
+	amend.Sign(admin)
+	erase := &ErasureTx{Hash: BlobHash([]byte("blob")), Reason: "request"}
+	erase.Sign(admin)
+
+	records := []string{"data", blocks[2].Data}
+	for _, tx := range []interface{}{member, amend, erase} {
+		b, err := json.Marshal(tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, string(b))
+	}
+	return records
+}
+
+func FuzzRecord(f *testing.F) {
+	admin, err := P2P.NewIdentityFrom(bytes.NewReader(make([]byte, 64)))
+	if err != nil {
+		f.Fatal(err)
+	}
+	blocks := fuzzChain(f, admin)
+	for _, data := range fuzzRecords(f, admin, blocks) {
+		// シードは全て有効な記録であること
+		if err := replayBlock(newMembership([]string{admin.Key()}, nil), withRecord(blocks, data), len(blocks)); err != nil {
+			f.Fatalf("seed rejected: %v %s", err, data)
+		}
+		f.Add(data)
+	}
+	f.Fuzz(func(t *testing.T, data string) {
+		chain := withRecord(blocks, data)
+		recordType(data)
+		replayBlock(nil, chain, len(blocks))
+		replayBlock(newMembership([]string{admin.Key()}, nil), chain, len(blocks))
+	})
+}
@@ -0,0 +1,189 @@
+/*
+  My Block Chain: P2P clock module
+*/
+package P2P
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+/*
+時計
+	待ち時間やタイムアウトは時計(Clock)を通して扱う。通常は実際の時刻を使い、
+	シミュレーションでは進め方を外から決める仮想の時計(VirtualClock)を使う。
+
+	仮想の時計はAdvanceで進めた時だけ時間が経ち、期限の来たタイマを期限の順に
+	(同じ期限なら登録した順に)起こす。待っているだけでは時間は進まない。
+*/
+
+// 時計
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	After(d time.Duration) <-chan time.Time
+	AfterFunc(d time.Duration, f func())
+}
+
+// 実際の時刻
+type RealClock struct{}
+
+func (RealClock) Now() time.Time                         { return time.Now() }
+func (RealClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+func (RealClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (RealClock) AfterFunc(d time.Duration, f func())    { time.AfterFunc(d, f) }
+
+// 仮想の時計のタイマ
+type virtualTimer struct {
+	when time.Time
+	seq  uint64
+	ch   chan time.Time
+	fn   func()
+}
+
+// 期限の順に並べたタイマ
+type timerHeap []*virtualTimer
+
+func (h timerHeap) Len() int { return len(h) }
+func (h timerHeap) Less(i, j int) bool {
+	if !h[i].when.Equal(h[j].when) {
+		return h[i].when.Before(h[j].when)
+	}
+	return h[i].seq < h[j].seq
+}
+func (h timerHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *timerHeap) Push(x interface{}) { *h = append(*h, x.(*virtualTimer)) }
+func (h *timerHeap) Pop() interface{} {
+	old := *h
+	t := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return t
+}
+
+// 仮想の時計
+type VirtualClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	seq    uint64
+	timers timerHeap
+}
+
+// 仮想の時計の作成
+func NewVirtualClock(start time.Time) *VirtualClock {
+	vc := new(VirtualClock)
+	vc.now = start
+	return vc
+}
+
+// 現在の時刻
+func (vc *VirtualClock) Now() time.Time {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+	return vc.now
+}
+
+// タイマの登録
+func (vc *VirtualClock) add(d time.Duration, ch chan time.Time, fn func()) {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+	if d < 0 {
+		d = 0
+	}
+	vc.seq++
+	heap.Push(&vc.timers, &virtualTimer{when: vc.now.Add(d), seq: vc.seq, ch: ch, fn: fn})
+}
+
+// 時計が進むまで待つ
+func (vc *VirtualClock) Sleep(d time.Duration) {
+	<-vc.After(d)
+}
+
+// 時計がd進んだら受信できるチャネル
+func (vc *VirtualClock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	vc.add(d, ch, nil)
+	return ch
+}
+
+// 時計がd進んだらfを呼ぶ(Advanceを呼んだゴルーチンで呼ぶ)
+func (vc *VirtualClock) AfterFunc(d time.Duration, f func()) {
+	vc.add(d, nil, f)
+}
+
+// 次のタイマの期限(無ければfalse)
+func (vc *VirtualClock) Next() (time.Time, bool) {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+	if len(vc.timers) == 0 {
+		return time.Time{}, false
+	}
+	return vc.timers[0].when, true
+}
+
+// 待っているタイマの数
+func (vc *VirtualClock) Pending() int {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+	return len(vc.timers)
+}
+
+// 時計をd進めて、期限の来たタイマを順に起こす
+func (vc *VirtualClock) Advance(d time.Duration) {
+	vc.AdvanceTo(vc.Now().Add(d))
+}
+
+// 時計をtまで進めて、期限の来たタイマを順に起こす
+func (vc *VirtualClock) AdvanceTo(t time.Time) {
+	for {
+		vc.mu.Lock()
+		if len(vc.timers) == 0 || vc.timers[0].when.After(t) {
+			if t.After(vc.now) {
+				vc.now = t
+			}
+			vc.mu.Unlock()
+			return
+		}
+		timer := heap.Pop(&vc.timers).(*virtualTimer)
+		if timer.when.After(vc.now) {
+			vc.now = timer.when
+		}
+		now := vc.now
+		vc.mu.Unlock()
+
+		if timer.ch != nil {
+			timer.ch <- now
+		}
+		if timer.fn != nil {
+			timer.fn()
+		}
+	}
+}
+
+// 時計の設定(Initの前に呼ぶ。設定しなければ実際の時刻)
+func (p2p *P2PNetwork) SetClock(clock Clock) {
+	p2p.clock = clock
+}
+
+// 使っている時計
+func (p2p *P2PNetwork) Clock() Clock {
+	if p2p.clock == nil {
+		return RealClock{}
+	}
+	return p2p.clock
+}
+
+// 時刻を扱う管理構造に時計を配る(Initで呼ぶ)
+func (p2p *P2PNetwork) useClock() {
+	p2p.foreign.clock = p2p.clock
+	p2p.replay.clock = p2p.clock
+	p2p.hello_replay.clock = p2p.clock
+	p2p.scores.clock = p2p.clock
+	p2p.unverified.clock = p2p.clock
+	p2p.gossip.seen.clock = p2p.clock
+	p2p.penalties.clock = p2p.clock
+	p2p.inv_requests.clock = p2p.clock
+	p2p.requests.entropy = p2p.entropy
+	p2p.dht.table.clock = p2p.clock
+	p2p.dht.providers.clock = p2p.clock
+}
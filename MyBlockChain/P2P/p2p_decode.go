@@ -0,0 +1,243 @@
+/*
+  My Block Chain: P2P message validation module
+*/
+package P2P
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// 受信メッセージの解析エラー
+var (
+	ErrShortFrame     = errors.New("Short frame.")
+	ErrBadMagic       = errors.New("Invalid magic.")
+	ErrBadVersion     = errors.New("Unsupported version.")
+	ErrBadLength      = errors.New("Invalid length.")
+	ErrTooLarge       = errors.New("Payload too large.")
+	ErrBadChecksum    = errors.New("Invalid checksum.")
+	ErrUnknownCommand = errors.New("Unknown command.")
+	ErrEmptyPayload   = errors.New("Empty payload.")
+	ErrShortMessage   = errors.New("Short message.")
+	ErrBadVarint      = errors.New("Invalid varint.")
+	ErrBadHash        = errors.New("Invalid hash.")
+	ErrTrailingBytes  = errors.New("Trailing bytes.")
+	ErrBadJSON        = errors.New("Invalid JSON.")
+	ErrInvalidField   = errors.New("Invalid field.")
+)
+
+const (
+	MAX_INV_HASHES = 256
+	MAX_HOST_LEN   = 255
+
+	// 不正なメッセージの減点
+	PENALTY_MALFORMED = 10
+	PENALTY_PANIC     = 50
+	PENALTY_LIMIT     = 100
+	PENALTY_DECAY     = time.Minute // この時間ごとに減点を半分にする
+	PENALTY_BLOCK     = 10 * time.Minute
+	MAX_PENALTY_ADDRS = 4096
+)
+
+// 解析エラー
+type DecodeError struct {
+	Cmd    int    // 解析中のコマンド(不明な場合は0)
+	Reason string // 詳細
+	Err    error  // エラーの種類(ErrShortMessageなど)
+}
+
+// エラーメッセージ
+func (e *DecodeError) Error() string {
+	msg := "Decode error"
+	if e.Cmd != 0 {
+		msg += fmt.Sprintf(" (cmd=%d)", e.Cmd)
+	}
+	msg += ": " + e.Err.Error()
+	if e.Reason != "" {
+		msg += " " + e.Reason
+	}
+	return msg
+}
+
+// errors.Is で種類を判定できるようにする
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// 不正なフィールドのエラーを作る
+func Malformed(reason string) error {
+	return &DecodeError{Err: ErrInvalidField, Reason: reason}
+}
+
+// 解析エラーか判定
+func IsDecodeError(err error) bool {
+	var de *DecodeError
+	return errors.As(err, &de)
+}
+
+// 内容の検証ができるメッセージ
+type validator interface {
+	Validate() error
+}
+
+// 送信元ごとの減点
+type penalty struct {
+	score   int
+	updated time.Time
+	blocked time.Time
+	total   uint64
+	reason  string
+}
+
+// 減点の統計情報
+type PenaltyStats struct {
+	Addr    string `json:"addr"`
+	Score   int    `json:"score"`
+	Total   uint64 `json:"total"`
+	Blocked bool   `json:"blocked"`
+	Reason  string `json:"reason"`
+}
+
+// 不正なメッセージを送ってきた送信元の管理
+// 減点が上限を超えた送信元からのパケットはしばらく捨てる
+type penaltyBox struct {
+	mu      sync.Mutex
+	entries map[string]*penalty
+	clock   Clock
+}
+
+// 減点する
+func (pb *penaltyBox) add(addr string, points int, reason string) {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+
+	if pb.entries == nil {
+		pb.entries = make(map[string]*penalty)
+	}
+	now := clockNow(pb.clock)
+	p, ok := pb.entries[addr]
+	if !ok {
+		if len(pb.entries) >= MAX_PENALTY_ADDRS {
+			pb.expire(now)
+		}
+		p = new(penalty)
+		pb.entries[addr] = p
+	}
+	p.decay(now)
+	p.score += points
+	p.total++
+	p.reason = reason
+	if p.score >= PENALTY_LIMIT {
+		fmt.Println("Block sender:", addr, reason)
+		p.blocked = now.Add(PENALTY_BLOCK)
+	}
+}
+
+// 受信を拒否中か確認
+func (pb *penaltyBox) isBlocked(addr string) bool {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+
+	p, ok := pb.entries[addr]
+	if !ok {
+		return false
+	}
+	return clockNow(pb.clock).Before(p.blocked)
+}
+
+// 古い記録を消す(ロックは呼び出し元で取る)
+func (pb *penaltyBox) expire(now time.Time) {
+	for addr, p := range pb.entries {
+		p.decay(now)
+		if p.score == 0 && now.After(p.blocked) {
+			delete(pb.entries, addr)
+		}
+	}
+}
+
+// 時間経過で減点を減らす
+func (p *penalty) decay(now time.Time) {
+	if p.updated.IsZero() {
+		p.updated = now
+		return
+	}
+	for now.Sub(p.updated) >= PENALTY_DECAY && p.score > 0 {
+		p.score /= 2
+		p.updated = p.updated.Add(PENALTY_DECAY)
+	}
+	if p.score == 0 {
+		p.updated = now
+	}
+}
+
+// 統計情報
+func (pb *penaltyBox) stats() []PenaltyStats {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+
+	now := clockNow(pb.clock)
+	stats := make([]PenaltyStats, 0, len(pb.entries))
+	for addr, p := range pb.entries {
+		p.decay(now)
+		stats = append(stats, PenaltyStats{
+			Addr:    addr,
+			Score:   p.score,
+			Total:   p.total,
+			Blocked: now.Before(p.blocked),
+			Reason:  p.reason,
+		})
+	}
+	return stats
+}
+
+// バイナリ形式のメッセージの検証
+func (node *Node) Validate() error {
+	if node.Host == "" || len(node.Host) > MAX_HOST_LEN {
+		return Malformed("host")
+	}
+	if node.P2PPort == 0 {
+		return Malformed("p2p_port")
+	}
+	if node.PubKey != "" && !validKey(node.PubKey) {
+		return Malformed("pubkey")
+	}
+	return nil
+}
+
+// インベントリ通知の検証
+func (inv *InvMsg) Validate() error {
+	if _, _, err := splitAddr(inv.From); err != nil {
+		return Malformed("from")
+	}
+	if inv.Kind <= 0 {
+		return Malformed("kind")
+	}
+	if len(inv.Hashes) == 0 || len(inv.Hashes) > MAX_INV_HASHES {
+		return Malformed("hashes")
+	}
+	return nil
+}
+
+// 要求メッセージの検証
+func (req *RequestMsg) Validate() error {
+	if _, _, err := splitAddr(req.From); err != nil {
+		return Malformed("from")
+	}
+	if req.Method <= 0 || req.Method >= MAX_REQ {
+		return Malformed("method")
+	}
+	return nil
+}
+
+// 応答メッセージの検証
+func (res *ResponseMsg) Validate() error {
+	if _, _, err := splitAddr(res.From); err != nil {
+		return Malformed("from")
+	}
+	if res.Status < RES_OK || res.Status > RES_ERROR {
+		return Malformed("status")
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+/*
+  My Block Chain: P2P decoder fuzz tests
+*/
+package P2P
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+/*
+受信したバイト列を解析する関数のファズテスト
+	go test -run=^$ -fuzz=FuzzDecodeFrame ./P2P/
+	go test -run=^$ -fuzz=FuzzUnmarshal ./P2P/
+
+	どんな入力でもpanicせず、失敗は*DecodeErrorで返すこと。
+	解析できたメッセージは、組み立て直しても同じように解析できること。
+*/
+
+const fuzz_hash = "00112233445566778899aabbccddeeff00112233445566778899aabbccddeeff"
+
+// 種類ごとの正しいメッセージ(シード)
+func fuzzMessages() []Codec {
+	node := Node{Host: "127.0.0.1", ApiPort: 3000, P2PPort: 4000, PubKey: fuzz_hash}
+	return []Codec{
+		&node,
+		&InvMsg{From: "127.0.0.1:4000", Kind: 1, Hashes: []string{fuzz_hash}},
+		&RequestMsg{ID: 1, From: "127.0.0.1:4000", Method: REQ_BLOCK, Body: []byte{WIRE_TAG, 0x02}},
+		&ResponseMsg{ID: 1, From: "127.0.0.1:4001", Status: RES_OK, Body: []byte("body")},
+		&HelloMsg{Node: node, Reply: true, Eph: make([]byte, 32), Ack: make([]byte, 32)},
+		fuzzGossip(),
+		&DHTFindMsg{Key: fuzz_hash},
+		&DHTNodesMsg{Nodes: []Node{node}, Providers: []Node{node}},
+	}
+}
+
+// 署名したゴシップのメッセージ
+func fuzzGossip() *GossipMsg {
+	id, err := NewIdentityFrom(bytes.NewReader(make([]byte, 64)))
+	if err != nil {
+		panic(err)
+	}
+	return newGossipMsg(id, 1, GOSSIP_TTL, CMD_NEWBLOCK, []byte{WIRE_TAG})
+}
+
+// 種類の番号から受け取るメッセージを作る
+func fuzzTarget(kind uint8) Codec {
+	switch kind % 8 {
+	case 0:
+		return new(Node)
+	case 1:
+		return new(InvMsg)
+	case 2:
+		return new(RequestMsg)
+	case 3:
+		return new(ResponseMsg)
+	case 4:
+		return new(HelloMsg)
+	case 5:
+		return new(GossipMsg)
+	case 6:
+		return new(DHTFindMsg)
+	}
+	return new(DHTNodesMsg)
+}
+
+// コマンドのペイロードとして受け取るメッセージ(P2Pの外で解析するものはnil)
+func fuzzPayload(cmd int) Codec {
+	switch cmd {
+	case CMD_ADDSRV, CMD_DELSRV:
+		return new(Node)
+	case CMD_INV, CMD_GETDATA:
+		return new(InvMsg)
+	case CMD_REQUEST:
+		return new(RequestMsg)
+	case CMD_RESPONSE:
+		return new(ResponseMsg)
+	case CMD_HELLO:
+		return new(HelloMsg)
+	case CMD_GOSSIP:
+		return new(GossipMsg)
+	}
+	return nil
+}
+
+// バイナリ形式のペイロード
+func fuzzEncode(v Codec) []byte {
+	w := NewWriter()
+	v.EncodeWire(w)
+	return w.Data()
+}
+
+// 解析の失敗が*DecodeErrorか確認する
+func checkDecodeError(t *testing.T, err error) {
+	if err != nil && !IsDecodeError(err) {
+		t.Fatalf("not a decode error: %T %v", err, err)
+	}
+}
+
+func FuzzUnmarshal(f *testing.F) {
+	for i, m := range fuzzMessages() {
+		f.Add(uint8(i), fuzzEncode(m))
+	}
+	f.Fuzz(func(t *testing.T, kind uint8, data []byte) {
+		v := fuzzTarget(kind)
+		err := Unmarshal(data, v)
+		checkDecodeError(t, err)
+		if err != nil {
+			return
+		}
+		again := fuzzTarget(kind)
+		if err := Unmarshal(fuzzEncode(v), again); err != nil {
+			t.Fatalf("re-encoded message rejected: %v", err)
+		}
+	})
+}
+
+func FuzzDecodeFrame(f *testing.F) {
+	id, err := NewIdentityFrom(bytes.NewReader(make([]byte, 64)))
+	if err != nil {
+		f.Fatal(err)
+	}
+	// コマンドごとの正しいフレーム(ペイロードの無いものも含む)
+	msgs := fuzzMessages()
+	seeds := map[int][]byte{
+		CMD_ADDSRV:   fuzzEncode(msgs[0]),
+		CMD_DELSRV:   nil,
+		CMD_INV:      fuzzEncode(msgs[1]),
+		CMD_REQUEST:  fuzzEncode(msgs[2]),
+		CMD_RESPONSE: fuzzEncode(msgs[3]),
+		CMD_HELLO:    fuzzEncode(msgs[4]),
+		CMD_GOSSIP:   fuzzEncode(msgs[5]),
+	}
+	for cmd := 1; cmd < MAX_CMD; cmd++ {
+		payload, ok := seeds[cmd]
+		if !ok {
+			continue
+		}
+		frame, err := encodeFrame(id, nil, wire_magic, cmd, payload, time.Unix(0, 0), bytes.NewReader(make([]byte, 8)))
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(frame)
+	}
+	f.Fuzz(func(t *testing.T, frame []byte) {
+		env, err := decodeFrame(frame, wire_magic)
+		checkDecodeError(t, err)
+		if err != nil {
+			return
+		}
+		if env.cmd <= 0 || env.cmd >= MAX_CMD || len(env.body) > MAX_PAYLOAD {
+			t.Fatalf("invalid envelope accepted: cmd=%d len=%d", env.cmd, len(env.body))
+		}
+		if v := fuzzPayload(env.cmd); v != nil {
+			checkDecodeError(t, Unmarshal(env.body, v))
+		}
+	})
+}
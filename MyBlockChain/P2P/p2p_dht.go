@@ -0,0 +1,652 @@
+/*
+  My Block Chain: P2P distributed hash table module
+*/
+package P2P
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/bits"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+分散ハッシュテーブル(Kademlia)
+	ノードIDは識別鍵のSHA-256で、距離はIDのXORで測る。ブロックやデータのハッシュも
+	同じ空間のキーとして扱う。各ノードは距離ごとのバケットに最大DHT_K個の連絡先を持ち、
+	キーに近いノードへ問い合わせを繰り返して、キーに最も近いノードを探す。
+
+	データの保持者(プロバイダ)はキーに近いノードに登録しておき、探すときは同じように
+	キーに近いノードへ問い合わせる。ブロックは持っているノード自身もプロバイダとして答える。
+
+	問い合わせ先とは通常の要求/応答で通信するので、未接続のノードにはアドレスを確認
+	(ダイヤルバック)してから問い合わせる。全ノードとつながる必要はない。
+*/
+const (
+	// 要求の種類
+	REQ_FIND_NODE      = 4 // キーに近いノード
+	REQ_FIND_PROVIDERS = 5 // キーのプロバイダとキーに近いノード
+	REQ_ADD_PROVIDER   = 6 // 送信元をプロバイダとして登録
+
+	DHT_ID_BITS = 256
+	DHT_K       = 16 // バケットの大きさ、応答で返すノード数
+	DHT_ALPHA   = 3  // 同時に問い合わせる数
+
+	DHT_TIMEOUT      = 2 * time.Second
+	DHT_DIAL_TIMEOUT = 3 * time.Second
+	DHT_DIAL_POLL    = 50 * time.Millisecond
+
+	PROVIDER_TTL      = time.Hour
+	MAX_PROVIDERS     = 20    // 1つのキーに登録するプロバイダの数
+	MAX_PROVIDER_KEYS = 65536 // 登録を受け付けるキーの数
+)
+
+var ErrBadKey = errors.New("Invalid DHT key.")
+
+// ノードID、キー
+type dhtID [sha256.Size]byte
+
+// 識別鍵からノードIDを作る
+func nodeID(key string) (dhtID, bool) {
+	var id dhtID
+	b, err := hex.DecodeString(key)
+	if err != nil || len(b) != KEY_SIZE {
+		return id, false
+	}
+	return dhtID(sha256.Sum256(b)), true
+}
+
+// ハッシュ(16進)をキーにする
+func dhtKey(hash string) (dhtID, bool) {
+	var id dhtID
+	b, err := hex.DecodeString(hash)
+	if err != nil || len(b) != len(id) {
+		return id, false
+	}
+	copy(id[:], b)
+	return id, true
+}
+
+// 距離
+func (id dhtID) xor(other dhtID) dhtID {
+	var d dhtID
+	for i := range id {
+		d[i] = id[i] ^ other[i]
+	}
+	return d
+}
+
+// 距離に対応するバケットの番号(先頭から一致するビット数)
+func (id dhtID) bucket(other dhtID) int {
+	d := id.xor(other)
+	for i, b := range d {
+		if b != 0 {
+			return i*8 + bits.LeadingZeros8(b)
+		}
+	}
+	return DHT_ID_BITS - 1
+}
+
+// ノードをキーに近い順に並べる
+func sortByDistance(nodes []Node, target dhtID) {
+	sort.SliceStable(nodes, func(i, j int) bool {
+		a, _ := nodeID(nodes[i].PubKey)
+		b, _ := nodeID(nodes[j].PubKey)
+		da, db := a.xor(target), b.xor(target)
+		return bytes.Compare(da[:], db[:]) < 0
+	})
+}
+
+// キーの問い合わせ
+type DHTFindMsg struct {
+	Key string `json:"key"`
+}
+
+// バイナリ形式に変換
+func (m *DHTFindMsg) EncodeWire(w *Writer) {
+	w.Hash(m.Key)
+}
+
+// バイナリ形式から変換
+func (m *DHTFindMsg) DecodeWire(r *Reader) {
+	m.Key = r.Hash()
+}
+
+// キーの問い合わせの検証
+func (m *DHTFindMsg) Validate() error {
+	if _, ok := dhtKey(m.Key); !ok {
+		return Malformed("key")
+	}
+	return nil
+}
+
+// 問い合わせの応答
+type DHTNodesMsg struct {
+	Nodes     []Node `json:"nodes"`
+	Providers []Node `json:"providers"`
+}
+
+// バイナリ形式に変換
+func (m *DHTNodesMsg) EncodeWire(w *Writer) {
+	w.Uvarint(uint64(len(m.Nodes)))
+	for i := range m.Nodes {
+		m.Nodes[i].EncodeWire(w)
+	}
+	w.Uvarint(uint64(len(m.Providers)))
+	for i := range m.Providers {
+		m.Providers[i].EncodeWire(w)
+	}
+}
+
+// バイナリ形式から変換
+func (m *DHTNodesMsg) DecodeWire(r *Reader) {
+	n := r.Count()
+	m.Nodes = make([]Node, n)
+	for i := 0; i < n && r.Err() == nil; i++ {
+		m.Nodes[i].DecodeWire(r)
+	}
+	n = r.Count()
+	m.Providers = make([]Node, n)
+	for i := 0; i < n && r.Err() == nil; i++ {
+		m.Providers[i].DecodeWire(r)
+	}
+}
+
+// 問い合わせの応答の検証
+func (m *DHTNodesMsg) Validate() error {
+	if len(m.Nodes) > DHT_K || len(m.Providers) > MAX_PROVIDERS+1 {
+		return Malformed("too many nodes")
+	}
+	for _, list := range [][]Node{m.Nodes, m.Providers} {
+		for i := range list {
+			if err := list[i].Validate(); err != nil {
+				return err
+			}
+			if list[i].PubKey == "" {
+				return Malformed("pubkey")
+			}
+		}
+	}
+	return nil
+}
+
+// ルーティングテーブルの連絡先
+type contact struct {
+	node Node
+	seen time.Time
+}
+
+// ルーティングテーブル
+// バケットが満杯なら新しい連絡先は捨てる(古くから応答しているノードを優先する)
+type routingTable struct {
+	mu      sync.Mutex
+	self    dhtID
+	buckets [DHT_ID_BITS][]*contact
+	clock   Clock
+}
+
+// 連絡先の追加、更新
+func (rt *routingTable) update(node *Node) {
+	id, ok := nodeID(node.PubKey)
+	if !ok || id == rt.self {
+		return
+	}
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	b := rt.self.bucket(id)
+	for _, c := range rt.buckets[b] {
+		if c.node.PubKey == node.PubKey {
+			c.node.Host, c.node.ApiPort, c.node.P2PPort = node.Host, node.ApiPort, node.P2PPort
+			c.seen = clockNow(rt.clock)
+			return
+		}
+	}
+	if len(rt.buckets[b]) >= DHT_K {
+		return
+	}
+	c := &contact{node: Node{Host: node.Host, ApiPort: node.ApiPort, P2PPort: node.P2PPort, PubKey: node.PubKey}, seen: clockNow(rt.clock)}
+	rt.buckets[b] = append(rt.buckets[b], c)
+}
+
+// 連絡先の削除(応答しないノード)
+func (rt *routingTable) remove(key string) {
+	id, ok := nodeID(key)
+	if !ok {
+		return
+	}
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	b := rt.self.bucket(id)
+	for i, c := range rt.buckets[b] {
+		if c.node.PubKey == key {
+			rt.buckets[b] = append(rt.buckets[b][:i:i], rt.buckets[b][i+1:]...)
+			return
+		}
+	}
+}
+
+// キーに近い連絡先をn個返す
+func (rt *routingTable) closest(target dhtID, n int) []Node {
+	rt.mu.Lock()
+	nodes := make([]Node, 0)
+	for _, bucket := range rt.buckets {
+		for _, c := range bucket {
+			nodes = append(nodes, c.node)
+		}
+	}
+	rt.mu.Unlock()
+
+	sortByDistance(nodes, target)
+	if len(nodes) > n {
+		nodes = nodes[:n]
+	}
+	return nodes
+}
+
+// 連絡先の数
+func (rt *routingTable) len() int {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	n := 0
+	for _, bucket := range rt.buckets {
+		n += len(bucket)
+	}
+	return n
+}
+
+// プロバイダの登録
+type providerRecord struct {
+	node    Node
+	expires time.Time
+}
+
+// プロバイダの一覧
+type providerStore struct {
+	mu      sync.Mutex
+	records map[dhtID][]*providerRecord
+	local   map[dhtID]bool // 自ノードが提供しているキー
+	clock   Clock
+}
+
+// プロバイダの登録(期限を延ばす)
+func (ps *providerStore) add(key dhtID, node *Node) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if ps.records == nil {
+		ps.records = make(map[dhtID][]*providerRecord)
+	}
+	now := clockNow(ps.clock)
+	list := ps.records[key]
+	for _, r := range list {
+		if r.node.PubKey == node.PubKey {
+			r.node.Host, r.node.ApiPort, r.node.P2PPort = node.Host, node.ApiPort, node.P2PPort
+			r.expires = now.Add(PROVIDER_TTL)
+			return true
+		}
+	}
+	if len(list) == 0 && len(ps.records) >= MAX_PROVIDER_KEYS {
+		ps.expire(now)
+		if len(ps.records) >= MAX_PROVIDER_KEYS {
+			return false
+		}
+	}
+	if len(list) >= MAX_PROVIDERS {
+		return false
+	}
+	r := &providerRecord{node: Node{Host: node.Host, ApiPort: node.ApiPort, P2PPort: node.P2PPort, PubKey: node.PubKey}, expires: now.Add(PROVIDER_TTL)}
+	ps.records[key] = append(list, r)
+	return true
+}
+
+// 期限切れの登録を消す(ロックは呼び出し元で取る)
+func (ps *providerStore) expire(now time.Time) {
+	for key, list := range ps.records {
+		live := list[:0]
+		for _, r := range list {
+			if now.Before(r.expires) {
+				live = append(live, r)
+			}
+		}
+		if len(live) == 0 {
+			delete(ps.records, key)
+		} else {
+			ps.records[key] = live
+		}
+	}
+}
+
+// キーのプロバイダ
+func (ps *providerStore) get(key dhtID) []Node {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	now := clockNow(ps.clock)
+	nodes := make([]Node, 0)
+	for _, r := range ps.records[key] {
+		if now.Before(r.expires) {
+			nodes = append(nodes, r.node)
+		}
+	}
+	return nodes
+}
+
+// 自ノードが提供するキーの登録
+func (ps *providerStore) provide(key dhtID) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.local == nil {
+		ps.local = make(map[dhtID]bool)
+	}
+	ps.local[key] = true
+}
+
+// 自ノードが提供しているか
+func (ps *providerStore) provides(key dhtID) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.local[key]
+}
+
+// 登録の数(キーの数、プロバイダの数)
+func (ps *providerStore) len() (int, int) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	n := 0
+	for _, list := range ps.records {
+		n += len(list)
+	}
+	return len(ps.records), n
+}
+
+// DHTの状態
+type dht struct {
+	table     routingTable
+	providers providerStore
+}
+
+// DHTの統計情報
+type DHTStats struct {
+	ID        string `json:"id"`
+	Contacts  int    `json:"contacts"`
+	Keys      int    `json:"provider_keys"`
+	Providers int    `json:"providers"`
+}
+
+// DHTの初期化
+func (p2p *P2PNetwork) initDHT() {
+	p2p.dht.table.self, _ = nodeID(p2p.Key())
+	p2p.SetPeerRequestHandler(REQ_FIND_NODE, p2p.serveFindNode)
+	p2p.SetPeerRequestHandler(REQ_FIND_PROVIDERS, p2p.serveFindProviders)
+	p2p.SetPeerRequestHandler(REQ_ADD_PROVIDER, p2p.serveAddProvider)
+}
+
+// 接続中のノードを連絡先に入れる
+func (p2p *P2PNetwork) refreshContacts() {
+	for _, node := range p2p.peers.snapshot() {
+		if !node.Self && node.PubKey != "" {
+			p2p.dht.table.update(node)
+		}
+	}
+}
+
+// キーに近いノード(自ノードの連絡先から)
+func (p2p *P2PNetwork) closestContacts(target dhtID) []Node {
+	p2p.refreshContacts()
+	return p2p.dht.table.closest(target, DHT_K)
+}
+
+// 近いノードの問い合わせを処理
+func (p2p *P2PNetwork) serveFindNode(from *Node, body []byte) ([]byte, error) {
+	m := new(DHTFindMsg)
+	if err := Unmarshal(body, m); err != nil {
+		return nil, err
+	}
+	p2p.dht.table.update(from)
+	target, _ := dhtKey(m.Key)
+	return p2p.Marshal(&DHTNodesMsg{Nodes: p2p.closestContacts(target)}), nil
+}
+
+// プロバイダの問い合わせを処理
+// 自ノードが持っているデータなら自ノードもプロバイダとして返す
+func (p2p *P2PNetwork) serveFindProviders(from *Node, body []byte) ([]byte, error) {
+	m := new(DHTFindMsg)
+	if err := Unmarshal(body, m); err != nil {
+		return nil, err
+	}
+	p2p.dht.table.update(from)
+	target, _ := dhtKey(m.Key)
+	res := &DHTNodesMsg{Nodes: p2p.closestContacts(target), Providers: p2p.dht.providers.get(target)}
+	if p2p.hasContent(target, m.Key) {
+		if self := p2p.peers.self(); self != nil {
+			res.Providers = append(res.Providers, Node{Host: self.Host, ApiPort: self.ApiPort, P2PPort: self.P2PPort, PubKey: self.PubKey})
+		}
+	}
+	return p2p.Marshal(res), nil
+}
+
+// プロバイダの登録を処理(登録できるのは送信元自身だけ)
+func (p2p *P2PNetwork) serveAddProvider(from *Node, body []byte) ([]byte, error) {
+	m := new(DHTFindMsg)
+	if err := Unmarshal(body, m); err != nil {
+		return nil, err
+	}
+	p2p.dht.table.update(from)
+	key, _ := dhtKey(m.Key)
+	if !p2p.dht.providers.add(key, from) {
+		return nil, errors.New("Provider store full.")
+	}
+	return nil, nil
+}
+
+// 自ノードがキーのデータを持っているか
+func (p2p *P2PNetwork) hasContent(key dhtID, hash string) bool {
+	if p2p.dht.providers.provides(key) {
+		return true
+	}
+	return p2p.inv_has != nil && p2p.inv_has(INV_BLOCK, hash)
+}
+
+// ノードに接続する(未接続ならアドレスを確認してから)
+func (p2p *P2PNetwork) dial(node *Node) (*Node, error) {
+	deadline := p2p.clock.Now().Add(DHT_DIAL_TIMEOUT)
+	for {
+		if n := p2p.peers.searchKey(node.PubKey); n != nil && n.session.ready() {
+			return n, nil
+		}
+		if n := p2p.peers.search(node.Host, node.P2PPort); n != nil && n.PubKey != node.PubKey {
+			return nil, ErrKeyMismatch
+		}
+		if p2p.clock.Now().After(deadline) {
+			return nil, ErrTimeout
+		}
+		p2p.verify(node, nil)
+		p2p.clock.Sleep(DHT_DIAL_POLL)
+	}
+}
+
+// 1つのノードに問い合わせる
+func (p2p *P2PNetwork) dhtQuery(node Node, method int, key string) (*DHTNodesMsg, error) {
+	n, err := p2p.dial(&node)
+	if err != nil {
+		return nil, err
+	}
+	res, err := p2p.Request(method, p2p.Marshal(&DHTFindMsg{Key: key}), &RequestOptions{Timeout: DHT_TIMEOUT, Peers: []string{n.me()}})
+	if err != nil {
+		return nil, err
+	}
+	m := new(DHTNodesMsg)
+	if err := Unmarshal(res.Body, m); err != nil {
+		p2p.misbehave(n, MIS_MALFORMED, "dht response")
+		return nil, err
+	}
+	p2p.dht.table.update(n)
+	return m, nil
+}
+
+// キーに近いノードを探す(反復検索)
+// providersがtrueならプロバイダも集め、見つかった時点で終える
+func (p2p *P2PNetwork) lookup(hash string, providers bool) ([]Node, []Node, error) {
+	target, ok := dhtKey(hash)
+	if !ok {
+		return nil, nil, ErrBadKey
+	}
+	method := REQ_FIND_NODE
+	if providers {
+		method = REQ_FIND_PROVIDERS
+	}
+
+	self := p2p.Key()
+	shortlist := p2p.closestContacts(target)
+	known := make(map[string]bool)
+	for _, n := range shortlist {
+		known[n.PubKey] = true
+	}
+	queried := make(map[string]bool)
+	responded := make(map[string]bool)
+	found := make(map[string]Node)
+
+	for {
+		// 近い順に、まだ問い合わせていないノードを選ぶ
+		batch := make([]Node, 0, DHT_ALPHA)
+		for i, n := range shortlist {
+			if i >= DHT_K || len(batch) >= DHT_ALPHA {
+				break
+			}
+			if !queried[n.PubKey] {
+				queried[n.PubKey] = true
+				batch = append(batch, n)
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		type result struct {
+			node Node
+			res  *DHTNodesMsg
+			err  error
+		}
+		ch := make(chan result, len(batch))
+		for _, n := range batch {
+			go func(n Node) {
+				res, err := p2p.dhtQuery(n, method, hash)
+				ch <- result{node: n, res: res, err: err}
+			}(n)
+		}
+		for range batch {
+			r := <-ch
+			if r.err != nil {
+				if debug_mode {
+					fmt.Println("DHT query failed:", r.node.me(), r.err)
+				}
+				p2p.dht.table.remove(r.node.PubKey)
+				continue
+			}
+			responded[r.node.PubKey] = true
+			for _, n := range r.res.Providers {
+				found[n.PubKey] = n
+			}
+			for _, n := range r.res.Nodes {
+				if n.PubKey == self || known[n.PubKey] {
+					continue
+				}
+				known[n.PubKey] = true
+				shortlist = append(shortlist, n)
+				p2p.dht.table.update(&n)
+			}
+		}
+		sortByDistance(shortlist, target)
+		if providers && len(found) > 0 {
+			break
+		}
+	}
+
+	// 応答したノードだけを返す
+	closest := make([]Node, 0, DHT_K)
+	for _, n := range shortlist {
+		if responded[n.PubKey] && len(closest) < DHT_K {
+			closest = append(closest, n)
+		}
+	}
+	provs := make([]Node, 0, len(found))
+	for _, n := range found {
+		provs = append(provs, n)
+	}
+	sortByDistance(provs, target)
+	return closest, provs, nil
+}
+
+// 識別鍵からノードID(16進)を作る
+func NodeID(key string) (string, error) {
+	id, ok := nodeID(key)
+	if !ok {
+		return "", ErrBadKey
+	}
+	return hex.EncodeToString(id[:]), nil
+}
+
+// キー(ノードIDやハッシュ)に近いノードを探す
+func (p2p *P2PNetwork) FindNode(key string) ([]Node, error) {
+	nodes, _, err := p2p.lookup(key, false)
+	return nodes, err
+}
+
+// データを持っているノードを探す
+func (p2p *P2PNetwork) FindProviders(hash string) ([]Node, error) {
+	_, provs, err := p2p.lookup(hash, true)
+	if err != nil {
+		return nil, err
+	}
+	if len(provs) == 0 {
+		return nil, ErrNotFound
+	}
+	return provs, nil
+}
+
+// 自ノードがデータを持っていることを、キーに近いノードに登録する
+// 登録は期限付きなので、持ち続ける場合はPROVIDER_TTLより短い間隔で呼び直す
+func (p2p *P2PNetwork) Provide(hash string) (int, error) {
+	key, ok := dhtKey(hash)
+	if !ok {
+		return 0, ErrBadKey
+	}
+	p2p.dht.providers.provide(key)
+
+	nodes, _, err := p2p.lookup(hash, false)
+	if err != nil {
+		return 0, err
+	}
+	stored := 0
+	body := p2p.Marshal(&DHTFindMsg{Key: hash})
+	for _, n := range nodes {
+		node := p2p.peers.searchKey(n.PubKey)
+		if node == nil {
+			continue
+		}
+		if _, err := p2p.Request(REQ_ADD_PROVIDER, body, &RequestOptions{Timeout: DHT_TIMEOUT, Peers: []string{node.me()}}); err != nil {
+			fmt.Println("provide error:", node.me(), err)
+			continue
+		}
+		stored++
+	}
+	return stored, nil
+}
+
+// 統計情報
+func (p2p *P2PNetwork) dhtStats() DHTStats {
+	keys, provs := p2p.dht.providers.len()
+	return DHTStats{
+		ID:        hex.EncodeToString(p2p.dht.table.self[:]),
+		Contacts:  p2p.dht.table.len(),
+		Keys:      keys,
+		Providers: provs,
+	}
+}
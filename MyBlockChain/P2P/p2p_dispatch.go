@@ -0,0 +1,237 @@
+/*
+  My Block Chain: P2P inbound dispatch module
+*/
+package P2P
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+)
+
+const (
+	DROP_NEWEST = 0 // キューが満杯なら新しいメッセージを捨てる
+	DROP_OLDEST = 1 // キューが満杯なら一番古いメッセージを捨てる
+
+	MAX_CMD = 20
+)
+
+// コマンド毎の処理方針
+type dispatchPolicy struct {
+	workers int // 同時実行数
+	size    int // キューの長さ
+	drop    int // 満杯時の破棄方針
+}
+
+// 未指定のコマンドの処理方針
+var default_policy = dispatchPolicy{workers: 2, size: 32, drop: DROP_NEWEST}
+
+// コマンド毎の処理方針
+// マイニングはCPUを使い切るので1つずつ、溢れた分は捨てる
+var dispatch_policies = map[int]dispatchPolicy{
+	CMD_NEWBLOCK:    {workers: 4, size: 128, drop: DROP_NEWEST},
+	CMD_ADDSRV:      {workers: 1, size: 32, drop: DROP_OLDEST},
+	CMD_DELSRV:      {workers: 1, size: 32, drop: DROP_OLDEST},
+	CMD_SENDBLOCK:   {workers: 2, size: 64, drop: DROP_NEWEST},
+	CMD_MININGBLOCK: {workers: 1, size: 2, drop: DROP_NEWEST},
+	CMD_MODIFYDATA:  {workers: 1, size: 4, drop: DROP_NEWEST},
+	CMD_INV:         {workers: 2, size: 128, drop: DROP_OLDEST},
+	CMD_GETDATA:     {workers: 2, size: 64, drop: DROP_NEWEST},
+	CMD_REQUEST:     {workers: 4, size: 128, drop: DROP_NEWEST},
+	CMD_RESPONSE:    {workers: 2, size: 128, drop: DROP_NEWEST},
+	CMD_HELLO:       {workers: 1, size: 32, drop: DROP_NEWEST},
+	CMD_GOSSIP:      {workers: 2, size: 128, drop: DROP_OLDEST},
+}
+
+// 受信メッセージ
+type inbound struct {
+	cmd  int
+	msg  []byte
+	addr net.Addr
+	from *Node // 署名で確認した送信元
+}
+
+// 受信処理の統計情報
+type DispatchStats struct {
+	Cmd       int    `json:"cmd"`
+	Workers   int    `json:"workers"`
+	Depth     int    `json:"depth"`
+	Capacity  int    `json:"capacity"`
+	Policy    string `json:"policy"`
+	Processed uint64 `json:"processed"`
+	Dropped   uint64 `json:"dropped"`
+	Errors    uint64 `json:"errors"`
+}
+
+// コマンド毎の受信キュー
+type cmdQueue struct {
+	cmd       int
+	policy    dispatchPolicy
+	ch        chan *inbound
+	processed uint64
+	dropped   uint64
+	errors    uint64
+}
+
+// 受信メッセージの振り分け
+// コマンド毎にキューと固定数のワーカを持つので、goroutine数とメモリ使用量に上限がある
+type dispatcher struct {
+	p2p     *P2PNetwork
+	queues  []*cmdQueue
+	unknown uint64
+}
+
+// 振り分け処理の初期化とワーカの起動
+func newDispatcher(p2p *P2PNetwork) *dispatcher {
+	d := new(dispatcher)
+	d.p2p = p2p
+	d.queues = make([]*cmdQueue, MAX_CMD)
+
+	for cmd := 1; cmd < MAX_CMD; cmd++ {
+		policy, ok := dispatch_policies[cmd]
+		if !ok {
+			policy = default_policy
+		}
+		q := new(cmdQueue)
+		q.cmd = cmd
+		q.policy = policy
+		q.ch = make(chan *inbound, policy.size)
+		d.queues[cmd] = q
+
+		for i := 0; i < policy.workers; i++ {
+			go d.worker(q)
+		}
+	}
+
+	return d
+}
+
+// 受信メッセージをキューに積む
+func (d *dispatcher) push(in *inbound) {
+	if in.cmd <= 0 || in.cmd >= len(d.queues) {
+		atomic.AddUint64(&d.unknown, 1)
+		fmt.Println("No Action")
+		return
+	}
+	q := d.queues[in.cmd]
+
+	for {
+		select {
+		case q.ch <- in:
+			return
+		default:
+		}
+
+		if q.policy.drop == DROP_NEWEST {
+			atomic.AddUint64(&q.dropped, 1)
+			fmt.Println("Dispatch queue full, drop:", in.cmd, in.addr)
+			return
+		}
+
+		// 一番古いものを捨てて入れ直す
+		select {
+		case <-q.ch:
+			atomic.AddUint64(&q.dropped, 1)
+			fmt.Println("Dispatch queue full, drop oldest:", in.cmd)
+		default:
+		}
+	}
+}
+
+// ワーカ(ノードを停止したら終わる)
+func (d *dispatcher) worker(q *cmdQueue) {
+	for {
+		select {
+		case in := <-q.ch:
+			d.handle(q, in)
+		case <-d.p2p.done:
+			return
+		}
+	}
+}
+
+// 1メッセージの処理
+// 解析エラーやpanicは送信元の減点にして、ノードは止めない
+func (d *dispatcher) handle(q *cmdQueue, in *inbound) {
+	defer func() {
+		if r := recover(); r != nil {
+			atomic.AddUint64(&q.errors, 1)
+			fmt.Println("Action panic:", in.cmd, in.addr, r)
+			d.penalize(in, MIS_PANIC, PENALTY_PANIC, fmt.Sprint("panic: ", r))
+		}
+	}()
+
+	if debug_mode {
+		fmt.Println("recieve function")
+		fmt.Println(in.addr)
+		fmt.Println(in.cmd, string(in.msg))
+	}
+
+	var err error
+	if pf := d.p2p.peer_actions[in.cmd]; pf != nil {
+		fmt.Println("Do Action")
+		err = pf(in.from, in.msg)
+	} else {
+		f := d.p2p.actions[in.cmd]
+		if f == nil {
+			fmt.Println("No Action")
+			return
+		}
+		fmt.Println("Do Action")
+		err = f(in.msg)
+	}
+	atomic.AddUint64(&q.processed, 1)
+	if err != nil {
+		atomic.AddUint64(&q.errors, 1)
+		fmt.Println(err)
+		var de *DecodeError
+		var mis *Misbehaviour
+		if errors.As(err, &de) {
+			if de.Cmd == 0 {
+				de.Cmd = in.cmd
+			}
+			d.penalize(in, MIS_MALFORMED, PENALTY_MALFORMED, de.Error())
+		} else if errors.As(err, &mis) {
+			d.penalize(in, mis.Kind, misbehaviour_points[mis.Kind], mis.Reason)
+		}
+	}
+}
+
+// 送信元を減点
+// 登録済みのノードは鍵ごとの点数、未登録の送信元はアドレスごとの減点にする
+func (d *dispatcher) penalize(in *inbound, kind int, points int, reason string) {
+	if in.from != nil && in.from.ID >= 0 {
+		d.p2p.misbehave(in.from, kind, reason)
+		return
+	}
+	if in.addr == nil {
+		return
+	}
+	d.p2p.penalties.add(in.addr.String(), points, reason)
+}
+
+// 統計情報
+func (d *dispatcher) stats() []DispatchStats {
+	stats := make([]DispatchStats, 0)
+	for _, q := range d.queues {
+		if q == nil {
+			continue
+		}
+		policy := "drop_newest"
+		if q.policy.drop == DROP_OLDEST {
+			policy = "drop_oldest"
+		}
+		stats = append(stats, DispatchStats{
+			Cmd:       q.cmd,
+			Workers:   q.policy.workers,
+			Depth:     len(q.ch),
+			Capacity:  cap(q.ch),
+			Policy:    policy,
+			Processed: atomic.LoadUint64(&q.processed),
+			Dropped:   atomic.LoadUint64(&q.dropped),
+			Errors:    atomic.LoadUint64(&q.errors),
+		})
+	}
+	return stats
+}
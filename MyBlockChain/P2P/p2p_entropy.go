@@ -0,0 +1,101 @@
+/*
+  My Block Chain: P2P entropy module
+*/
+package P2P
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	mrand "math/rand"
+	"sync"
+	"time"
+)
+
+/*
+乱数源
+	鍵、ノンス、メッセージIDなどの乱数は乱数源(io.Reader)から読む。
+	通常は暗号用の乱数(crypto/rand)を使う。シミュレーションやテストでは
+	種を固定した乱数源(NewSeededEntropy)を使うと、同じ乱数が出て再現できる。
+	種を固定した乱数源は予測できるので、実際のネットワークでは使わない。
+
+	時計と同じく、設定しなければ既定のもの(crypto/rand)を使う。
+*/
+
+// 種を固定した乱数源
+type seededEntropy struct {
+	mu  sync.Mutex
+	rnd *mrand.Rand
+}
+
+// 種を固定した乱数源の作成(再現用。暗号には使えない)
+func NewSeededEntropy(seed int64) io.Reader {
+	return &seededEntropy{rnd: mrand.New(mrand.NewSource(seed))}
+}
+
+// 乱数を読む
+func (se *seededEntropy) Read(b []byte) (int, error) {
+	se.mu.Lock()
+	defer se.mu.Unlock()
+	for i := range b {
+		b[i] = byte(se.rnd.Intn(256))
+	}
+	return len(b), nil
+}
+
+// 設定されていなければ暗号用の乱数源
+func entropyOf(r io.Reader) io.Reader {
+	if r == nil {
+		return rand.Reader
+	}
+	return r
+}
+
+// 設定されていなければ実際の時刻
+func clockNow(c Clock) time.Time {
+	if c == nil {
+		return time.Now()
+	}
+	return c.Now()
+}
+
+// 乱数源から64ビットの乱数を読む
+func randUint64(r io.Reader) (uint64, error) {
+	b := make([]byte, 8)
+	if _, err := io.ReadFull(entropyOf(r), b); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+// 乱数源を使って並べ替える(読めなければ並べ替えない)
+func shuffle(r io.Reader, n int, swap func(i, j int)) {
+	for i := n - 1; i > 0; i-- {
+		v, err := randUint64(r)
+		if err != nil {
+			return
+		}
+		swap(i, int(v%uint64(i+1)))
+	}
+}
+
+// 乱数源から使い捨て鍵を作る
+// ecdhのGenerateKeyは乱数源の読み方が一定でないので、秘密鍵のバイト列を直接読む
+func newX25519Key(r io.Reader) (*ecdh.PrivateKey, error) {
+	b := make([]byte, 32)
+	if _, err := io.ReadFull(entropyOf(r), b); err != nil {
+		return nil, err
+	}
+	return ecdh.X25519().NewPrivateKey(b)
+}
+
+// 乱数源の設定(Initの前に呼ぶ。設定しなければ暗号用の乱数)
+func (p2p *P2PNetwork) SetEntropy(r io.Reader) {
+	p2p.entropy = r
+}
+
+// 使っている乱数源
+func (p2p *P2PNetwork) Entropy() io.Reader {
+	return entropyOf(p2p.entropy)
+}
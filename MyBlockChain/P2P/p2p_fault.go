@@ -0,0 +1,403 @@
+/*
+  My Block Chain: P2P fault injection module
+*/
+package P2P
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+障害の注入
+	FaultTransportは別のTransportを包み、送信するパケットに障害を起こす。
+	パケットの消失、遅延とゆらぎ、重複、順序の入れ替え、名前付きの分断を設定できる。
+	障害の設定(FaultRules)は複数のノードで共有でき、同じプロセスで動かすノードに
+	まとめて障害を起こせる。乱数の種を固定すれば同じ障害を再現できる。
+
+	SetReceiveFaultsを呼ぶと受信したパケットにも同じ障害を起こす。受信したパケットの
+	送信元のアドレスは送信用の一時的なアドレスなので、フレームの署名を確認して
+	登録済みのノードのアドレスに直してから判定する(確認できなければ受信したアドレス)。
+	別のプロセスのノードからの受信に使う。同じプロセスのノード同士(シミュレータ)では
+	送信側で障害を起こしているので呼ばない(呼ぶと障害が二重になる)。
+
+	分断は名前ごとにアドレスのグループを並べる。違うグループのノードの間と、
+	グループに入っているノードと入っていないノードの間は通信できない。
+*/
+
+const (
+	FAULT_QUEUE = 1024 // 受信側で障害を起こしたパケットのキューの長さ
+)
+
+var ErrInvalidFault = errors.New("Invalid fault config.")
+
+// 受信したフレームの送信元のノードのアドレスを返す関数
+type frame_source_fn func(frame []byte, addr string) string
+
+// 障害の設定
+type FaultConfig struct {
+	Loss      float64 `json:"loss"`       // 消失する確率
+	Duplicate float64 `json:"duplicate"`  // 重複する確率
+	Reorder   float64 `json:"reorder"`    // 後のパケットに追い越される確率
+	LatencyMs int     `json:"latency_ms"` // 遅延
+	JitterMs  int     `json:"jitter_ms"`  // 遅延のゆらぎ(0からこの値までを加える)
+	ReorderMs int     `json:"reorder_ms"` // 追い越させるパケットに加える遅延
+}
+
+// 障害の統計情報
+type FaultStats struct {
+	Config     FaultConfig           `json:"config"`
+	Partitions map[string][][]string `json:"partitions"`
+	Sent       uint64                `json:"sent"`
+	Lost       uint64                `json:"lost"`
+	Blocked    uint64                `json:"blocked"` // 分断で捨てた数
+	Duplicated uint64                `json:"duplicated"`
+	Delayed    uint64                `json:"delayed"`
+	Reordered  uint64                `json:"reordered"`
+}
+
+// 障害の設定(複数のFaultTransportで共有できる)
+type FaultRules struct {
+	mu         sync.Mutex
+	config     FaultConfig
+	partitions map[string][][]string
+	rnd        *rand.Rand
+	clock      Clock
+	stats      FaultStats
+}
+
+// 障害を起こす通信路
+type FaultTransport struct {
+	rules  *FaultRules
+	inner  Transport
+	mu     sync.Mutex
+	local  string          // 受信しているアドレス(送信元として分断の判定に使う)
+	source frame_source_fn // 受信にも障害を起こす場合の送信元の判定
+}
+
+// 障害を起こす送信側の通信路
+type faultConn struct {
+	ft    *FaultTransport
+	inner Conn
+	to    string
+}
+
+// 障害を起こす受信側の通信路
+// 受信は裏で読み続け、障害を起こした後のパケットをキューから返す
+type faultPacketConn struct {
+	ft     *FaultTransport
+	inner  PacketConn
+	ready  chan faultPacket
+	closed chan struct{}
+	err    error // 裏の受信が終わった理由(closedを閉じる前に設定する)
+}
+
+// 障害を起こした後の受信パケット
+type faultPacket struct {
+	b    []byte
+	addr net.Addr
+}
+
+// 障害の設定の作成
+func NewFaultRules(seed int64) *FaultRules {
+	fr := new(FaultRules)
+	fr.partitions = make(map[string][][]string)
+	fr.rnd = rand.New(rand.NewSource(seed))
+	fr.clock = RealClock{}
+	return fr
+}
+
+// 遅らせたパケットを送る時計の設定
+func (fr *FaultRules) SetClock(clock Clock) {
+	fr.clock = clock
+}
+
+// 障害の設定の検証
+func (c *FaultConfig) Validate() error {
+	for _, p := range []float64{c.Loss, c.Duplicate, c.Reorder} {
+		if p < 0 || p > 1 {
+			return ErrInvalidFault
+		}
+	}
+	if c.LatencyMs < 0 || c.JitterMs < 0 || c.ReorderMs < 0 {
+		return ErrInvalidFault
+	}
+	return nil
+}
+
+// 障害の設定の変更
+func (fr *FaultRules) SetConfig(config FaultConfig) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	fr.config = config
+	return nil
+}
+
+// 分断の設定(同じ名前があれば置き換える)
+func (fr *FaultRules) Partition(name string, groups ...[]string) error {
+	if name == "" || len(groups) == 0 {
+		return ErrInvalidFault
+	}
+	for _, g := range groups {
+		for _, addr := range g {
+			if _, _, err := splitAddr(addr); err != nil {
+				return err
+			}
+		}
+	}
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	fr.partitions[name] = groups
+	return nil
+}
+
+// 分断の解除
+func (fr *FaultRules) Heal(name string) error {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	if _, ok := fr.partitions[name]; !ok {
+		return ErrNotFound
+	}
+	delete(fr.partitions, name)
+	return nil
+}
+
+// 全ての障害の解除
+func (fr *FaultRules) Reset() {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	fr.config = FaultConfig{}
+	fr.partitions = make(map[string][][]string)
+}
+
+// 分断の名前の一覧
+func (fr *FaultRules) Partitions() []string {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	names := make([]string, 0, len(fr.partitions))
+	for name := range fr.partitions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// 統計情報
+func (fr *FaultRules) Stats() FaultStats {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	st := fr.stats
+	st.Config = fr.config
+	st.Partitions = make(map[string][][]string)
+	for name, groups := range fr.partitions {
+		st.Partitions[name] = groups
+	}
+	return st
+}
+
+// 送信元と送信先が分断されているか(ロックは呼び出し元で取る)
+func (fr *FaultRules) blocked(from string, to string) bool {
+	for _, groups := range fr.partitions {
+		if groupOf(groups, from) != groupOf(groups, to) {
+			return true
+		}
+	}
+	return false
+}
+
+// アドレスの入っているグループ(無ければ-1)
+func groupOf(groups [][]string, addr string) int {
+	for i, g := range groups {
+		for _, a := range g {
+			if a == addr {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// 1つのパケットの扱いを決める
+// 送る回数(0なら捨てる)と、それぞれの遅延を返す
+func (fr *FaultRules) plan(from string, to string) []time.Duration {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+
+	c := fr.config
+	if fr.blocked(from, to) {
+		fr.stats.Blocked++
+		return nil
+	}
+	if c.Loss > 0 && fr.rnd.Float64() < c.Loss {
+		fr.stats.Lost++
+		return nil
+	}
+	n := 1
+	if c.Duplicate > 0 && fr.rnd.Float64() < c.Duplicate {
+		fr.stats.Duplicated++
+		n = 2
+	}
+	delays := make([]time.Duration, n)
+	for i := range delays {
+		d := time.Duration(c.LatencyMs) * time.Millisecond
+		if c.JitterMs > 0 {
+			d += time.Duration(fr.rnd.Int63n(int64(c.JitterMs) * int64(time.Millisecond)))
+		}
+		if c.Reorder > 0 && fr.rnd.Float64() < c.Reorder {
+			fr.stats.Reordered++
+			d += time.Duration(c.ReorderMs) * time.Millisecond
+		}
+		if d > 0 {
+			fr.stats.Delayed++
+		}
+		delays[i] = d
+	}
+	fr.stats.Sent += uint64(n)
+	return delays
+}
+
+// 通信路を包む
+func (fr *FaultRules) Wrap(inner Transport) *FaultTransport {
+	return &FaultTransport{rules: fr, inner: inner}
+}
+
+// 障害の設定
+func (ft *FaultTransport) Rules() *FaultRules {
+	return ft.rules
+}
+
+// 受信にも障害を起こす(Listenの前に呼ぶ)
+// sourceはフレームを送ったノードのアドレスを返す
+func (ft *FaultTransport) SetReceiveFaults(source frame_source_fn) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	ft.source = source
+}
+
+// 受信の開始
+func (ft *FaultTransport) Listen(addr string) (PacketConn, error) {
+	c, err := ft.inner.Listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	ft.mu.Lock()
+	ft.local = addr
+	source := ft.source
+	ft.mu.Unlock()
+	if source == nil {
+		return c, nil
+	}
+	fc := &faultPacketConn{ft: ft, inner: c, ready: make(chan faultPacket, FAULT_QUEUE), closed: make(chan struct{})}
+	go fc.pump(addr, source)
+	return fc, nil
+}
+
+// 受信したパケットに障害を起こしてキューに入れる
+func (fc *faultPacketConn) pump(local string, source frame_source_fn) {
+	buf := make([]byte, MAX_PACKET)
+	for {
+		n, addr, err := fc.inner.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				fc.err = err
+				close(fc.closed)
+				return
+			}
+			continue
+		}
+		p := faultPacket{b: make([]byte, n), addr: addr}
+		copy(p.b, buf[:n])
+		for _, d := range fc.ft.rules.plan(source(p.b, addr.String()), local) {
+			if d <= 0 {
+				fc.push(p)
+				continue
+			}
+			fc.ft.rules.clock.AfterFunc(d, func() { fc.push(p) })
+		}
+	}
+}
+
+// キューに入れる(いっぱいなら捨てる)
+func (fc *faultPacketConn) push(p faultPacket) {
+	select {
+	case fc.ready <- p:
+	case <-fc.closed:
+	default:
+	}
+}
+
+// 受信
+func (fc *faultPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case p := <-fc.ready:
+		return copy(b, p.b), p.addr, nil
+	case <-fc.closed:
+		return 0, nil, fc.err
+	}
+}
+
+// 受信の終了
+func (fc *faultPacketConn) Close() error {
+	return fc.inner.Close()
+}
+
+// 送信先に接続
+func (ft *FaultTransport) Dial(addr string) (Conn, error) {
+	c, err := ft.inner.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &faultConn{ft: ft, inner: c, to: addr}, nil
+}
+
+// 送信(遅らせる場合は裏で送るので、書き換えられないようにコピーする)
+func (c *faultConn) Write(b []byte) (int, error) {
+	c.ft.mu.Lock()
+	from := c.ft.local
+	c.ft.mu.Unlock()
+
+	for _, d := range c.ft.rules.plan(from, c.to) {
+		if d <= 0 {
+			if _, err := c.inner.Write(b); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		p := make([]byte, len(b))
+		copy(p, b)
+		c.ft.rules.clock.AfterFunc(d, func() { c.inner.Write(p) })
+	}
+	return len(b), nil
+}
+
+// 接続の終了
+func (c *faultConn) Close() error {
+	return c.inner.Close()
+}
+
+// 受信したフレームを送ったノードのアドレス(受信側の障害の判定に使う)
+// 署名を確認できて登録済みのノードの鍵ならそのノードのアドレス、
+// HELLOなら署名されたメッセージで名乗ったアドレス、それ以外は受信したアドレスを返す
+func (p2p *P2PNetwork) FrameSource(frame []byte, addr string) string {
+	env, err := decodeFrame(frame, p2p.magic)
+	if err != nil {
+		return addr
+	}
+	if node := p2p.peers.searchKey(env.key); node != nil {
+		return node.me()
+	}
+	if env.cmd == CMD_HELLO {
+		m := new(HelloMsg)
+		if err := Unmarshal(env.body, m); err == nil {
+			return m.Node.me()
+		}
+	}
+	return addr
+}
@@ -0,0 +1,307 @@
+/*
+  My Block Chain: P2P gossip module
+*/
+package P2P
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ゴシップ
+	全ノードに送る代わりに、ランダムに選んだfanout個の隣接ノードにだけ送り、
+	受け取ったノードが同じように転送することで全体に広げる。
+	メッセージにはIDとTTL(残りホップ数)を付け、一度見たIDは処理も転送もしない。
+	IDは最初に送ったノードの鍵とノンス、コマンド、中身のハッシュで、送ったノードが
+	署名する。受信時に計算し直して一致しないものと署名が合わないものは捨てるので、
+	他人のIDを騙って本物のメッセージを止めることはできない。
+	ノンスは送るたびに変わるので、同じ中身を送り直したものも別のメッセージとして広がる。
+	全ノードとつながっていなくても、グラフが連結していれば届く。
+
+	中身のコマンドは転送してきた隣接ノードから届いたものとして処理するので、
+	不正な中身の減点は転送元にかかる。
+*/
+const (
+	GOSSIP_FANOUT  = 4  // 転送先の数(0なら全ての隣接ノード)
+	GOSSIP_TTL     = 8  // 最初に付けるホップ数
+	MAX_GOSSIP_TTL = 32 // 受け付けるホップ数の上限
+
+	MAX_GOSSIP_SEEN = 65536
+	GOSSIP_SEEN_TTL = 10 * time.Minute
+)
+
+// ゴシップで広げてよいコマンド
+var gossip_cmds = map[int]bool{
+	CMD_NEWBLOCK:    true,
+	CMD_ADDSRV:      true,
+	CMD_DELSRV:      true,
+	CMD_MININGBLOCK: true,
+	CMD_MODIFYDATA:  true,
+}
+
+// ゴシップのメッセージ
+type GossipMsg struct {
+	ID      string `json:"id"`
+	Origin  string `json:"origin"` // 最初に送ったノードの鍵
+	Nonce   uint64 `json:"nonce"`
+	Sig     []byte `json:"sig"` // OriginによるIDへの署名
+	TTL     int    `json:"ttl"`
+	Cmd     int    `json:"cmd"`
+	Payload []byte `json:"payload"`
+}
+
+// バイナリ形式に変換
+func (g *GossipMsg) EncodeWire(w *Writer) {
+	w.Hash(g.ID)
+	w.Hash(g.Origin)
+	w.Uvarint(g.Nonce)
+	w.Bytes(g.Sig)
+	w.Uvarint(uint64(g.TTL))
+	w.Uvarint(uint64(g.Cmd))
+	w.Bytes(g.Payload)
+}
+
+// バイナリ形式から変換
+func (g *GossipMsg) DecodeWire(r *Reader) {
+	g.ID = r.Hash()
+	g.Origin = r.Hash()
+	g.Nonce = r.Uvarint()
+	g.Sig = r.Bytes()
+	g.TTL = int(r.Uvarint())
+	g.Cmd = int(r.Uvarint())
+	g.Payload = r.Bytes()
+}
+
+// メッセージID(送ったノードの鍵とノンス、コマンド、中身のハッシュ)
+func gossipID(origin string, nonce uint64, cmd int, payload []byte) string {
+	w := NewWriter()
+	w.Hash(origin)
+	w.Uvarint(nonce)
+	w.Uvarint(uint64(cmd))
+	w.Bytes(payload)
+	h := sha256.Sum256(w.Data())
+	return hex.EncodeToString(h[:])
+}
+
+// 署名したメッセージを作る
+func newGossipMsg(id *Identity, nonce uint64, ttl int, cmd int, payload []byte) *GossipMsg {
+	g := &GossipMsg{Origin: id.Key(), Nonce: nonce, TTL: ttl, Cmd: cmd, Payload: payload}
+	g.ID = gossipID(g.Origin, nonce, cmd, payload)
+	sum, _ := hex.DecodeString(g.ID)
+	g.Sig = id.Sign(sum)
+	return g
+}
+
+// ゴシップのメッセージの検証
+func (g *GossipMsg) Validate() error {
+	if b, err := hex.DecodeString(g.ID); err != nil || len(b) != sha256.Size {
+		return Malformed("id")
+	}
+	if g.TTL <= 0 || g.TTL > MAX_GOSSIP_TTL {
+		return Malformed("ttl")
+	}
+	if !gossip_cmds[g.Cmd] {
+		return Malformed("cmd")
+	}
+	if len(g.Payload) == 0 {
+		return Malformed("payload")
+	}
+	if !validKey(g.Origin) {
+		return Malformed("origin")
+	}
+	if g.ID != gossipID(g.Origin, g.Nonce, g.Cmd, g.Payload) {
+		return Malformed("id")
+	}
+	origin, _ := hex.DecodeString(g.Origin)
+	sum, _ := hex.DecodeString(g.ID)
+	if !verifySig(origin, sum, g.Sig) {
+		return &DecodeError{Err: ErrBadSignature, Reason: "gossip"}
+	}
+	return nil
+}
+
+// 処理済みのメッセージID
+// 期限切れか上限を超えたら古いものから忘れる
+type seenCache struct {
+	mu    sync.Mutex
+	seen  map[string]time.Time
+	order []string
+	clock Clock
+}
+
+// 登録。新規ならtrueを返す
+func (sc *seenCache) add(id string) bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if sc.seen == nil {
+		sc.seen = make(map[string]time.Time)
+	}
+	if _, ok := sc.seen[id]; ok {
+		return false
+	}
+	now := clockNow(sc.clock)
+	for len(sc.order) > 0 {
+		old := sc.order[0]
+		if len(sc.order) < MAX_GOSSIP_SEEN && now.Sub(sc.seen[old]) < GOSSIP_SEEN_TTL {
+			break
+		}
+		delete(sc.seen, old)
+		sc.order = sc.order[1:]
+	}
+	sc.seen[id] = now
+	sc.order = append(sc.order, id)
+	return true
+}
+
+// 件数
+func (sc *seenCache) len() int {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return len(sc.seen)
+}
+
+// ゴシップの設定と統計
+type gossiper struct {
+	fanout     int
+	ttl        int
+	seen       seenCache
+	originated uint64
+	delivered  uint64
+	duplicates uint64
+	forwarded  uint64
+}
+
+// ゴシップの統計情報
+type GossipStats struct {
+	Fanout     int    `json:"fanout"`
+	TTL        int    `json:"ttl"`
+	Seen       int    `json:"seen"`
+	Originated uint64 `json:"originated"`
+	Delivered  uint64 `json:"delivered"`
+	Duplicates uint64 `json:"duplicates"`
+	Forwarded  uint64 `json:"forwarded"`
+}
+
+// 転送先の数の設定(0なら全ての隣接ノード。Initの後に呼ぶ)
+func (p2p *P2PNetwork) SetFanout(n int) {
+	if n < 0 {
+		n = 0
+	}
+	p2p.gossip.fanout = n
+}
+
+// 最初に付けるホップ数の設定(Initの後に呼ぶ)
+func (p2p *P2PNetwork) SetGossipTTL(ttl int) {
+	if ttl <= 0 || ttl > MAX_GOSSIP_TTL {
+		fmt.Println("Invalid gossip TTL:", ttl)
+		return
+	}
+	p2p.gossip.ttl = ttl
+}
+
+// 隣接ノードをランダムな順に並べる(自ノードとexceptは除く)
+func (p2p *P2PNetwork) shuffledPeers(except *Node) []*Node {
+	nodes := make([]*Node, 0)
+	for _, node := range p2p.peers.snapshot() {
+		if node.Self || node == except {
+			continue
+		}
+		nodes = append(nodes, node)
+	}
+	shuffle(p2p.entropy, len(nodes), func(i, j int) { nodes[i], nodes[j] = nodes[j], nodes[i] })
+	return nodes
+}
+
+// 転送先を選ぶ
+func (p2p *P2PNetwork) gossipTargets(except *Node) []*Node {
+	nodes := p2p.shuffledPeers(except)
+	if p2p.gossip.fanout > 0 && len(nodes) > p2p.gossip.fanout {
+		nodes = nodes[:p2p.gossip.fanout]
+	}
+	return nodes
+}
+
+// 選んだ隣接ノードに送る
+func (p2p *P2PNetwork) spread(g *GossipMsg, except *Node) int {
+	b := p2p.Marshal(g)
+	n := 0
+	for _, node := range p2p.gossipTargets(except) {
+		if err := node.post(CMD_GOSSIP, b); err != nil {
+			fmt.Println("gossip error:", node.me(), err)
+			continue
+		}
+		n++
+	}
+	return n
+}
+
+// メッセージをゴシップで全体に広げる
+// selfがtrueなら自ノードでも処理する
+func (p2p *P2PNetwork) Gossip(cmd int, msg []byte, self bool) error {
+	fmt.Println("Gossip:", cmd, len(msg))
+
+	if !gossip_cmds[cmd] {
+		return errors.New("Not a gossip command:" + strconv.Itoa(cmd))
+	}
+	nonce, err := randUint64(p2p.Entropy())
+	if err != nil {
+		return err
+	}
+	g := newGossipMsg(p2p.identity, nonce, p2p.gossip.ttl, cmd, msg)
+
+	p2p.gossip.seen.add(g.ID)
+	atomic.AddUint64(&p2p.gossip.originated, 1)
+	p2p.spread(g, nil)
+
+	if self {
+		if node := p2p.peers.self(); node != nil {
+			return node.post(cmd, msg)
+		}
+	}
+	return nil
+}
+
+// ゴシップ受信アクション
+// 初めて見たメッセージなら中身を処理して、TTLが残っていれば転送する
+func (p2p *P2PNetwork) HandleGossip(from *Node, msg []byte) error {
+	g := new(GossipMsg)
+	if err := Unmarshal(msg, g); err != nil {
+		return err
+	}
+	if !p2p.gossip.seen.add(g.ID) {
+		atomic.AddUint64(&p2p.gossip.duplicates, 1)
+		return nil
+	}
+	atomic.AddUint64(&p2p.gossip.delivered, 1)
+
+	// 中身は通常の受信メッセージと同じキューで処理する
+	p2p.dispatch.push(&inbound{cmd: g.Cmd, msg: g.Payload, from: from})
+
+	if g.TTL > 1 {
+		g.TTL--
+		n := p2p.spread(g, from)
+		atomic.AddUint64(&p2p.gossip.forwarded, uint64(n))
+	}
+	return nil
+}
+
+// 統計情報
+func (p2p *P2PNetwork) gossipStats() GossipStats {
+	return GossipStats{
+		Fanout:     p2p.gossip.fanout,
+		TTL:        p2p.gossip.ttl,
+		Seen:       p2p.gossip.seen.len(),
+		Originated: atomic.LoadUint64(&p2p.gossip.originated),
+		Delivered:  atomic.LoadUint64(&p2p.gossip.delivered),
+		Duplicates: atomic.LoadUint64(&p2p.gossip.duplicates),
+		Forwarded:  atomic.LoadUint64(&p2p.gossip.forwarded),
+	}
+}
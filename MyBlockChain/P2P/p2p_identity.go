@@ -0,0 +1,502 @@
+/*
+  My Block Chain: P2P node identity module
+*/
+package P2P
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	KEY_SIZE = ed25519.PublicKeySize
+
+	// リプレイ対策
+	REPLAY_WINDOW    = 30 * time.Second // 送信時刻のずれの許容範囲
+	MAX_REPLAY_CACHE = 65536
+	MAX_HELLO_REPLAY = 4096 // 未登録の送信元からのHELLOの記録の上限
+	MAX_HELLO_SOURCE = 16   // 1つの送信元アドレスからのHELLOの記録の上限
+
+	// 署名の不正は解析エラーより重く減点する
+	PENALTY_FORGED = 50
+
+	// ハンドシェイクの再送
+	HELLO_RETRY    = 5
+	HELLO_INTERVAL = time.Second
+)
+
+var (
+	ErrBadSignature  = errors.New("Invalid signature.")
+	ErrReplay        = errors.New("Replayed message.")
+	ErrStale         = errors.New("Message out of replay window.")
+	ErrReplayLimit   = errors.New("Too many handshakes from source.")
+	ErrUnknownSender = errors.New("Unknown sender.")
+	ErrUntrusted     = errors.New("Untrusted node key.")
+	ErrKeyMismatch   = errors.New("Node key mismatch.")
+	ErrNotMember     = errors.New("Not a member.")
+)
+
+// 参加が認められた鍵か確認する関数
+type member_fn func(key string) bool
+
+// ノードの識別鍵(ed25519)
+type Identity struct {
+	priv ed25519.PrivateKey
+	pub  ed25519.PublicKey
+}
+
+// 識別鍵の生成
+func NewIdentity() (*Identity, error) {
+	return NewIdentityFrom(rand.Reader)
+}
+
+// 乱数源を指定した識別鍵の生成
+func NewIdentityFrom(r io.Reader) (*Identity, error) {
+	pub, priv, err := ed25519.GenerateKey(r)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{priv: priv, pub: pub}, nil
+}
+
+// 識別鍵をファイルから読み込む
+// ファイルが無い場合は生成して保存する(シードを16進で保存)
+func LoadIdentity(path string) (*Identity, error) {
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		id, err := NewIdentity()
+		if err != nil {
+			return nil, err
+		}
+		seed := hex.EncodeToString(id.priv.Seed())
+		if err := os.WriteFile(path, []byte(seed+"\n"), 0600); err != nil {
+			return nil, err
+		}
+		fmt.Println("Node key created:", path, id.Key())
+		return id, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	seed, err := hex.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, errors.New("Invalid node key file:" + path)
+	}
+	priv := ed25519.NewKeyFromSeed(seed)
+	return &Identity{priv: priv, pub: priv.Public().(ed25519.PublicKey)}, nil
+}
+
+// 公開鍵(16進)
+func (id *Identity) Key() string {
+	return hex.EncodeToString(id.pub)
+}
+
+// 署名
+func (id *Identity) Sign(msg []byte) []byte {
+	return ed25519.Sign(id.priv, msg)
+}
+
+// 署名の検証
+func verifySig(pub []byte, msg []byte, sig []byte) bool {
+	if len(pub) != KEY_SIZE || len(sig) != ed25519.SignatureSize {
+		return false
+	}
+	return ed25519.Verify(ed25519.PublicKey(pub), msg, sig)
+}
+
+// 公開鍵(16進)の形式確認
+func validKey(key string) bool {
+	b, err := hex.DecodeString(key)
+	return err == nil && len(b) == KEY_SIZE
+}
+
+// 受信済みメッセージの記録(リプレイ対策)
+// 送信時刻が許容範囲外のものと、範囲内で同じノンスのものを拒否する
+// 上限に達したら一番古い記録を捨てる(受信を止めない)
+type replayCache struct {
+	mu         sync.Mutex
+	seen       map[string]replayEntry
+	sources    map[string]int // 送信元ごとの記録数
+	pruned     time.Time
+	clock      Clock
+	limit      int // 記録の上限(0ならMAX_REPLAY_CACHE)
+	per_source int // 送信元ごとの記録の上限(0なら制限しない)
+}
+
+// 受信の記録
+type replayEntry struct {
+	sent   time.Time
+	source string
+}
+
+// 受信を記録。拒否する場合はエラーを返す
+func (rc *replayCache) check(key string, source string, nonce uint64, ts int64) error {
+	now := clockNow(rc.clock)
+	sent := time.Unix(0, ts)
+	if sent.Before(now.Add(-REPLAY_WINDOW)) || sent.After(now.Add(REPLAY_WINDOW)) {
+		return ErrStale
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if rc.seen == nil {
+		rc.seen = make(map[string]replayEntry)
+		rc.sources = make(map[string]int)
+	}
+	limit := rc.limit
+	if limit <= 0 {
+		limit = MAX_REPLAY_CACHE
+	}
+	// 許容範囲を過ぎた記録は時刻の確認で弾けるので消してよい
+	if now.Sub(rc.pruned) > REPLAY_WINDOW || len(rc.seen) >= limit {
+		for k, e := range rc.seen {
+			if now.Sub(e.sent) > 2*REPLAY_WINDOW {
+				rc.forget(k, e)
+			}
+		}
+		rc.pruned = now
+	}
+
+	k := fmt.Sprintf("%s:%x", key, nonce)
+	if _, ok := rc.seen[k]; ok {
+		return ErrReplay
+	}
+	if rc.per_source > 0 && rc.sources[source] >= rc.per_source {
+		return ErrReplayLimit
+	}
+	if len(rc.seen) >= limit {
+		rc.evictOldest()
+	}
+	rc.seen[k] = replayEntry{sent: sent, source: source}
+	rc.sources[source]++
+	return nil
+}
+
+// 記録があるか
+func (rc *replayCache) has(key string, nonce uint64) bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	_, ok := rc.seen[fmt.Sprintf("%s:%x", key, nonce)]
+	return ok
+}
+
+// 記録を消す
+func (rc *replayCache) forget(k string, e replayEntry) {
+	delete(rc.seen, k)
+	rc.sources[e.source]--
+	if rc.sources[e.source] <= 0 {
+		delete(rc.sources, e.source)
+	}
+}
+
+// 一番古い記録を捨てる
+func (rc *replayCache) evictOldest() {
+	oldest := ""
+	var at time.Time
+	for k, e := range rc.seen {
+		if oldest == "" || e.sent.Before(at) {
+			oldest, at = k, e.sent
+		}
+	}
+	if oldest != "" {
+		rc.forget(oldest, rc.seen[oldest])
+	}
+}
+
+// ハンドシェイクのメッセージ
+// 自ノードの情報を送り、送信元の鍵と情報の鍵が一致することを確認する
+// 使い捨て鍵を交換して暗号化セッションを作る
+type HelloMsg struct {
+	Node  Node   `json:"node"`
+	Reply bool   `json:"reply"`         // 返事が欲しい場合はtrue
+	Eph   []byte `json:"eph"`           // 送信元の使い捨て鍵(X25519)
+	Ack   []byte `json:"ack,omitempty"` // 返事の場合、相手の使い捨て鍵
+}
+
+// バイナリ形式に変換
+func (m *HelloMsg) EncodeWire(w *Writer) {
+	m.Node.EncodeWire(w)
+	if m.Reply {
+		w.Byte(1)
+	} else {
+		w.Byte(0)
+	}
+	w.Bytes(m.Eph)
+	w.Bytes(m.Ack)
+}
+
+// バイナリ形式から変換
+func (m *HelloMsg) DecodeWire(r *Reader) {
+	m.Node.DecodeWire(r)
+	m.Reply = r.Byte() == 1
+	m.Eph = r.Bytes()
+	m.Ack = r.Bytes()
+}
+
+// ハンドシェイクのメッセージの検証
+func (m *HelloMsg) Validate() error {
+	if err := m.Node.Validate(); err != nil {
+		return err
+	}
+	if m.Node.PubKey == "" {
+		return Malformed("pubkey")
+	}
+	if len(m.Eph) != 32 {
+		return Malformed("eph")
+	}
+	if len(m.Ack) != 0 && len(m.Ack) != 32 {
+		return Malformed("ack")
+	}
+	return nil
+}
+
+// 識別鍵の設定(Initの前に呼ぶ)
+func (p2p *P2PNetwork) SetIdentity(id *Identity) {
+	p2p.identity = id
+}
+
+// 自ノードの公開鍵
+func (p2p *P2PNetwork) Key() string {
+	if p2p.identity == nil {
+		return ""
+	}
+	return p2p.identity.Key()
+}
+
+// 自ノードの識別鍵(記録への署名に使う)
+func (p2p *P2PNetwork) Identity() *Identity {
+	return p2p.identity
+}
+
+// ハンドシェイクを受け付ける鍵の設定
+// 空の場合は最初に名乗った鍵をそのアドレスの鍵として固定する
+func (p2p *P2PNetwork) SetTrustedKeys(keys []string) error {
+	trusted := make(map[string]bool)
+	for _, k := range keys {
+		k = strings.ToLower(strings.TrimSpace(k))
+		if k == "" {
+			continue
+		}
+		if !validKey(k) {
+			return errors.New("Invalid node key:" + k)
+		}
+		trusted[k] = true
+	}
+	p2p.trusted = trusted
+	return nil
+}
+
+// 参加ノードの確認方法を登録(登録しなければ制限しない)
+func (p2p *P2PNetwork) SetMembership(fn member_fn) {
+	p2p.member = fn
+}
+
+// 参加が認められた鍵か確認
+func (p2p *P2PNetwork) isMember(key string) bool {
+	if p2p.member == nil {
+		return true
+	}
+	return key != "" && p2p.member(key)
+}
+
+// 参加が取り消されたノードを切断する
+func (p2p *P2PNetwork) EnforceMembership() {
+	for _, node := range p2p.peers.snapshot() {
+		if node.Self || node.PubKey == "" || p2p.isMember(node.PubKey) {
+			continue
+		}
+		fmt.Println("Remove non-member:", node.me(), node.PubKey)
+		p2p.Remove(node.ID)
+	}
+}
+
+// 受信メッセージの送信元の確認
+// 登録済みのノードの鍵で署名されたものだけ受け付ける(ハンドシェイクは除く)
+// リプレイの確認は送信元を特定してから行う
+// 未登録の送信元からのHELLOは、送信元アドレスごとに数を制限した別の記録で確認する
+// (使い捨ての鍵でHELLOを送り続けても、登録済みのノードの受信は止まらない)
+func (p2p *P2PNetwork) authenticate(env *envelope, addr string) (*Node, error) {
+	if p2p.isBanned(env.key, "") {
+		return nil, ErrBanned
+	}
+	node := p2p.peers.searchKey(env.key)
+	if node != nil {
+		// 登録前に受け取ったHELLOの再送も拒否する
+		if p2p.hello_replay.has(env.key, env.nonce) {
+			return nil, ErrReplay
+		}
+		if err := p2p.replay.check(env.key, node.me(), env.nonce, env.ts); err != nil {
+			return nil, err
+		}
+		return node, nil
+	}
+	if env.cmd == CMD_HELLO {
+		if err := p2p.hello_replay.check(env.key, addr, env.nonce, env.ts); err != nil {
+			return nil, err
+		}
+		// 未登録の送信元はIDが-1のNodeで表す
+		return &Node{ID: -1, PubKey: env.key}, nil
+	}
+	return nil, ErrUnknownSender
+}
+
+// ハンドシェイクを送る(鍵交換の開始)
+func (p2p *P2PNetwork) hello(node *Node, reply bool) error {
+	self := p2p.peers.self()
+	if self == nil {
+		return errors.New("No self node.")
+	}
+	priv, err := node.session.newEphemeral()
+	if err != nil {
+		return err
+	}
+	m := &HelloMsg{Node: *self, Reply: reply, Eph: priv.PublicKey().Bytes()}
+	return node.post(CMD_HELLO, p2p.Marshal(m))
+}
+
+// ハンドシェイクに返事をして、セッション鍵を作る
+func (p2p *P2PNetwork) answer(node *Node, peer_eph []byte) error {
+	self := p2p.peers.self()
+	if self == nil {
+		return errors.New("No self node.")
+	}
+	priv, err := newX25519Key(p2p.entropy)
+	if err != nil {
+		return err
+	}
+	key, err := deriveSessionKey(priv, peer_eph, p2p.Key(), node.PubKey, p2p.magic)
+	if err != nil {
+		return err
+	}
+
+	// 返事は平文なので、送ってから鍵を切り替える
+	m := &HelloMsg{Node: *self, Eph: priv.PublicKey().Bytes(), Ack: peer_eph}
+	if err := node.post(CMD_HELLO, p2p.Marshal(m)); err != nil {
+		return err
+	}
+	node.session.install(key)
+	return nil
+}
+
+// セッションができるまでハンドシェイクを送り直す
+func (p2p *P2PNetwork) handshake(node *Node) {
+	for i := 0; i < HELLO_RETRY; i++ {
+		if err := p2p.hello(node, true); err != nil {
+			fmt.Println("hello error:", node.me(), err)
+		}
+		p2p.clock.Sleep(HELLO_INTERVAL)
+		if node.session.ready() || p2p.peers.get(node.ID) != node {
+			return
+		}
+	}
+	fmt.Println("Handshake timeout:", node.me())
+}
+
+// ハンドシェイクアクション
+// 未登録のノードはアドレスを確認してから登録し、登録済みで鍵が未確定なら鍵を固定する
+func (p2p *P2PNetwork) Hello(from *Node, msg []byte) error {
+	fmt.Println("hello action")
+
+	m := new(HelloMsg)
+	if err := Unmarshal(msg, m); err != nil {
+		return err
+	}
+	if m.Node.PubKey != from.PubKey {
+		return Malformed("hello key")
+	}
+
+	node := p2p.peers.search(m.Node.Host, m.Node.P2PPort)
+	if node != nil && node.Self {
+		return Malformed("hello from self address")
+	}
+	if n := p2p.peers.searchKey(from.PubKey); n != nil && n != node {
+		// 別のアドレスで登録済みの鍵
+		return Misbehave(MIS_FORGED, "key registered for "+n.me())
+	}
+	if p2p.isBanned("", m.Node.me()) {
+		return ErrBanned
+	}
+
+	if len(p2p.trusted) > 0 && !p2p.trusted[from.PubKey] {
+		fmt.Println("Untrusted node:", m.Node.me(), from.PubKey)
+		return ErrUntrusted
+	}
+	if !p2p.isMember(from.PubKey) {
+		fmt.Println("Not a member:", m.Node.me(), from.PubKey)
+		return ErrNotMember
+	}
+
+	welcome := false
+	if node == nil {
+		// 確認要求への返事なら登録する
+		node = p2p.unverified.verified(m.Node.me(), from.PubKey, m.Ack)
+		if node == nil {
+			// 名乗ったアドレスに確認要求を送る(返事はそれに兼ねる)
+			p2p.verify(&m.Node, m.Eph)
+			return nil
+		}
+		node.ApiPort = m.Node.ApiPort
+		if _, err := p2p.peers.add(node); err != nil {
+			node.disconnect()
+			return err
+		}
+		fmt.Println("Node joined:", node.me(), node.PubKey)
+	} else {
+		pinned, err := p2p.peers.pin(node, from.PubKey)
+		if err != nil {
+			fmt.Println("Node key mismatch:", node.me())
+			return Misbehave(MIS_FORGED, "key mismatch for "+node.me())
+		}
+		if pinned {
+			fmt.Println("Node key pinned:", node.me(), node.PubKey)
+		}
+		welcome = p2p.peers.welcomed(node)
+	}
+
+	// 鍵交換
+	if len(m.Ack) > 0 {
+		// こちらから送ったハンドシェイクへの返事
+		// 古い返事なら鍵は作らないが、返事の要求には答える
+		if priv := node.session.takeEphemeral(m.Ack); priv != nil {
+			key, err := deriveSessionKey(priv, m.Eph, p2p.Key(), node.PubKey, p2p.magic)
+			if err != nil {
+				return err
+			}
+			node.session.install(key)
+		} else {
+			fmt.Println("Stale hello reply:", node.me())
+		}
+	}
+	if m.Reply {
+		if err := p2p.answer(node, m.Eph); err != nil {
+			return err
+		}
+	}
+
+	// サーバ追加を受けたノードには、ハンドシェイク完了後に他のサーバ情報を送る
+	if welcome {
+		go p2p.welcome(node)
+	}
+	return nil
+}
+
+// 他のサーバ情報を送る
+// 相手はこちらの返事を処理するまで登録していないので、少し待ってから送る
+func (p2p *P2PNetwork) welcome(node *Node) {
+	p2p.clock.Sleep(HELLO_INTERVAL)
+	for _, n := range p2p.peers.snapshot() {
+		if n != node {
+			node.post(CMD_ADDSRV, p2p.Marshal(n))
+		}
+	}
+}
@@ -0,0 +1,253 @@
+/*
+  My Block Chain: P2P signed message tests
+*/
+package P2P
+
+import (
+	"bytes"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/*
+署名付きメッセージの受信の試験
+	MemNetworkで2つのノードをつなぎ、乱数の種を固定して、受信側が
+	署名の改ざん、リプレイ、登録と違う鍵の署名、未登録の送信元からのHELLOの洪水を
+	拒否することを確かめる。不正なフレームは直接MemNetworkに書き込む。
+*/
+
+const (
+	test_port    = 4000
+	test_timeout = 10 * time.Second
+)
+
+// 試験用のノード(受信したCMD_MODIFYDATAのメッセージをchに送る)
+type testNode struct {
+	p2p  *P2PNetwork
+	addr string
+	ch   chan []byte
+}
+
+// 試験用のノードの作成
+func newTestNode(t *testing.T, mn *MemNetwork, host string, seed int64) *testNode {
+	p2p := new(P2PNetwork)
+	p2p.SetTransport(mn)
+	p2p.SetEntropy(NewSeededEntropy(seed))
+	if _, err := p2p.Init(host, 3000, test_port); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p2p.Close() })
+
+	tn := &testNode{p2p: p2p, addr: p2p.Self(), ch: make(chan []byte, 16)}
+	p2p.SetAction(CMD_MODIFYDATA, func(msg []byte) error {
+		tn.ch <- msg
+		return nil
+	})
+	return tn
+}
+
+// 2つのノードをつないで、セッションができるまで待つ
+func connectTestNodes(t *testing.T, a *testNode, b *testNode) {
+	if _, err := a.p2p.Add(&Node{Host: b.p2p.peers.self().Host, ApiPort: 3000, P2PPort: test_port}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "session", func() bool {
+		return a.peer(b) != nil && a.peer(b).session.ready() && b.peer(a) != nil && b.peer(a).session.ready()
+	})
+}
+
+// 相手のノードの登録
+func (tn *testNode) peer(other *testNode) *Node {
+	return tn.p2p.peers.searchKey(other.p2p.Key())
+}
+
+// 条件を満たすまで待つ
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(test_timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout:", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// 受信したメッセージ(無ければnil)
+func (tn *testNode) received(d time.Duration) []byte {
+	select {
+	case msg := <-tn.ch:
+		return msg
+	case <-time.After(d):
+		return nil
+	}
+}
+
+// 拒否した数
+func (tn *testNode) rejected() uint64 {
+	return atomic.LoadUint64(&tn.p2p.rejected)
+}
+
+// 送信元アドレスの減点(無ければ0)
+func (tn *testNode) penalty(addr string) int {
+	for _, st := range tn.p2p.penalties.stats() {
+		if st.Addr == addr {
+			return st.Score
+		}
+	}
+	return 0
+}
+
+// aからbへのフレームを作る(sessがnilなら暗号化しない)
+func testFrame(t *testing.T, id *Identity, sess *session, to *testNode, msg []byte, now time.Time, seed int64) []byte {
+	frame, err := encodeFrame(id, sess, to.p2p.magic, CMD_MODIFYDATA, msg, now, NewSeededEntropy(seed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+// フレームを直接書き込み、送信元のアドレスを返す
+func inject(t *testing.T, mn *MemNetwork, to *testNode, frames ...[]byte) string {
+	c, err := mn.Dial(to.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range frames {
+		c.Write(f)
+	}
+	return string(c.(*memDialer).from)
+}
+
+// 2つのノードをつないだネットワーク
+func newTestPair(t *testing.T) (*MemNetwork, *testNode, *testNode) {
+	mn := NewMemNetwork()
+	a := newTestNode(t, mn, "10.0.0.1", 1)
+	b := newTestNode(t, mn, "10.0.0.2", 2)
+	connectTestNodes(t, a, b)
+	return mn, a, b
+}
+
+func TestSignedFrameAccepted(t *testing.T) {
+	mn, a, b := newTestPair(t)
+	frame := testFrame(t, a.p2p.identity, a.peer(b).session, b, []byte("hello"), time.Now(), 10)
+	inject(t, mn, b, frame)
+	if msg := b.received(test_timeout); !bytes.Equal(msg, []byte("hello")) {
+		t.Fatalf("valid frame not delivered: %q", msg)
+	}
+}
+
+func TestTamperedSignatureRejected(t *testing.T) {
+	mn, a, b := newTestPair(t)
+	sess := a.peer(b).session
+
+	// 署名と中身をそれぞれ書き換え、チェックサムは計算し直す
+	for i, offset := range []int{FRAME_HEADER + KEY_SIZE + 16, FRAME_HEADER + ENVELOPE_HEADER + SESSION_KEY_ID} {
+		frame := testFrame(t, a.p2p.identity, sess, b, []byte("tampered"), time.Now(), int64(20+i))
+		frame[offset] ^= 0x01
+		sum := checksum(frame[FRAME_HEADER:])
+		copy(frame[11:15], sum[:])
+
+		from := inject(t, mn, b, frame)
+		waitFor(t, "penalty", func() bool { return b.penalty(from) > 0 })
+		if score := b.penalty(from); score < PENALTY_FORGED {
+			t.Fatalf("tampered frame %d not penalized as forged: %d", i, score)
+		}
+	}
+	if msg := b.received(100 * time.Millisecond); msg != nil {
+		t.Fatalf("tampered frame delivered: %q", msg)
+	}
+}
+
+func TestReplayRejected(t *testing.T) {
+	mn, a, b := newTestPair(t)
+	sess := a.peer(b).session
+
+	// 同じフレーム(同じノンス)は1度だけ受け付ける
+	before := b.rejected()
+	frame := testFrame(t, a.p2p.identity, sess, b, []byte("once"), time.Now(), 30)
+	inject(t, mn, b, frame, frame)
+	if msg := b.received(test_timeout); !bytes.Equal(msg, []byte("once")) {
+		t.Fatalf("first frame not delivered: %q", msg)
+	}
+	waitFor(t, "replay rejected", func() bool { return b.rejected() > before })
+	if msg := b.received(100 * time.Millisecond); msg != nil {
+		t.Fatalf("replayed frame delivered: %q", msg)
+	}
+
+	// 送信時刻が許容範囲外のものは拒否する
+	for i, ts := range []time.Time{time.Now().Add(-2 * REPLAY_WINDOW), time.Now().Add(2 * REPLAY_WINDOW)} {
+		before := b.rejected()
+		inject(t, mn, b, testFrame(t, a.p2p.identity, sess, b, []byte("stale"), ts, int64(31+i)))
+		waitFor(t, "stale rejected", func() bool { return b.rejected() > before })
+	}
+	if msg := b.received(100 * time.Millisecond); msg != nil {
+		t.Fatalf("stale frame delivered: %q", msg)
+	}
+}
+
+func TestOtherKeyRejected(t *testing.T) {
+	mn, a, b := newTestPair(t)
+	sess := a.peer(b).session
+	other, err := NewIdentityFrom(NewSeededEntropy(40))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 登録されていない鍵で署名したもの
+	before := b.rejected()
+	inject(t, mn, b, testFrame(t, other, sess, b, []byte("other"), time.Now(), 41))
+	waitFor(t, "unknown sender rejected", func() bool { return b.rejected() > before })
+
+	// 登録済みのノードの鍵を名乗り、別の鍵で署名したもの
+	frame := testFrame(t, other, sess, b, []byte("forged"), time.Now(), 42)
+	copy(frame[FRAME_HEADER:FRAME_HEADER+KEY_SIZE], a.p2p.identity.pub)
+	sum := checksum(frame[FRAME_HEADER:])
+	copy(frame[11:15], sum[:])
+	from := inject(t, mn, b, frame)
+	waitFor(t, "forged key penalized", func() bool { return b.penalty(from) >= PENALTY_FORGED })
+
+	if msg := b.received(100 * time.Millisecond); msg != nil {
+		t.Fatalf("frame with other key delivered: %q", msg)
+	}
+}
+
+func TestHelloFloodLimited(t *testing.T) {
+	mn, a, b := newTestPair(t)
+
+	// 1つの送信元アドレスから、毎回違う未登録の鍵でHELLOを送り続ける
+	flood := MAX_HELLO_SOURCE + 8
+	frames := make([][]byte, 0, flood)
+	for i := 0; i < flood; i++ {
+		id, err := NewIdentityFrom(NewSeededEntropy(int64(100 + i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		eph, err := newX25519Key(NewSeededEntropy(int64(1000 + i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := &HelloMsg{Node: Node{Host: "10.0.1.1", ApiPort: 3000, P2PPort: uint16(5000 + i), PubKey: id.Key()}, Reply: true, Eph: eph.PublicKey().Bytes()}
+		frame, err := encodeFrame(id, nil, b.p2p.magic, CMD_HELLO, b.p2p.Marshal(m), time.Now(), NewSeededEntropy(int64(2000+i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, frame)
+	}
+	before := b.rejected()
+	from := inject(t, mn, b, frames...)
+	waitFor(t, "hello flood limited", func() bool { return b.rejected() >= before+uint64(flood-MAX_HELLO_SOURCE) })
+
+	b.p2p.hello_replay.mu.Lock()
+	recorded := b.p2p.hello_replay.sources[from]
+	b.p2p.hello_replay.mu.Unlock()
+	if recorded > MAX_HELLO_SOURCE {
+		t.Fatalf("hello records from one source: %d > %d", recorded, MAX_HELLO_SOURCE)
+	}
+
+	// 登録済みのノードからの受信は止まらない
+	inject(t, mn, b, testFrame(t, a.p2p.identity, a.peer(b).session, b, []byte("after flood"), time.Now(), 50))
+	if msg := b.received(test_timeout); !bytes.Equal(msg, []byte("after flood")) {
+		t.Fatalf("registered node blocked by hello flood: %q", msg)
+	}
+}
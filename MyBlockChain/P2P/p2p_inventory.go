@@ -0,0 +1,264 @@
+/*
+  My Block Chain: P2P inventory module
+*/
+package P2P
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	INV_BLOCK = 1
+
+	MAX_KNOWN_INV   = 1024
+	GETDATA_TIMEOUT = 10 * time.Second
+)
+
+// インベントリ通知、データ要求のメッセージ
+type InvMsg struct {
+	From   string   `json:"from"`
+	Kind   int      `json:"kind"`
+	Hashes []string `json:"hashes"`
+}
+
+// バイナリ形式に変換
+func (inv *InvMsg) EncodeWire(w *Writer) {
+	w.String(inv.From)
+	w.Varint(int64(inv.Kind))
+	w.Uvarint(uint64(len(inv.Hashes)))
+	for _, h := range inv.Hashes {
+		w.Hash(h)
+	}
+}
+
+// バイナリ形式から変換
+func (inv *InvMsg) DecodeWire(r *Reader) {
+	inv.From = r.String()
+	inv.Kind = int(r.Varint())
+	n := r.Count()
+	inv.Hashes = make([]string, 0, n)
+	for i := 0; i < n && r.Err() == nil; i++ {
+		inv.Hashes = append(inv.Hashes, r.Hash())
+	}
+}
+
+// インベントリを持っているか確認する関数
+type inv_has_fn func(kind int, hash string) bool
+
+// インベントリの中身(送信コマンドとメッセージ)を取り出す関数
+type inv_get_fn func(kind int, hash string) (int, []byte)
+
+// ノードが既に知っているインベントリ
+// 古いものから忘れる
+type knownInv struct {
+	mu    sync.Mutex
+	set   map[string]bool
+	order []string
+}
+
+// 既知インベントリの初期化
+func newKnownInv() *knownInv {
+	k := new(knownInv)
+	k.set = make(map[string]bool)
+	k.order = make([]string, 0)
+	return k
+}
+
+// インベントリのキー
+func invKey(kind int, hash string) string {
+	return strconv.Itoa(kind) + ":" + hash
+}
+
+// 既知として登録。新規ならtrueを返す
+func (k *knownInv) add(key string) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.set[key] {
+		return false
+	}
+	k.set[key] = true
+	k.order = append(k.order, key)
+	if len(k.order) > MAX_KNOWN_INV {
+		delete(k.set, k.order[0])
+		k.order = k.order[1:]
+	}
+	return true
+}
+
+// 既知の登録を取り消す(送信に失敗した時)
+func (k *knownInv) remove(key string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if !k.set[key] {
+		return
+	}
+	delete(k.set, key)
+	for i := len(k.order) - 1; i >= 0; i-- {
+		if k.order[i] == key {
+			k.order = append(k.order[:i], k.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// 既知か確認
+func (k *knownInv) has(key string) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.set[key]
+}
+
+// 要求中のインベントリ
+// 複数のノードから同じ通知が来ても、要求は1度だけにする
+type invRequests struct {
+	mu       sync.Mutex
+	inflight map[string]time.Time
+	clock    Clock
+}
+
+// 要求を登録。要求済みならfalseを返す
+func (r *invRequests) start(key string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.inflight == nil {
+		r.inflight = make(map[string]time.Time)
+	}
+	now := clockNow(r.clock)
+	for k, t := range r.inflight {
+		if now.Sub(t) > GETDATA_TIMEOUT {
+			delete(r.inflight, k)
+		}
+	}
+	if _, ok := r.inflight[key]; ok {
+		return false
+	}
+	r.inflight[key] = now
+	return true
+}
+
+// 要求完了
+func (r *invRequests) done(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.inflight, key)
+}
+
+// インベントリの問い合わせ先を登録
+func (p2p *P2PNetwork) SetInventory(has inv_has_fn, get inv_get_fn) {
+	p2p.inv_has = has
+	p2p.inv_get = get
+}
+
+// インベントリの取得完了を通知
+func (p2p *P2PNetwork) Received(kind int, hash string) {
+	p2p.inv_requests.done(invKey(kind, hash))
+}
+
+// インベントリを通知する
+// 既に知っているノードには送らない。送るのはfanout個までで、受け取ったノードが
+// 取得後に同じように通知するのでゴシップとして全体に広がる
+// 送れなかったノードは知らないままにして、次の通知で送り直す
+func (p2p *P2PNetwork) Announce(kind int, hash string) {
+	fmt.Println("Announce:", kind, hash)
+
+	key := invKey(kind, hash)
+	b := p2p.Marshal(&InvMsg{From: p2p.Self(), Kind: kind, Hashes: []string{hash}})
+
+	sent := 0
+	for _, node := range p2p.shuffledPeers(nil) {
+		if p2p.gossip.fanout > 0 && sent >= p2p.gossip.fanout {
+			break
+		}
+		if !node.known.add(key) {
+			continue
+		}
+		if err := node.post(CMD_INV, b); err != nil {
+			fmt.Println("send error:", node, err)
+			node.known.remove(key)
+			continue
+		}
+		sent++
+	}
+}
+
+// 指定ノードにインベントリの中身を送る
+// 送れた時だけ既知にする
+func (p2p *P2PNetwork) Push(node *Node, kind int, hash string, cmd int, msg []byte) error {
+	if err := node.post(cmd, msg); err != nil {
+		return err
+	}
+	node.known.add(invKey(kind, hash))
+	return nil
+}
+
+// インベントリ通知アクション
+func (p2p *P2PNetwork) Inv(node *Node, msg []byte) error {
+	fmt.Println("inv action")
+
+	inv := new(InvMsg)
+	err := Unmarshal(msg, inv)
+	if err != nil {
+		return err
+	}
+	if inv.From != node.me() {
+		// 署名した鍵のノードと名乗ったアドレスが違う
+		return Malformed("from")
+	}
+	if p2p.inv_has == nil {
+		return nil
+	}
+
+	// 持っていないものだけ要求する
+	missing := make([]string, 0)
+	for _, hash := range inv.Hashes {
+		key := invKey(inv.Kind, hash)
+		node.known.add(key)
+		if p2p.inv_has(inv.Kind, hash) {
+			continue
+		}
+		if !p2p.inv_requests.start(key) {
+			continue
+		}
+		missing = append(missing, hash)
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	b := p2p.Marshal(&InvMsg{From: p2p.Self(), Kind: inv.Kind, Hashes: missing})
+	return node.post(CMD_GETDATA, b)
+}
+
+// データ要求アクション
+func (p2p *P2PNetwork) GetData(node *Node, msg []byte) error {
+	fmt.Println("getdata action")
+
+	inv := new(InvMsg)
+	err := Unmarshal(msg, inv)
+	if err != nil {
+		return err
+	}
+	if inv.From != node.me() {
+		return Malformed("from")
+	}
+	if p2p.inv_get == nil {
+		return nil
+	}
+
+	for _, hash := range inv.Hashes {
+		cmd, data := p2p.inv_get(inv.Kind, hash)
+		if data == nil {
+			fmt.Println("Inventory NOT Found:", inv.Kind, hash)
+			continue
+		}
+		p2p.Push(node, inv.Kind, hash, cmd, data)
+	}
+
+	return nil
+}
@@ -0,0 +1,134 @@
+/*
+  My Block Chain: P2P network magic module
+*/
+package P2P
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+/*
+ネットワークの識別
+	フレームの先頭4バイト(magic)はチェーンのパラメータ(ネットワーク名、genesisブロック、
+	難易度、管理者など)から作る。パラメータが違うネットワークのフレームは解析せずに捨て、
+	送信元ごとに数える。同じホストで複数のネットワークを動かしていて、ポートを
+	間違えても混ざらない。
+
+	ネットワーク名と鍵だけでは、既定の名前のままの別々のネットワークが同じmagicになる。
+	最初のノードでネットワークごとのseed(乱数)を作ってパラメータに混ぜ、
+	参加するノードには同じseedを渡す。
+
+	送信元の鍵はフレームに書かれたもの(署名は確認しない)なので、統計にだけ使う。
+*/
+const (
+	MAX_FOREIGN_SOURCES = 1024
+	NETWORK_SEED_SIZE   = 16
+)
+
+// 他のネットワークからのフレームの統計情報
+type ForeignStats struct {
+	Key    string    `json:"key"` // フレームに書かれた送信元の鍵
+	Addr   string    `json:"addr"`
+	Peer   bool      `json:"peer"` // 登録済みのノードの鍵か
+	Magic  string    `json:"magic"`
+	Frames uint64    `json:"frames"`
+	Last   time.Time `json:"last"`
+}
+
+// 他のネットワークからのフレームの記録
+type foreignFrames struct {
+	mu      sync.Mutex
+	sources map[string]*ForeignStats
+	total   uint64
+	clock   Clock
+}
+
+// チェーンのパラメータからmagicを作る
+func NetworkMagic(params ...string) [4]byte {
+	h := sha256.New()
+	h.Write(wire_magic[:])
+	for _, p := range params {
+		h.Write([]byte(p))
+		h.Write([]byte{0})
+	}
+	var magic [4]byte
+	copy(magic[:], h.Sum(nil))
+	return magic
+}
+
+// ネットワークごとのseedを作る(16進)
+func NewNetworkSeed() (string, error) {
+	b := make([]byte, NETWORK_SEED_SIZE)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// seedの形式の確認
+func ValidNetworkSeed(seed string) error {
+	if b, err := hex.DecodeString(seed); err != nil || len(b) != NETWORK_SEED_SIZE {
+		return errors.New("Invalid network seed: " + seed)
+	}
+	return nil
+}
+
+// magicの設定(Initの前に呼ぶ。設定しなければ共通の値)
+func (p2p *P2PNetwork) SetNetworkMagic(magic [4]byte) {
+	p2p.magic = magic
+}
+
+// 使っているmagic(16進)
+func (p2p *P2PNetwork) Magic() string {
+	return hex.EncodeToString(p2p.magic[:])
+}
+
+// 他のネットワークのフレームを記録する
+func (ff *foreignFrames) add(frame []byte, addr string, peer func(key string) bool) {
+	key := ""
+	if len(frame) >= FRAME_HEADER+KEY_SIZE {
+		key = hex.EncodeToString(frame[FRAME_HEADER : FRAME_HEADER+KEY_SIZE])
+	}
+	magic := hex.EncodeToString(frame[0:4])
+
+	ff.mu.Lock()
+	defer ff.mu.Unlock()
+
+	ff.total++
+	if ff.sources == nil {
+		ff.sources = make(map[string]*ForeignStats)
+	}
+	id := key
+	if id == "" {
+		id = addr
+	}
+	fs, ok := ff.sources[id]
+	if !ok {
+		if len(ff.sources) >= MAX_FOREIGN_SOURCES {
+			return
+		}
+		fs = &ForeignStats{Key: key, Peer: key != "" && peer(key)}
+		ff.sources[id] = fs
+	}
+	fs.Addr = addr
+	fs.Magic = magic
+	fs.Frames++
+	fs.Last = clockNow(ff.clock)
+}
+
+// 統計情報
+func (ff *foreignFrames) stats() (uint64, []ForeignStats) {
+	ff.mu.Lock()
+	defer ff.mu.Unlock()
+
+	stats := make([]ForeignStats, 0, len(ff.sources))
+	for _, fs := range ff.sources {
+		stats = append(stats, *fs)
+	}
+	return ff.total, stats
+}
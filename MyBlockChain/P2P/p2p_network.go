@@ -4,11 +4,14 @@
 package P2P
 
 import (
-	"encoding/json"
+	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,39 +22,68 @@ const (
 	CMD_SENDBLOCK   = 4
 	CMD_MININGBLOCK = 5
 	CMD_MODIFYDATA  = 6
+	CMD_INV         = 7
+	CMD_GETDATA     = 8
+	CMD_REQUEST     = 9
+	CMD_RESPONSE    = 10
+	CMD_HELLO       = 11
+	CMD_GOSSIP      = 12
+
+	MAX_PACKET = 65507
 
 	debug_mode = false
 )
 
 // サーバ管理の構造体
 type Node struct {
-	Host    string   `json:"host" form:"host" query:"host"`
-	ApiPort uint16   `json:"api_port" form :"api_port" query:"api_port"`
-	P2PPort uint16   `json:"p2p_port" form :"p2p_port" query:"p2p_port"`
-	Self    bool     `json:"-"`
-	Conn    net.Conn `json:"-"`
+	ID      int    `json:"id"`
+	Host    string `json:"host" form:"host" query:"host"`
+	ApiPort uint16 `json:"api_port" form :"api_port" query:"api_port"`
+	P2PPort uint16 `json:"p2p_port" form :"p2p_port" query:"p2p_port"`
+	PubKey  string `json:"pubkey" form:"pubkey" query:"pubkey"` // 識別鍵(16進)。空ならハンドシェイクで固定する
+	Self    bool   `json:"-"`
+	Conn    Conn   `json:"-"`
+	queue   *sendQueue
+	known   *knownInv
+	sign    *Identity // 送信メッセージの署名鍵
+	welcome bool      // ハンドシェイク後に他のサーバ情報を送る
+	session *session  // 暗号化セッション
+	magic   [4]byte   // 送信フレームのネットワーク識別子
+	clock   Clock     // 送信フレームの時刻
+	entropy io.Reader // 送信フレームのノンス
 }
 
 // ネットワーク接続
-func (node *Node) connect() {
+func (node *Node) connect(p2p *P2PNetwork) {
+	node.sign = p2p.identity
+	node.magic = p2p.magic
+	node.clock = p2p.clock
+	node.entropy = p2p.entropy
+	if node.session == nil {
+		node.session = new(session)
+	}
+	node.session.clock = p2p.clock
+	node.session.entropy = p2p.entropy
 	target := node.Host + ":" + strconv.Itoa(int(node.P2PPort))
 
 	if debug_mode {
 		fmt.Println("target = ", target)
 	}
 
-	conn, err := net.Dial("udp", target)
+	conn, err := p2p.transport.Dial(target)
 	if err != nil {
 		fmt.Println("failed to connect ", target, err)
 		node.Conn = nil
 	} else {
 		fmt.Println(target, "connected.")
 		node.Conn = conn
+		node.startQueue()
 	}
 }
 
 // ネットワーク切断
 func (node *Node) disconnect() {
+	node.stopQueue()
 	if node.Conn != nil {
 		node.Conn.Close()
 	}
@@ -80,75 +112,166 @@ func (node *Node) me() string {
 	return node.Host + ":" + strconv.FormatInt(int64(node.P2PPort), 10)
 }
 
+// バイナリ形式に変換
+func (node *Node) EncodeWire(w *Writer) {
+	w.String(node.Host)
+	w.Uvarint(uint64(node.ApiPort))
+	w.Uvarint(uint64(node.P2PPort))
+	w.Hash(node.PubKey)
+}
+
+// バイナリ形式から変換
+func (node *Node) DecodeWire(r *Reader) {
+	node.Host = r.String()
+	node.ApiPort = uint16(r.Uvarint())
+	node.P2PPort = uint16(r.Uvarint())
+	node.PubKey = r.Hash()
+}
+
+// サーバのアドレス("host:port")
+func (node *Node) Addr() string {
+	return node.me()
+}
+
 type act_fn func([]byte) error
 
+// 送信元を受け取るアクションハンドラ
+type peer_act_fn func(from *Node, msg []byte) error
+
 // 自身のアドレス情報を返す
 func (p2p *P2PNetwork) Self() string {
-	for _, n := range p2p.nodes {
-		if n.Self {
-			return n.me()
-		}
+	n := p2p.peers.self()
+	if n == nil {
+		return ""
 	}
-	return ""
+	return n.me()
 }
 
 // P2P通信のサーバ処理
 func (p2p *P2PNetwork) p2p_srv(host string, port uint16) {
 	fmt.Println("Start p2p server", host, port)
 
-	udpAddr := &net.UDPAddr{
-		IP:   net.ParseIP(host),
-		Port: int(port),
-	}
-	updLn, err := net.ListenUDP("udp", udpAddr)
+	updLn, err := p2p.transport.Listen(host + ":" + strconv.Itoa(int(port)))
 	if err != nil {
 		fmt.Println("listen error", err)
 		return
 	}
+	// Closeで受信を止められるように登録する(先に停止していたらすぐに閉じる)
+	p2p.srv_mu.Lock()
+	p2p.listener = updLn
+	p2p.srv_mu.Unlock()
+	if p2p.closed() {
+		updLn.Close()
+		return
+	}
 
+	buf := make([]byte, MAX_PACKET)
 	for {
-		buf := make([]byte, 1024)
 		if debug_mode {
-			fmt.Println("call updLn.ReadFromUDP")
+			fmt.Println("call updLn.ReadFrom")
 		}
-		n, addr, err := updLn.ReadFromUDP(buf)
+		n, addr, err := updLn.ReadFrom(buf)
 		if debug_mode {
 			fmt.Println("read", n, err)
 		}
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err == nil {
-			go func() {
-				if debug_mode {
-					fmt.Println("recieve function")
-					fmt.Println(addr)
-					fmt.Println(string(buf))
+			// 不正なメッセージを送り続けた送信元は無視する
+			if p2p.penalties.isBlocked(addr.String()) {
+				continue
+			}
+			// 他のネットワークのフレームは数えるだけで捨てる
+			if n >= 4 && !bytes.Equal(buf[0:4], p2p.magic[:]) {
+				p2p.foreign.add(buf[:n], addr.String(), func(key string) bool { return p2p.peers.searchKey(key) != nil })
+				continue
+			}
+			env, err := decodeFrame(buf[:n], p2p.magic)
+			if err != nil {
+				fmt.Println("Invalid frame:", addr, err)
+				points := PENALTY_MALFORMED
+				if errors.Is(err, ErrBadSignature) {
+					points = PENALTY_FORGED
 				}
-				cmd := int(buf[0])
+				p2p.penalties.add(addr.String(), points, err.Error())
+				continue
+			}
+			// 署名した鍵が登録済みのノードのものか確認
+			from, err := p2p.authenticate(env, addr.String())
+			if err != nil {
+				atomic.AddUint64(&p2p.rejected, 1)
 				if debug_mode {
-					fmt.Println(cmd)
+					fmt.Println("Rejected:", addr, env.cmd, err)
 				}
-				msg := buf[1:n]
-				if cmd < len(p2p.actions) {
-					fmt.Println("Do Action")
-					f := p2p.actions[cmd]
-					if f != nil {
-						err := f(msg)
-						if err != nil {
-							fmt.Println(err)
-						}
+				continue
+			}
+			// 受信レートの制限
+			if from.ID >= 0 {
+				ok, flood := p2p.scores.allow(from.PubKey, from.me())
+				if !ok {
+					atomic.AddUint64(&p2p.limited, 1)
+					if flood {
+						p2p.misbehave(from, MIS_FLOOD, "rate limit")
 					}
-				} else {
-					fmt.Println("No Action")
+					continue
 				}
-
-			}()
+			}
+			// 復号(受信バッファは使い回すので、平文のHELLOはコピーする)
+			body, err := p2p.decrypt(from, env)
+			if err != nil {
+				atomic.AddUint64(&p2p.undecrypted, 1)
+				if debug_mode {
+					fmt.Println("Undecryptable:", addr, env.cmd, err)
+				}
+				continue
+			}
+			msg := body
+			if env.cmd == CMD_HELLO {
+				msg = make([]byte, len(body))
+				copy(msg, body)
+			}
+			// 処理はワーカに任せる
+			p2p.dispatch.push(&inbound{cmd: env.cmd, msg: msg, addr: addr, from: from})
 		}
 	}
 }
 
 // P2Pネットワーク管理構造体
 type P2PNetwork struct {
-	nodes   []*Node
-	actions []act_fn
+	peers        *peerTable
+	actions      []act_fn
+	peer_actions []peer_act_fn
+	identity     *Identity
+	transport    Transport
+	clock        Clock
+	entropy      io.Reader
+	magic        [4]byte
+	foreign      foreignFrames
+	trusted      map[string]bool
+	member       member_fn
+	replay       replayCache
+	hello_replay replayCache // 未登録の送信元からのHELLO
+	rejected     uint64
+	undecrypted  uint64
+	limited      uint64
+	scores       scoreBoard
+	unverified   unverifiedSet
+	gossip       gossiper
+	dispatch     *dispatcher
+	wire_format  int
+	penalties    penaltyBox
+	inv_has      inv_has_fn
+	inv_get      inv_get_fn
+	inv_requests invRequests
+	req_handlers []req_fn
+	peer_reqs    []peer_req_fn
+	dht          dht
+	requests     requestTable
+	done         chan struct{} // Closeで閉じる(裏の処理を止める)
+	stop_once    sync.Once
+	srv_mu       sync.Mutex
+	listener     PacketConn
 }
 
 // P2Pネットワークにサーバを追加
@@ -158,25 +281,68 @@ func (p2p *P2PNetwork) Add(node *Node) (int, error) {
 
 	fmt.Println("add node:", node)
 
-	// 他のサーバにも追加リクエストを飛ばす
-	bytes, _ := json.Marshal(node)
-	p2p.Broadcast(CMD_ADDSRV, bytes, false)
+	// 登録済みや追加中のサーバは追加しない
+	// 確認と予約は同じロックの中で行い、同じサーバを同時に2回追加しない
+	if n, err := p2p.peers.reserve(node); err != nil {
+		if n != nil {
+			return n.ID, err
+		}
+		return -1, err
+	}
+	defer p2p.peers.release(node)
+
+	if node.PubKey != "" && !validKey(node.PubKey) {
+		return -1, errors.New("Invalid node key:" + node.PubKey)
+	}
+	if p2p.isBanned(node.PubKey, node.me()) {
+		return -1, ErrBanned
+	}
+	// 参加を制限している場合は鍵の指定が必要
+	if !p2p.isMember(node.PubKey) {
+		return -1, ErrNotMember
+	}
 
 	// 通信準備
-	node.connect()
+	node.connect(p2p)
 
-	// 追加されたサーバに他のサーバ情報を送る
-	for _, n := range p2p.nodes {
-		b, _ := json.Marshal(n)
-		s_msg := append([]byte{byte(CMD_ADDSRV)}, b...)
-		node.Send(s_msg)
-		time.Sleep(1 * time.Second / 2)
+	// サーバリストに追加
+	// 他のサーバ情報はハンドシェイクで鍵を確認してから送る
+	node.welcome = true
+	id, err := p2p.peers.add(node)
+	if err != nil {
+		node.disconnect()
+		return id, err
 	}
 
-	// サーバリストに追加
-	p2p.nodes = append(p2p.nodes, node)
+	// 追加できた場合だけ、他のサーバにも追加リクエストを飛ばす
+	p2p.Gossip(CMD_ADDSRV, p2p.Marshal(node), false)
+	go p2p.handshake(node)
 
-	return 0, nil
+	return id, nil
+}
+
+// P2Pネットワークからサーバを削除
+func (p2p *P2PNetwork) Remove(id int) error {
+
+	fmt.Println("P2PNetwork.Remove:", id)
+
+	node := p2p.peers.get(id)
+	if node == nil {
+		return errors.New("Node NOT Found:" + strconv.Itoa(id))
+	}
+	if node.Self {
+		return errors.New("Could not remove self node.")
+	}
+
+	p2p.peers.remove(id)
+	node.disconnect()
+
+	return nil
+}
+
+// ID指定でサーバ情報を取得
+func (p2p *P2PNetwork) Get(id int) *Node {
+	return p2p.peers.get(id)
 }
 
 // サーバ情報の検索
@@ -184,24 +350,40 @@ func (p2p *P2PNetwork) Search(host string, p2p_port uint16) *Node {
 
 	fmt.Println("Search:", host, p2p_port)
 
-	for _, node := range p2p.nodes {
-		if node.Host == host && node.P2PPort == p2p_port {
-			return node
-		}
-	}
+	return p2p.peers.search(host, p2p_port)
+}
 
-	return nil
+// "host:port" 形式のアドレスでサーバ情報を検索
+func (p2p *P2PNetwork) SearchAddr(addr string) *Node {
+	host, port, err := splitAddr(addr)
+	if err != nil {
+		return nil
+	}
+	return p2p.Search(host, port)
 }
 
 // P2Pネットワークに接続しているサーバ一覧を取得
 func (p2p *P2PNetwork) List() []*Node {
-	for _, node := range p2p.nodes {
+	nodes := p2p.peers.snapshot()
+	for _, node := range nodes {
 		fmt.Println(node)
 	}
-	return p2p.nodes
+	return nodes
+}
+
+// 自ノード以外の接続中のノードのアドレス
+func (p2p *P2PNetwork) Peers() []string {
+	peers := make([]string, 0)
+	for _, node := range p2p.peers.snapshot() {
+		if !node.Self {
+			peers = append(peers, node.me())
+		}
+	}
+	return peers
 }
 
 // P2Pネットワークに接続しているサーバにメッセージ送信
+// 各ノードの送信キューに積むだけなので、すぐに戻る
 func (p2p *P2PNetwork) Broadcast(cmd int, msg []byte, self bool) {
 
 	fmt.Println("Broadcast:", cmd, string(msg))
@@ -209,83 +391,142 @@ func (p2p *P2PNetwork) Broadcast(cmd int, msg []byte, self bool) {
 	   メッセージ送信時は、cmd + msg で送る。
 	   cmd は 1バイトとする。
 	*/
-	s_msg := append([]byte{byte(cmd)}, msg...)
-	if debug_mode {
-		fmt.Println(s_msg)
-	}
-
-	for _, node := range p2p.nodes {
+	for _, node := range p2p.peers.snapshot() {
 		if debug_mode {
 			fmt.Println(node)
 		}
 		if self == false && node.Self {
 			fmt.Println("not send")
 			continue
-		} else {
-			if err := node.Send(s_msg); err != nil {
-				fmt.Println("send error:", node, err)
-			}
 		}
-		time.Sleep(1 * time.Second / 2)
+		if err := node.post(cmd, msg); err != nil {
+			fmt.Println("send error:", node, err)
+		}
 	}
 }
 
+// 指定したサーバにメッセージ送信
+func (p2p *P2PNetwork) SendTo(node *Node, cmd int, msg []byte) error {
+	if debug_mode {
+		fmt.Println("SendTo:", node, cmd, string(msg))
+	}
+	return node.post(cmd, msg)
+}
+
 // メッセージをいずれかのサーバに送信
+// 送信キューが受け付けた最初のサーバに送る
 func (p2p *P2PNetwork) SendOne(cmd int, msg []byte) {
 	fmt.Println("SendOne:", cmd, string(msg))
 
-	s_msg := append([]byte{byte(cmd)}, msg...)
-	if debug_mode {
-		fmt.Println(s_msg)
-	}
-
-	for _, node := range p2p.nodes {
+	for _, node := range p2p.peers.snapshot() {
 		if debug_mode {
 			fmt.Println(node)
 		}
 		if node.Self {
 			fmt.Println("not send")
 			continue
-		} else {
-			err := node.Send(s_msg)
-			if err == nil {
-				break
-			}
 		}
-		time.Sleep(1 * time.Second / 2)
+		if err := node.post(cmd, msg); err == nil {
+			break
+		}
 	}
 }
 
+// 送信元を受け取るアクションハンドラの紐付け登録
+// 同じコマンドにSetActionのハンドラがあっても、こちらを優先する
+func (p2p *P2PNetwork) SetPeerAction(cmd int, handler peer_act_fn) {
+	if cmd <= 0 || cmd >= len(p2p.peer_actions) {
+		fmt.Println("Invalid command:", cmd)
+		return
+	}
+	p2p.peer_actions[cmd] = handler
+}
+
 // アクションとアクションハンドラの紐付け登録
 func (p2p *P2PNetwork) SetAction(cmd int, handler act_fn) *act_fn {
 
+	if cmd <= 0 || cmd >= len(p2p.actions) {
+		fmt.Println("Invalid command:", cmd)
+		return nil
+	}
 	fn := p2p.actions[cmd]
 	p2p.actions[cmd] = handler
 	return &fn
 }
 
+// 通信路の設定(Initの前に呼ぶ。設定しなければUDP)
+func (p2p *P2PNetwork) SetTransport(tr Transport) {
+	p2p.transport = tr
+}
+
 // P2P ネットワークの初期化処理
 func (p2p *P2PNetwork) Init(host string, api_port uint16, p2p_port uint16) (*P2PNetwork, error) {
 
 	fmt.Println("P2P_init")
-	p2p.nodes = make([]*Node, 0)
-	p2p.actions = make([]act_fn, 20)
+	if p2p.transport == nil {
+		p2p.transport = UDPTransport{}
+	}
+	if p2p.clock == nil {
+		p2p.clock = RealClock{}
+	}
+	p2p.entropy = p2p.Entropy()
+	p2p.done = make(chan struct{})
+	if p2p.magic == [4]byte{} {
+		p2p.magic = wire_magic
+	}
+	fmt.Println("Network magic:", p2p.Magic())
+	p2p.peers = newPeerTable()
+	p2p.hello_replay.limit = MAX_HELLO_REPLAY
+	p2p.hello_replay.per_source = MAX_HELLO_SOURCE
+	p2p.actions = make([]act_fn, MAX_CMD)
+	p2p.peer_actions = make([]peer_act_fn, MAX_CMD)
+	p2p.req_handlers = make([]req_fn, MAX_REQ)
+	p2p.peer_reqs = make([]peer_req_fn, MAX_REQ)
+	p2p.dispatch = newDispatcher(p2p)
+
+	// 識別鍵が無ければ一時的な鍵を使う(再起動すると別のノードとして扱われる)
+	if p2p.identity == nil {
+		id, err := NewIdentityFrom(p2p.entropy)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Println("Using ephemeral node key.")
+		p2p.identity = id
+	}
+	fmt.Println("Node key:", p2p.identity.Key())
+
+	// ハンドシェイク、ゴシップの転送、要求/応答は常に受け付ける
+	p2p.SetPeerAction(CMD_HELLO, p2p.Hello)
+	p2p.SetPeerAction(CMD_GOSSIP, p2p.HandleGossip)
+	p2p.SetPeerAction(CMD_REQUEST, p2p.HandleRequest)
+	p2p.SetPeerAction(CMD_RESPONSE, p2p.HandleResponse)
+	p2p.gossip.fanout = GOSSIP_FANOUT
+	p2p.gossip.ttl = GOSSIP_TTL
+	p2p.initDHT()
+	p2p.useClock()
 
 	// 自ノードの管理構造を初期化
 	node := new(Node)
 	node.Host = host
 	node.ApiPort = api_port
 	node.P2PPort = p2p_port
+	node.PubKey = p2p.identity.Key()
 	node.Self = true
 
-	// 自ノードの通信路開設
-	node.connect()
+	// 自ノードの通信路開設(自分宛ては鍵交換しない)
+	self_session, err := newSelfSession(p2p)
+	if err != nil {
+		return nil, err
+	}
+	node.session = self_session
+	node.connect(p2p)
 
 	// サーバリストに自ノードを追加
-	p2p.nodes = append(p2p.nodes, node)
+	p2p.peers.add(node)
 
 	// サーバ初期化
 	go p2p.p2p_srv(host, p2p_port)
+	go p2p.rekeyLoop()
 
 	if debug_mode {
 		fmt.Println(p2p)
@@ -294,6 +535,43 @@ func (p2p *P2PNetwork) Init(host string, api_port uint16, p2p_port uint16) (*P2P
 	return p2p, nil
 }
 
+// 停止処理
+// 受信と裏の処理(鍵の更新、受信メッセージのワーカ)を止めて、全ノードとの通信路を閉じる
+func (p2p *P2PNetwork) Close() error {
+	p2p.stop_once.Do(func() {
+		close(p2p.done)
+		p2p.srv_mu.Lock()
+		if p2p.listener != nil {
+			p2p.listener.Close()
+		}
+		p2p.srv_mu.Unlock()
+		for _, node := range p2p.peers.snapshot() {
+			node.disconnect()
+		}
+	})
+	return nil
+}
+
+// 停止したか
+func (p2p *P2PNetwork) closed() bool {
+	select {
+	case <-p2p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// 時計がd進むまで待つ。途中で停止したらfalseを返す
+func (p2p *P2PNetwork) wait(d time.Duration) bool {
+	select {
+	case <-p2p.clock.After(d):
+		return true
+	case <-p2p.done:
+		return false
+	}
+}
+
 // サーバ追加アクション
 func (p2p *P2PNetwork) AddSrv(msg []byte) error {
 	fmt.Println("add server action")
@@ -305,9 +583,9 @@ func (p2p *P2PNetwork) AddSrv(msg []byte) error {
 		fmt.Println(string(msg))
 	}
 
-	err := json.Unmarshal(msg, node)
+	err := Unmarshal(msg, node)
 	if err != nil {
-		fmt.Println("json.Unmarshal failed")
+		fmt.Println("Unmarshal failed")
 		return err
 	}
 	fmt.Println("node:", node)
@@ -317,8 +595,25 @@ func (p2p *P2PNetwork) AddSrv(msg []byte) error {
 	   追加するとき、Selfはfalseにすること
 	*/
 	node.Self = false
-	node.connect()
-	p2p.nodes = append(p2p.nodes, node)
+	if p2p.peers.search(node.Host, node.P2PPort) != nil {
+		fmt.Println("already registered:", node.me())
+		return nil
+	}
+	if p2p.peers.searchKey(node.PubKey) != nil {
+		fmt.Println("key already registered:", node.PubKey)
+		return nil
+	}
+	if p2p.isBanned(node.PubKey, node.me()) {
+		fmt.Println("banned node:", node.me())
+		return nil
+	}
+	if !p2p.isMember(node.PubKey) {
+		fmt.Println("not a member:", node.me())
+		return nil
+	}
+
+	// 通知されたアドレスは確認が取れるまで登録しない
+	p2p.verify(node, nil)
 
 	return nil
 }
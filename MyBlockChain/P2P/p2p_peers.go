@@ -0,0 +1,205 @@
+/*
+  My Block Chain: P2P peer table module
+*/
+package P2P
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+)
+
+// ピアテーブル
+// HTTPハンドラ、UDPハンドラ、送信処理から同時に参照されるので必ずロックを取ってアクセスする
+type peerTable struct {
+	mu      sync.RWMutex
+	nodes   []*Node
+	next_id int
+	adding  map[string]bool // 追加処理中のアドレス
+}
+
+// ピアテーブルの初期化
+func newPeerTable() *peerTable {
+	pt := new(peerTable)
+	pt.nodes = make([]*Node, 0)
+	pt.next_id = 0
+	pt.adding = make(map[string]bool)
+	return pt
+}
+
+// 追加するアドレスを予約する
+// 登録済みなら登録済みのノード、他で追加処理中ならエラーを返す
+// 予約できたら、追加が終わった後にreleaseを呼ぶ
+func (pt *peerTable) reserve(node *Node) (*Node, error) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+
+	for _, n := range pt.nodes {
+		if n.Host == node.Host && n.P2PPort == node.P2PPort {
+			return n, errors.New("Node already exists:" + node.me())
+		}
+	}
+	if pt.adding[node.me()] {
+		return nil, errors.New("Node is being added:" + node.me())
+	}
+	pt.adding[node.me()] = true
+	return nil, nil
+}
+
+// アドレスの予約を解除する
+func (pt *peerTable) release(node *Node) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	delete(pt.adding, node.me())
+}
+
+// ノードを追加してIDを払い出す
+func (pt *peerTable) add(node *Node) (int, error) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+
+	for _, n := range pt.nodes {
+		if n.Host == node.Host && n.P2PPort == node.P2PPort {
+			return n.ID, errors.New("Node already exists:" + node.me())
+		}
+	}
+
+	node.ID = pt.next_id
+	pt.next_id++
+	if node.known == nil {
+		node.known = newKnownInv()
+	}
+	pt.nodes = append(pt.nodes, node)
+
+	return node.ID, nil
+}
+
+// ID指定でノードを削除
+func (pt *peerTable) remove(id int) *Node {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+
+	for i, n := range pt.nodes {
+		if n.ID == id {
+			// 他のスナップショットに影響しないよう新しいスライスを作る
+			nodes := make([]*Node, 0, len(pt.nodes)-1)
+			nodes = append(nodes, pt.nodes[:i]...)
+			nodes = append(nodes, pt.nodes[i+1:]...)
+			pt.nodes = nodes
+			return n
+		}
+	}
+	return nil
+}
+
+// ID指定でノードを取得
+func (pt *peerTable) get(id int) *Node {
+	pt.mu.RLock()
+	defer pt.mu.RUnlock()
+
+	for _, n := range pt.nodes {
+		if n.ID == id {
+			return n
+		}
+	}
+	return nil
+}
+
+// アドレス指定でノードを取得
+func (pt *peerTable) search(host string, p2p_port uint16) *Node {
+	pt.mu.RLock()
+	defer pt.mu.RUnlock()
+
+	for _, n := range pt.nodes {
+		if n.Host == host && n.P2PPort == p2p_port {
+			return n
+		}
+	}
+	return nil
+}
+
+// 公開鍵指定でノードを取得
+func (pt *peerTable) searchKey(key string) *Node {
+	pt.mu.RLock()
+	defer pt.mu.RUnlock()
+
+	if key == "" {
+		return nil
+	}
+	for _, n := range pt.nodes {
+		if n.PubKey == key {
+			return n
+		}
+	}
+	return nil
+}
+
+// ノードの鍵を固定する
+// 新たに固定した場合はtrue、既に別の鍵で固定済みならエラーを返す
+func (pt *peerTable) pin(node *Node, key string) (bool, error) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+
+	if node.PubKey == key {
+		return false, nil
+	}
+	if node.PubKey != "" {
+		return false, ErrKeyMismatch
+	}
+	node.PubKey = key
+	return true, nil
+}
+
+// サーバ追加APIで登録したノードか確認(確認は1度だけ)
+func (pt *peerTable) welcomed(node *Node) bool {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+
+	v := node.welcome
+	node.welcome = false
+	return v
+}
+
+// 自ノードを取得
+func (pt *peerTable) self() *Node {
+	pt.mu.RLock()
+	defer pt.mu.RUnlock()
+
+	for _, n := range pt.nodes {
+		if n.Self {
+			return n
+		}
+	}
+	return nil
+}
+
+// 反復処理用のスナップショットを返す
+func (pt *peerTable) snapshot() []*Node {
+	pt.mu.RLock()
+	defer pt.mu.RUnlock()
+
+	nodes := make([]*Node, len(pt.nodes))
+	copy(nodes, pt.nodes)
+	return nodes
+}
+
+// 登録ノード数
+func (pt *peerTable) len() int {
+	pt.mu.RLock()
+	defer pt.mu.RUnlock()
+	return len(pt.nodes)
+}
+
+// "host:port" 形式のアドレスを分解
+func splitAddr(addr string) (string, uint16, error) {
+	for i := len(addr) - 1; i >= 0; i-- {
+		if addr[i] == ':' {
+			port, err := strconv.ParseUint(addr[i+1:], 10, 16)
+			if err != nil || i == 0 || port == 0 {
+				return "", 0, errors.New("Invalid address:" + addr)
+			}
+			return addr[:i], uint16(port), nil
+		}
+	}
+	return "", 0, errors.New("Invalid address:" + addr)
+}
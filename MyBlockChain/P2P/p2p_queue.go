@@ -0,0 +1,186 @@
+/*
+  My Block Chain: P2P send queue module
+*/
+package P2P
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	PRIO_HIGH = 0 // ブロック関連
+	PRIO_LOW  = 1 // ノード探索関連
+
+	SEND_QUEUE_HIGH = 64
+	SEND_QUEUE_LOW  = 32
+)
+
+// 送信キューの統計情報
+type QueueStats struct {
+	ID          int    `json:"id"`
+	Addr        string `json:"addr"`
+	HighDepth   int    `json:"high_depth"`
+	LowDepth    int    `json:"low_depth"`
+	Sent        uint64 `json:"sent"`
+	Errors      uint64 `json:"errors"`
+	DroppedHigh uint64 `json:"dropped_high"`
+	DroppedLow  uint64 `json:"dropped_low"`
+}
+
+// ノード毎の送信キュー
+// 送信はキュー毎の専用goroutineが行うので、呼び出し元は待たされない
+type sendQueue struct {
+	node         *Node
+	high         chan []byte
+	low          chan []byte
+	quit         chan struct{}
+	stop_once    sync.Once
+	sent         uint64
+	errors       uint64
+	dropped_high uint64
+	dropped_low  uint64
+}
+
+// コマンドの送信優先度
+func cmdPriority(cmd int) int {
+	switch cmd {
+	case CMD_ADDSRV, CMD_DELSRV:
+		return PRIO_LOW
+	}
+	return PRIO_HIGH
+}
+
+// 送信キューの作成と送信goroutineの起動
+func newSendQueue(node *Node) *sendQueue {
+	q := new(sendQueue)
+	q.node = node
+	q.high = make(chan []byte, SEND_QUEUE_HIGH)
+	q.low = make(chan []byte, SEND_QUEUE_LOW)
+	q.quit = make(chan struct{})
+
+	go q.writer()
+
+	return q
+}
+
+// 送信goroutine
+func (q *sendQueue) writer() {
+	for {
+		// 優先度の高いものから送る
+		select {
+		case msg := <-q.high:
+			q.write(msg)
+			continue
+		case <-q.quit:
+			return
+		default:
+		}
+
+		select {
+		case msg := <-q.high:
+			q.write(msg)
+		case msg := <-q.low:
+			q.write(msg)
+		case <-q.quit:
+			return
+		}
+	}
+}
+
+// 1メッセージ送信
+func (q *sendQueue) write(msg []byte) {
+	if err := q.node.Send(msg); err != nil {
+		atomic.AddUint64(&q.errors, 1)
+		return
+	}
+	atomic.AddUint64(&q.sent, 1)
+}
+
+// キューに積む(満杯なら破棄する)
+func (q *sendQueue) push(msg []byte, prio int) error {
+	select {
+	case <-q.quit:
+		return errors.New("Queue closed:" + q.node.me())
+	default:
+	}
+
+	ch := q.low
+	dropped := &q.dropped_low
+	if prio == PRIO_HIGH {
+		ch = q.high
+		dropped = &q.dropped_high
+	}
+
+	select {
+	case ch <- msg:
+		return nil
+	default:
+		atomic.AddUint64(dropped, 1)
+		fmt.Println("Send queue full, drop:", q.node.me())
+		return errors.New("Send queue full:" + q.node.me())
+	}
+}
+
+// 送信goroutineを止める
+func (q *sendQueue) stop() {
+	q.stop_once.Do(func() {
+		close(q.quit)
+	})
+}
+
+// 統計情報
+func (q *sendQueue) stats() QueueStats {
+	return QueueStats{
+		ID:          q.node.ID,
+		Addr:        q.node.me(),
+		HighDepth:   len(q.high),
+		LowDepth:    len(q.low),
+		Sent:        atomic.LoadUint64(&q.sent),
+		Errors:      atomic.LoadUint64(&q.errors),
+		DroppedHigh: atomic.LoadUint64(&q.dropped_high),
+		DroppedLow:  atomic.LoadUint64(&q.dropped_low),
+	}
+}
+
+// ノードの送信キューにメッセージを積む
+func (node *Node) post(cmd int, msg []byte) error {
+	if node.queue == nil {
+		return errors.New("Not connected:" + node.me())
+	}
+	if node.sign == nil {
+		return errors.New("No node key:" + node.me())
+	}
+	if len(msg) > MAX_PAYLOAD {
+		return ErrTooLarge
+	}
+	// HELLO以外はセッション鍵で暗号化する
+	var sess *session
+	if cmd != CMD_HELLO {
+		if node.session == nil || !node.session.ready() {
+			return ErrNoSession
+		}
+		sess = node.session
+	}
+	frame, err := encodeFrame(node.sign, sess, node.magic, cmd, msg, clockNow(node.clock), node.entropy)
+	if err != nil {
+		return err
+	}
+	return node.queue.push(frame, cmdPriority(cmd))
+}
+
+// 送信キューを開始
+func (node *Node) startQueue() {
+	if node.queue == nil {
+		node.queue = newSendQueue(node)
+	}
+}
+
+// 送信キューを停止
+func (node *Node) stopQueue() {
+	if node.queue != nil {
+		node.queue.stop()
+	}
+}
@@ -0,0 +1,313 @@
+/*
+  My Block Chain: P2P request/response module
+*/
+package P2P
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// 要求の種類
+	REQ_BLOCK   = 1 // 高さ指定でブロック
+	REQ_HEADERS = 2 // ヘッダの範囲
+	REQ_BLOCKS  = 3 // ブロックの範囲
+	REQ_TIP     = 7 // チェーンの先端の交換
+	REQ_BLOB    = 8 // ハッシュ指定でチェーンの外に置いたデータ
+	MAX_REQ     = 16
+
+	// 応答の状態
+	RES_OK        = 0
+	RES_NOT_FOUND = 1
+	RES_ERROR     = 2
+
+	REQUEST_TIMEOUT = 3 * time.Second
+	REQUEST_RETRY   = 2
+)
+
+var (
+	ErrNotFound = errors.New("Not found.")
+	ErrTimeout  = errors.New("Request timeout.")
+	ErrNoPeer   = errors.New("No peer to request.")
+)
+
+// 要求メッセージ
+type RequestMsg struct {
+	ID     uint64 `json:"id"`
+	From   string `json:"from"`
+	Method int    `json:"method"`
+	Body   []byte `json:"body"`
+}
+
+// 応答メッセージ
+type ResponseMsg struct {
+	ID     uint64 `json:"id"`
+	From   string `json:"from"`
+	Status int    `json:"status"`
+	Body   []byte `json:"body"`
+	Error  string `json:"error,omitempty"`
+}
+
+// バイナリ形式に変換
+func (req *RequestMsg) EncodeWire(w *Writer) {
+	w.Uvarint(req.ID)
+	w.String(req.From)
+	w.Varint(int64(req.Method))
+	w.Bytes(req.Body)
+}
+
+// バイナリ形式から変換
+func (req *RequestMsg) DecodeWire(r *Reader) {
+	req.ID = r.Uvarint()
+	req.From = r.String()
+	req.Method = int(r.Varint())
+	req.Body = r.Bytes()
+}
+
+// バイナリ形式に変換
+func (res *ResponseMsg) EncodeWire(w *Writer) {
+	w.Uvarint(res.ID)
+	w.String(res.From)
+	w.Varint(int64(res.Status))
+	w.Bytes(res.Body)
+	w.String(res.Error)
+}
+
+// バイナリ形式から変換
+func (res *ResponseMsg) DecodeWire(r *Reader) {
+	res.ID = r.Uvarint()
+	res.From = r.String()
+	res.Status = int(r.Varint())
+	res.Body = r.Bytes()
+	res.Error = r.String()
+}
+
+// 要求の送り方
+type RequestOptions struct {
+	Timeout time.Duration // 1回あたりの待ち時間
+	Retries int           // 別のノードに出し直す回数
+	Peers   []string      // 要求先("host:port")。空なら接続中の全ノードから選ぶ
+}
+
+// 要求の結果
+type Response struct {
+	From string
+	Body []byte
+}
+
+// 要求を処理する関数
+// 持っていない場合はErrNotFoundを返す
+type req_fn func([]byte) ([]byte, error)
+
+// 送信元を受け取る要求ハンドラ
+type peer_req_fn func(from *Node, body []byte) ([]byte, error)
+
+// 応答待ちの要求
+type requestTable struct {
+	mu      sync.Mutex
+	next_id uint64
+	waiting map[uint64]*pendingRequest
+	entropy io.Reader
+}
+
+// 応答待ち
+type pendingRequest struct {
+	peer string
+	ch   chan *ResponseMsg
+}
+
+// 要求IDを払い出して応答待ちに登録
+func (rt *requestTable) open(peer string) (uint64, chan *ResponseMsg) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	if rt.waiting == nil {
+		rt.waiting = make(map[uint64]*pendingRequest)
+		rt.next_id, _ = randUint64(rt.entropy)
+		rt.next_id >>= 1
+	}
+	rt.next_id++
+	ch := make(chan *ResponseMsg, 1)
+	rt.waiting[rt.next_id] = &pendingRequest{peer: peer, ch: ch}
+	return rt.next_id, ch
+}
+
+// 応答待ちから外す
+func (rt *requestTable) close(id uint64) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	delete(rt.waiting, id)
+}
+
+// 応答を待っている要求に渡す
+func (rt *requestTable) deliver(res *ResponseMsg) bool {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	p, ok := rt.waiting[res.ID]
+	if !ok || p.peer != res.From {
+		// 要求していない相手からの応答は捨てる
+		return false
+	}
+	delete(rt.waiting, res.ID)
+	p.ch <- res
+	return true
+}
+
+// 要求ハンドラの登録
+func (p2p *P2PNetwork) SetRequestHandler(method int, handler req_fn) {
+	if method <= 0 || method >= MAX_REQ {
+		fmt.Println("Invalid request method:", method)
+		return
+	}
+	p2p.req_handlers[method] = handler
+}
+
+// 送信元を受け取る要求ハンドラの登録
+// 同じ種類にSetRequestHandlerのハンドラがあっても、こちらを優先する
+func (p2p *P2PNetwork) SetPeerRequestHandler(method int, handler peer_req_fn) {
+	if method <= 0 || method >= MAX_REQ {
+		fmt.Println("Invalid request method:", method)
+		return
+	}
+	p2p.peer_reqs[method] = handler
+}
+
+// 要求を送り、応答を待つ
+// タイムアウトや"not found"の場合は別のノードに出し直す
+func (p2p *P2PNetwork) Request(method int, body []byte, opt *RequestOptions) (*Response, error) {
+	if opt == nil {
+		opt = &RequestOptions{}
+	}
+	timeout := opt.Timeout
+	if timeout <= 0 {
+		timeout = REQUEST_TIMEOUT
+	}
+
+	// 要求先の候補
+	peers := opt.Peers
+	if len(peers) == 0 {
+		peers = make([]string, 0)
+		for _, node := range p2p.peers.snapshot() {
+			if !node.Self {
+				peers = append(peers, node.me())
+			}
+		}
+		shuffle(p2p.entropy, len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+	}
+	if len(peers) == 0 {
+		return nil, ErrNoPeer
+	}
+
+	self := p2p.Self()
+	last_err := ErrNoPeer
+	not_found := 0
+	for attempt := 0; attempt <= opt.Retries; attempt++ {
+		peer := peers[attempt%len(peers)]
+		node := p2p.SearchAddr(peer)
+		if node == nil {
+			continue
+		}
+
+		id, ch := p2p.requests.open(peer)
+		b := p2p.Marshal(&RequestMsg{ID: id, From: self, Method: method, Body: body})
+		if err := node.post(CMD_REQUEST, b); err != nil {
+			p2p.requests.close(id)
+			last_err = err
+			continue
+		}
+
+		select {
+		case res := <-ch:
+			switch res.Status {
+			case RES_OK:
+				return &Response{From: res.From, Body: res.Body}, nil
+			case RES_NOT_FOUND:
+				not_found++
+				last_err = ErrNotFound
+			default:
+				last_err = errors.New(res.Error)
+			}
+		case <-p2p.clock.After(timeout):
+			p2p.requests.close(id)
+			fmt.Println("Request timeout:", peer, method, id)
+			last_err = ErrTimeout
+		}
+	}
+
+	if not_found > 0 {
+		return nil, ErrNotFound
+	}
+	return nil, last_err
+}
+
+// 要求受信アクション
+func (p2p *P2PNetwork) HandleRequest(node *Node, msg []byte) error {
+	req := new(RequestMsg)
+	if err := Unmarshal(msg, req); err != nil {
+		return err
+	}
+	if req.From != node.me() {
+		// 署名した鍵のノードと名乗ったアドレスが違う
+		return Malformed("from")
+	}
+
+	res := &ResponseMsg{ID: req.ID, From: p2p.Self(), Status: RES_OK}
+	handler := p2p.req_handlers[req.Method]
+	if ph := p2p.peer_reqs[req.Method]; ph != nil {
+		handler = func(body []byte) ([]byte, error) { return ph(node, body) }
+	}
+	var herr error
+	if handler == nil {
+		res.Status = RES_ERROR
+		res.Error = "Unknown request method:" + strconv.Itoa(req.Method)
+	} else {
+		body, err := handler(req.Body)
+		if err == ErrNotFound {
+			res.Status = RES_NOT_FOUND
+		} else if err != nil {
+			res.Status = RES_ERROR
+			res.Error = err.Error()
+			if IsDecodeError(err) {
+				// 不正な要求には応答した上で送信元を減点する
+				herr = err
+			}
+		} else {
+			res.Body = body
+		}
+	}
+
+	if err := node.post(CMD_RESPONSE, p2p.Marshal(res)); err != nil {
+		return err
+	}
+	return herr
+}
+
+// 応答受信アクション
+func (p2p *P2PNetwork) HandleResponse(node *Node, msg []byte) error {
+	res := new(ResponseMsg)
+	if err := Unmarshal(msg, res); err != nil {
+		return err
+	}
+	if res.From != node.me() {
+		return Malformed("from")
+	}
+	if !p2p.requests.deliver(res) {
+		if debug_mode {
+			fmt.Println("Unexpected response:", res.From, res.ID)
+		}
+	}
+	return nil
+}
+
+// 要求の統計(応答待ちの数)
+func (p2p *P2PNetwork) pendingRequests() int {
+	p2p.requests.mu.Lock()
+	defer p2p.requests.mu.Unlock()
+	return len(p2p.requests.waiting)
+}
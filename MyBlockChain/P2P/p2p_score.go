@@ -0,0 +1,395 @@
+/*
+  My Block Chain: P2P peer scoring module
+*/
+package P2P
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// 不正行為の種類
+	MIS_MALFORMED     = 1 // 解析できないメッセージ
+	MIS_INVALID_BLOCK = 2 // 検証に失敗したブロック
+	MIS_BAD_HEADERS   = 3 // つながらないヘッダ列
+	MIS_FLOOD         = 4 // 送信レートの超過
+	MIS_PANIC         = 5 // 処理中にpanicを起こしたメッセージ
+	MIS_FORGED        = 6 // 登録と異なる鍵やアドレスを名乗った
+
+	BAN_SCORE    = 100
+	BAN_DURATION = 24 * time.Hour
+	SCORE_DECAY  = 10 * time.Minute // この時間ごとに点数を半分にする
+
+	// 受信レートの上限(トークンバケット)
+	RATE_LIMIT    = 200 // 1秒あたりのメッセージ数
+	RATE_BURST    = 400
+	FLOOD_PENALTY = time.Second // 超過の減点は1秒に1回まで
+)
+
+var ErrBanned = errors.New("Node is banned.")
+
+// 不正行為ごとの減点
+var misbehaviour_points = map[int]int{
+	MIS_MALFORMED:     10,
+	MIS_INVALID_BLOCK: 50,
+	MIS_BAD_HEADERS:   25,
+	MIS_FLOOD:         5,
+	MIS_PANIC:         50,
+	MIS_FORGED:        100,
+}
+
+// 不正行為の名前(統計情報用)
+var misbehaviour_names = map[int]string{
+	MIS_MALFORMED:     "malformed",
+	MIS_INVALID_BLOCK: "invalid_block",
+	MIS_BAD_HEADERS:   "bad_headers",
+	MIS_FLOOD:         "flood",
+	MIS_PANIC:         "panic",
+	MIS_FORGED:        "forged",
+}
+
+// 不正行為のエラー
+// アクションハンドラがこれを返すと送信元を減点する
+type Misbehaviour struct {
+	Kind   int
+	Reason string
+}
+
+// エラーメッセージ
+func (m *Misbehaviour) Error() string {
+	return "Misbehaviour (" + misbehaviour_names[m.Kind] + "): " + m.Reason
+}
+
+// 不正行為のエラーを作る
+func Misbehave(kind int, reason string) error {
+	return &Misbehaviour{Kind: kind, Reason: reason}
+}
+
+// 接続禁止の記録
+type Ban struct {
+	Key    string    `json:"key"`
+	Addr   string    `json:"addr"`
+	Reason string    `json:"reason"`
+	Since  time.Time `json:"since"`
+	Until  time.Time `json:"until"`
+}
+
+// ノードの点数
+type peerScore struct {
+	addr     string
+	score    int
+	updated  time.Time
+	counts   map[int]uint64
+	tokens   float64
+	refilled time.Time
+	flooded  time.Time
+}
+
+// 点数の統計情報
+type ScoreStats struct {
+	Key    string            `json:"key"`
+	Addr   string            `json:"addr"`
+	Score  int               `json:"score"`
+	Counts map[string]uint64 `json:"counts"`
+}
+
+// ノードの点数と接続禁止リスト(鍵で管理する)
+type scoreBoard struct {
+	mu     sync.Mutex
+	scores map[string]*peerScore
+	bans   []*Ban
+	path   string
+	clock  Clock
+}
+
+// 点数の取得(無ければ作る。ロックは呼び出し元で取る)
+func (sb *scoreBoard) get(key string, addr string) *peerScore {
+	if sb.scores == nil {
+		sb.scores = make(map[string]*peerScore)
+	}
+	ps, ok := sb.scores[key]
+	if !ok {
+		now := clockNow(sb.clock)
+		ps = &peerScore{updated: now, refilled: now, tokens: RATE_BURST, counts: make(map[int]uint64)}
+		sb.scores[key] = ps
+	}
+	if addr != "" {
+		ps.addr = addr
+	}
+	return ps
+}
+
+// 時間経過で点数を戻す
+func (ps *peerScore) decay(now time.Time) {
+	for now.Sub(ps.updated) >= SCORE_DECAY && ps.score > 0 {
+		ps.score /= 2
+		ps.updated = ps.updated.Add(SCORE_DECAY)
+	}
+	if ps.score == 0 {
+		ps.updated = now
+	}
+}
+
+// 減点する。禁止の点数を超えたらtrueを返す
+func (sb *scoreBoard) add(key string, addr string, kind int) bool {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+
+	ps := sb.get(key, addr)
+	ps.decay(clockNow(sb.clock))
+	ps.score += misbehaviour_points[kind]
+	ps.counts[kind]++
+	return ps.score >= BAN_SCORE
+}
+
+// 受信レートの確認
+// 超過した場合はfalseと、減点するかどうかを返す
+func (sb *scoreBoard) allow(key string, addr string) (bool, bool) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+
+	now := clockNow(sb.clock)
+	ps := sb.get(key, addr)
+	ps.tokens += now.Sub(ps.refilled).Seconds() * RATE_LIMIT
+	if ps.tokens > RATE_BURST {
+		ps.tokens = RATE_BURST
+	}
+	ps.refilled = now
+	if ps.tokens >= 1 {
+		ps.tokens--
+		return true, false
+	}
+	if now.Sub(ps.flooded) < FLOOD_PENALTY {
+		return false, false
+	}
+	ps.flooded = now
+	return false, true
+}
+
+// 接続禁止か確認(期限切れは消す)
+func (sb *scoreBoard) banned(key string, addr string) *Ban {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+
+	sb.expire(clockNow(sb.clock))
+	for _, b := range sb.bans {
+		if (key != "" && b.Key == key) || (addr != "" && b.Addr == addr) {
+			return b
+		}
+	}
+	return nil
+}
+
+// 期限切れの禁止を消す(ロックは呼び出し元で取る)
+func (sb *scoreBoard) expire(now time.Time) {
+	bans := make([]*Ban, 0, len(sb.bans))
+	for _, b := range sb.bans {
+		if now.Before(b.Until) {
+			bans = append(bans, b)
+		}
+	}
+	if len(bans) != len(sb.bans) {
+		sb.bans = bans
+		sb.save()
+	}
+}
+
+// 接続禁止に追加
+func (sb *scoreBoard) ban(b *Ban) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+
+	for i, old := range sb.bans {
+		if (b.Key != "" && old.Key == b.Key) || (b.Addr != "" && old.Addr == b.Addr) {
+			sb.bans[i] = b
+			sb.save()
+			return
+		}
+	}
+	sb.bans = append(sb.bans, b)
+	if ps, ok := sb.scores[b.Key]; ok {
+		ps.score = 0
+	}
+	sb.save()
+}
+
+// 接続禁止を解除(鍵かアドレスで指定)
+func (sb *scoreBoard) unban(id string) bool {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+
+	for i, b := range sb.bans {
+		if b.Key == id || b.Addr == id {
+			sb.bans = append(sb.bans[:i:i], sb.bans[i+1:]...)
+			sb.save()
+			return true
+		}
+	}
+	return false
+}
+
+// 接続禁止リストの保存(ロックは呼び出し元で取る)
+func (sb *scoreBoard) save() {
+	if sb.path == "" {
+		return
+	}
+	b, err := json.MarshalIndent(sb.bans, "", "  ")
+	if err != nil {
+		fmt.Println("ban list error:", err)
+		return
+	}
+	tmp := sb.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		fmt.Println("ban list error:", err)
+		return
+	}
+	if err := os.Rename(tmp, sb.path); err != nil {
+		fmt.Println("ban list error:", err)
+	}
+}
+
+// 接続禁止リストの読み込み
+func (sb *scoreBoard) load(path string) error {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+
+	sb.path = path
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	bans := make([]*Ban, 0)
+	if err := json.Unmarshal(b, &bans); err != nil {
+		return errors.New("Invalid ban list:" + path)
+	}
+	sb.bans = bans
+	sb.expire(clockNow(sb.clock))
+	return nil
+}
+
+// 統計情報
+func (sb *scoreBoard) stats() []ScoreStats {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+
+	now := clockNow(sb.clock)
+	stats := make([]ScoreStats, 0, len(sb.scores))
+	for key, ps := range sb.scores {
+		ps.decay(now)
+		if ps.score == 0 && len(ps.counts) == 0 {
+			continue
+		}
+		counts := make(map[string]uint64)
+		for kind, n := range ps.counts {
+			counts[misbehaviour_names[kind]] = n
+		}
+		stats = append(stats, ScoreStats{Key: key, Addr: ps.addr, Score: ps.score, Counts: counts})
+	}
+	return stats
+}
+
+// 接続禁止リストのファイルを設定して読み込む(Initの前に呼ぶ)
+func (p2p *P2PNetwork) SetBanFile(path string) error {
+	return p2p.scores.load(path)
+}
+
+// ノードの不正行為を記録する
+// 点数が上限を超えたら切断して接続禁止にする
+func (p2p *P2PNetwork) misbehave(node *Node, kind int, reason string) {
+	if node == nil || node.Self || node.PubKey == "" {
+		return
+	}
+	fmt.Println("Misbehaviour:", node.me(), misbehaviour_names[kind], reason)
+	if p2p.scores.add(node.PubKey, node.me(), kind) {
+		p2p.ban(node.PubKey, node.me(), reason, BAN_DURATION)
+	}
+}
+
+// アドレス指定で不正行為を記録する(同期処理などから使う)
+func (p2p *P2PNetwork) Penalize(addr string, kind int, reason string) {
+	p2p.misbehave(p2p.SearchAddr(addr), kind, reason)
+}
+
+// 接続禁止にして切断する
+func (p2p *P2PNetwork) ban(key string, addr string, reason string, d time.Duration) {
+	now := clockNow(p2p.clock)
+	fmt.Println("Ban node:", addr, key, reason)
+	p2p.scores.ban(&Ban{Key: key, Addr: addr, Reason: reason, Since: now, Until: now.Add(d)})
+
+	node := p2p.peers.searchKey(key)
+	if node == nil && addr != "" {
+		node = p2p.SearchAddr(addr)
+	}
+	if node != nil && !node.Self {
+		p2p.Remove(node.ID)
+	}
+}
+
+// 鍵かアドレスを指定して接続禁止にする(APIから使う)
+func (p2p *P2PNetwork) Ban(id string, reason string, d time.Duration) error {
+	if d <= 0 {
+		d = BAN_DURATION
+	}
+	if validKey(id) {
+		id = strings.ToLower(id)
+		if id == p2p.Key() {
+			return errors.New("Could not ban self node.")
+		}
+		addr := ""
+		if node := p2p.peers.searchKey(id); node != nil {
+			if node.Self {
+				return errors.New("Could not ban self node.")
+			}
+			addr = node.me()
+		}
+		p2p.ban(id, addr, reason, d)
+		return nil
+	}
+	if _, _, err := splitAddr(id); err != nil {
+		return err
+	}
+	key := ""
+	if node := p2p.SearchAddr(id); node != nil {
+		if node.Self {
+			return errors.New("Could not ban self node.")
+		}
+		key = node.PubKey
+	}
+	p2p.ban(key, id, reason, d)
+	return nil
+}
+
+// 接続禁止を解除
+func (p2p *P2PNetwork) Unban(id string) error {
+	if !p2p.scores.unban(id) {
+		return errors.New("Ban NOT Found:" + id)
+	}
+	return nil
+}
+
+// 接続禁止リスト
+func (p2p *P2PNetwork) Bans() []Ban {
+	p2p.scores.mu.Lock()
+	defer p2p.scores.mu.Unlock()
+
+	p2p.scores.expire(clockNow(p2p.clock))
+	bans := make([]Ban, 0, len(p2p.scores.bans))
+	for _, b := range p2p.scores.bans {
+		bans = append(bans, *b)
+	}
+	return bans
+}
+
+// 接続禁止か確認
+func (p2p *P2PNetwork) isBanned(key string, addr string) bool {
+	return p2p.scores.banned(key, addr) != nil
+}
@@ -0,0 +1,323 @@
+/*
+  My Block Chain: P2P encrypted session module
+*/
+package P2P
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+/*
+暗号化セッション
+	ハンドシェイク(HELLO)で使い捨てのX25519鍵を交換し、共有鍵からHKDFで
+	方向ごとのAES-256-GCM鍵を作る。HELLOは識別鍵で署名されているので中間者は
+	鍵を差し替えられない。HELLO以外のフレームは全てセッション鍵で暗号化する。
+
+	鍵の更新は新しいHELLOを送るだけで行う。受信側は直近の数世代の鍵を持つので、
+	更新中に届いた古い鍵のフレームも復号できる。
+*/
+const (
+	FLAG_ENCRYPTED = 0x04 // ペイロードがセッション鍵で暗号化されている
+
+	SESSION_KEY_ID   = 4 // 暗号文の先頭に付ける鍵の識別子の長さ
+	MAX_SESSION_KEYS = 3 // 受信用に保持する鍵の世代数
+	MAX_PENDING_EPH  = 4 // 返事待ちの使い捨て鍵の数
+
+	// 鍵の更新
+	REKEY_INTERVAL = 10 * time.Minute
+	REKEY_MESSAGES = 1 << 20
+	REKEY_CHECK    = time.Minute
+)
+
+var (
+	ErrNoSession = errors.New("No session.")
+	ErrPlaintext = errors.New("Unencrypted message.")
+	ErrDecrypt   = errors.New("Could not decrypt message.")
+)
+
+// セッション鍵(1世代分)
+type sessionKey struct {
+	id   uint32
+	send cipher.AEAD
+	recv cipher.AEAD
+}
+
+// ノードとの暗号化セッション
+type session struct {
+	mu      sync.Mutex
+	pending [][]byte           // 返事待ちの使い捨て鍵(公開鍵)
+	privs   []*ecdh.PrivateKey // pendingに対応する秘密鍵
+	keys    []*sessionKey      // 新しい順。先頭を送信に使う
+	since   time.Time          // 送信鍵を作った時刻
+	sent    uint64             // 送信鍵で暗号化した数
+	clock   Clock
+	entropy io.Reader
+}
+
+// 自ノード宛て用のセッション(交換せずに乱数の鍵を使う)
+func newSelfSession(p2p *P2PNetwork) (*session, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(p2p.Entropy(), key); err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	s := &session{clock: p2p.clock, entropy: p2p.entropy}
+	s.install(&sessionKey{id: 0, send: aead, recv: aead})
+	return s, nil
+}
+
+// AES-256-GCM
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// 使い捨て鍵を作り、返事待ちに登録する
+func (s *session) newEphemeral() (*ecdh.PrivateKey, error) {
+	priv, err := newX25519Key(s.entropy)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = append(s.pending, priv.PublicKey().Bytes())
+	s.privs = append(s.privs, priv)
+	if len(s.pending) > MAX_PENDING_EPH {
+		s.pending = s.pending[1:]
+		s.privs = s.privs[1:]
+	}
+	return priv, nil
+}
+
+// 返事待ちの使い捨て鍵を取り出す
+func (s *session) takeEphemeral(pub []byte) *ecdh.PrivateKey {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, p := range s.pending {
+		if bytes.Equal(p, pub) {
+			priv := s.privs[i]
+			s.pending = append(s.pending[:i:i], s.pending[i+1:]...)
+			s.privs = append(s.privs[:i:i], s.privs[i+1:]...)
+			return priv
+		}
+	}
+	return nil
+}
+
+// 返事待ちの使い捨て鍵か確認
+func (s *session) hasEphemeral(pub []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range s.pending {
+		if bytes.Equal(p, pub) {
+			return true
+		}
+	}
+	return false
+}
+
+// 鍵交換
+// 識別鍵の小さい方を先にして鍵を並べるので、両側で同じ鍵ができる
+// ネットワークのmagicを混ぜるので、他のネットワークとは同じ鍵にならない
+func deriveSessionKey(priv *ecdh.PrivateKey, peer_eph []byte, self_key string, peer_key string, magic [4]byte) (*sessionKey, error) {
+	pub, err := ecdh.X25519().NewPublicKey(peer_eph)
+	if err != nil {
+		return nil, Malformed("eph")
+	}
+	shared, err := priv.ECDH(pub)
+	if err != nil {
+		return nil, Malformed("eph")
+	}
+
+	local := priv.PublicKey().Bytes()
+	first := self_key < peer_key
+	info := make([]byte, 0, 2*len(local)+2*KEY_SIZE)
+	if first {
+		info = append(append(append(info, self_key...), peer_key...), local...)
+		info = append(info, peer_eph...)
+	} else {
+		info = append(append(append(info, peer_key...), self_key...), peer_eph...)
+		info = append(info, local...)
+	}
+	okm := hkdfSHA256(shared, magic[:], info, 64)
+
+	k1, err := newAEAD(okm[:32])
+	if err != nil {
+		return nil, err
+	}
+	k2, err := newAEAD(okm[32:])
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(info)
+	key := &sessionKey{id: binary.BigEndian.Uint32(sum[:SESSION_KEY_ID])}
+	if first {
+		key.send, key.recv = k1, k2
+	} else {
+		key.send, key.recv = k2, k1
+	}
+	return key, nil
+}
+
+// HKDF(RFC 5869)
+func hkdfSHA256(secret []byte, salt []byte, info []byte, length int) []byte {
+	ext := hmac.New(sha256.New, salt)
+	ext.Write(secret)
+	prk := ext.Sum(nil)
+
+	out := make([]byte, 0, length)
+	var t []byte
+	for i := byte(1); len(out) < length; i++ {
+		exp := hmac.New(sha256.New, prk)
+		exp.Write(t)
+		exp.Write(info)
+		exp.Write([]byte{i})
+		t = exp.Sum(nil)
+		out = append(out, t...)
+	}
+	return out[:length]
+}
+
+// 新しい鍵を使い始める
+func (s *session) install(key *sessionKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = append([]*sessionKey{key}, s.keys...)
+	if len(s.keys) > MAX_SESSION_KEYS {
+		s.keys = s.keys[:MAX_SESSION_KEYS]
+	}
+	s.since = clockNow(s.clock)
+	s.sent = 0
+}
+
+// セッション確立済みか
+func (s *session) ready() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.keys) > 0
+}
+
+// 鍵の更新が必要か
+func (s *session) stale() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.keys) > 0 && (clockNow(s.clock).Sub(s.since) > REKEY_INTERVAL || s.sent > REKEY_MESSAGES)
+}
+
+// GCMのノンス(封筒のノンスと送信時刻から作る)
+func gcmNonce(nonce uint64, ts int64) []byte {
+	n := make([]byte, 12)
+	binary.BigEndian.PutUint64(n[0:8], nonce)
+	binary.BigEndian.PutUint32(n[8:12], uint32(ts))
+	return n
+}
+
+// 暗号化(鍵ID + 暗号文)
+func (s *session) seal(aad []byte, nonce uint64, ts int64, msg []byte) ([]byte, error) {
+	s.mu.Lock()
+	if len(s.keys) == 0 {
+		s.mu.Unlock()
+		return nil, ErrNoSession
+	}
+	key := s.keys[0]
+	s.sent++
+	s.mu.Unlock()
+
+	out := make([]byte, SESSION_KEY_ID, SESSION_KEY_ID+len(msg)+key.send.Overhead())
+	binary.BigEndian.PutUint32(out, key.id)
+	return key.send.Seal(out, gcmNonce(nonce, ts), msg, aad), nil
+}
+
+// 復号
+func (s *session) open(aad []byte, nonce uint64, ts int64, body []byte) ([]byte, error) {
+	if len(body) < SESSION_KEY_ID {
+		return nil, ErrDecrypt
+	}
+	id := binary.BigEndian.Uint32(body)
+
+	s.mu.Lock()
+	var key *sessionKey
+	for _, k := range s.keys {
+		if k.id == id {
+			key = k
+			break
+		}
+	}
+	s.mu.Unlock()
+	if key == nil {
+		return nil, ErrNoSession
+	}
+
+	msg, err := key.recv.Open(nil, gcmNonce(nonce, ts), body[SESSION_KEY_ID:], aad)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return msg, nil
+}
+
+// 受信したフレームを復号する
+// HELLO以外は暗号化必須
+func (p2p *P2PNetwork) decrypt(from *Node, env *envelope) ([]byte, error) {
+	if env.cmd == CMD_HELLO {
+		return env.body, nil
+	}
+	if env.flags&FLAG_ENCRYPTED == 0 {
+		return nil, ErrPlaintext
+	}
+	if from.session == nil {
+		return nil, ErrNoSession
+	}
+	return from.session.open(env.aad, env.nonce, env.ts, env.body)
+}
+
+// 古くなったセッション鍵を定期的に更新する
+func (p2p *P2PNetwork) rekeyLoop() {
+	for p2p.wait(REKEY_CHECK) {
+		for _, node := range p2p.peers.snapshot() {
+			if node.Self || node.session == nil || !node.session.stale() {
+				continue
+			}
+			fmt.Println("Rekey:", node.me())
+			if err := p2p.hello(node, true); err != nil {
+				fmt.Println("rekey error:", node.me(), err)
+			}
+		}
+	}
+}
+
+// セッションの統計情報
+type SessionStats struct {
+	Addr  string `json:"addr"`
+	Ready bool   `json:"ready"`
+	Keys  int    `json:"keys"`
+	Age   string `json:"age"`
+	Sent  uint64 `json:"sent"`
+}
+
+// 統計情報
+func (s *session) stats(addr string) SessionStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := SessionStats{Addr: addr, Ready: len(s.keys) > 0, Keys: len(s.keys), Sent: s.sent}
+	if st.Ready {
+		st.Age = clockNow(s.clock).Sub(s.since).Round(time.Second).String()
+	}
+	return st
+}
@@ -0,0 +1,115 @@
+/*
+  My Block Chain: P2P encrypted session tests
+*/
+package P2P
+
+import (
+	"bytes"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/*
+暗号化セッションの受信の試験
+	MemNetworkでつないだ2つのノードで、受信側が平文のフレーム、現在または
+	1つ前のセッション鍵で復号できないフレーム、知らない鍵IDのフレームを
+	拒否することを確かめる。鍵の更新後も、本物の1つ前の鍵のフレームは受け付ける。
+*/
+
+// 復号できなかった数
+func (tn *testNode) undecrypted() uint64 {
+	return atomic.LoadUint64(&tn.p2p.undecrypted)
+}
+
+// 送信鍵
+func (tn *testNode) sendKey(other *testNode) *sessionKey {
+	s := tn.peer(other).session
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.keys[0]
+}
+
+// 受信側が持つ鍵の数
+func (tn *testNode) keyCount(other *testNode) int {
+	s := tn.peer(other).session
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.keys)
+}
+
+// 指定した鍵だけを持つ送信用のセッション
+func keySession(t *testing.T, id uint32, aead_seed int64) *session {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(NewSeededEntropy(aead_seed), key); err != nil {
+		t.Fatal(err)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := new(session)
+	s.install(&sessionKey{id: id, send: aead, recv: aead})
+	return s
+}
+
+// 復号できずに捨てられることを確かめる
+func expectUndecrypted(t *testing.T, mn *MemNetwork, b *testNode, what string, frame []byte) {
+	before := b.undecrypted()
+	inject(t, mn, b, frame)
+	waitFor(t, what, func() bool { return b.undecrypted() > before })
+	if msg := b.received(100 * time.Millisecond); msg != nil {
+		t.Fatalf("%s delivered: %q", what, msg)
+	}
+}
+
+func TestUndecryptableRejected(t *testing.T) {
+	mn, a, b := newTestPair(t)
+	id := a.sendKey(b).id
+
+	// 暗号化していないもの
+	expectUndecrypted(t, mn, b, "plaintext", testFrame(t, a.p2p.identity, nil, b, []byte("plain"), time.Now(), 60))
+	// 現在の鍵IDで、違う鍵で暗号化したもの
+	expectUndecrypted(t, mn, b, "wrong key", testFrame(t, a.p2p.identity, keySession(t, id, 61), b, []byte("wrong"), time.Now(), 62))
+	// 知らない鍵ID
+	expectUndecrypted(t, mn, b, "unknown key id", testFrame(t, a.p2p.identity, keySession(t, id+1, 63), b, []byte("unknown"), time.Now(), 64))
+
+	// 正しい鍵のものは受け付ける
+	inject(t, mn, b, testFrame(t, a.p2p.identity, a.peer(b).session, b, []byte("valid"), time.Now(), 65))
+	if msg := b.received(test_timeout); !bytes.Equal(msg, []byte("valid")) {
+		t.Fatalf("valid frame not delivered: %q", msg)
+	}
+}
+
+func TestPreviousKeyAfterRekey(t *testing.T) {
+	mn, a, b := newTestPair(t)
+	old := a.sendKey(b)
+
+	// 鍵の更新が両方のノードで終わるまで待つ
+	if err := a.p2p.hello(a.peer(b), true); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "rekey", func() bool {
+		return a.sendKey(b).id != old.id && a.keyCount(b) >= 2 && b.keyCount(a) >= 2
+	})
+
+	// 本物の1つ前の鍵で暗号化したものは受け付ける
+	prev := new(session)
+	prev.install(old)
+	inject(t, mn, b, testFrame(t, a.p2p.identity, prev, b, []byte("previous"), time.Now(), 70))
+	if msg := b.received(test_timeout); !bytes.Equal(msg, []byte("previous")) {
+		t.Fatalf("frame under previous key not delivered: %q", msg)
+	}
+
+	// 1つ前の鍵IDでも、違う鍵で暗号化したものは拒否する
+	expectUndecrypted(t, mn, b, "wrong previous key", testFrame(t, a.p2p.identity, keySession(t, old.id, 71), b, []byte("forged"), time.Now(), 72))
+	// 現在の鍵IDで違う鍵のものも同じ
+	expectUndecrypted(t, mn, b, "wrong current key", testFrame(t, a.p2p.identity, keySession(t, a.sendKey(b).id, 73), b, []byte("forged"), time.Now(), 74))
+
+	// 現在の鍵のものは受け付ける
+	inject(t, mn, b, testFrame(t, a.p2p.identity, a.peer(b).session, b, []byte("current"), time.Now(), 75))
+	if msg := b.received(test_timeout); !bytes.Equal(msg, []byte("current")) {
+		t.Fatalf("frame under current key not delivered: %q", msg)
+	}
+}
@@ -0,0 +1,64 @@
+/*
+  My Block Chain: P2P statistics module
+*/
+package P2P
+
+import (
+	"sync/atomic"
+)
+
+// P2Pネットワークの統計情報
+type Stats struct {
+	Queues        []QueueStats    `json:"queues"`
+	Dispatch      []DispatchStats `json:"dispatch"`
+	Unknown       uint64          `json:"unknown"`
+	Requests      int             `json:"pending_requests"`
+	Penalties     []PenaltyStats  `json:"penalties"`
+	Rejected      uint64          `json:"rejected"` // 送信元を確認できず捨てたメッセージ
+	Undecryptable uint64          `json:"undecryptable"`
+	Sessions      []SessionStats  `json:"sessions"`
+	Limited       uint64          `json:"rate_limited"`
+	Scores        []ScoreStats    `json:"scores"`
+	Unverified    int             `json:"unverified"`
+	Probes        uint64          `json:"probes_limited"` // 制限で送らなかった確認要求
+	Expired       uint64          `json:"unverified_expired"`
+	Gossip        GossipStats     `json:"gossip"`
+	DHT           DHTStats        `json:"dht"`
+	Magic         string          `json:"magic"`
+	Foreign       uint64          `json:"foreign_frames"` // 他のネットワークのフレーム
+	ForeignPeers  []ForeignStats  `json:"foreign"`
+}
+
+// 統計情報を取得
+func (p2p *P2PNetwork) Stats() Stats {
+	stats := Stats{}
+	stats.Queues = make([]QueueStats, 0)
+	for _, node := range p2p.peers.snapshot() {
+		if node.queue != nil {
+			stats.Queues = append(stats.Queues, node.queue.stats())
+		}
+	}
+	if p2p.dispatch != nil {
+		stats.Dispatch = p2p.dispatch.stats()
+		stats.Unknown = atomic.LoadUint64(&p2p.dispatch.unknown)
+	}
+	stats.Requests = p2p.pendingRequests()
+	stats.Penalties = p2p.penalties.stats()
+	stats.Rejected = atomic.LoadUint64(&p2p.rejected)
+	stats.Undecryptable = atomic.LoadUint64(&p2p.undecrypted)
+	stats.Limited = atomic.LoadUint64(&p2p.limited)
+	stats.Scores = p2p.scores.stats()
+	stats.Unverified = len(p2p.unverified.stats())
+	stats.Probes, stats.Expired = p2p.unverified.counts()
+	stats.Gossip = p2p.gossipStats()
+	stats.DHT = p2p.dhtStats()
+	stats.Magic = p2p.Magic()
+	stats.Foreign, stats.ForeignPeers = p2p.foreign.stats()
+	stats.Sessions = make([]SessionStats, 0)
+	for _, node := range p2p.peers.snapshot() {
+		if !node.Self && node.session != nil {
+			stats.Sessions = append(stats.Sessions, node.session.stats(node.me()))
+		}
+	}
+	return stats
+}
@@ -0,0 +1,209 @@
+/*
+  My Block Chain: P2P transport module
+*/
+package P2P
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+)
+
+/*
+通信路
+	P2Pの送受信はTransportを通して行う。通常はUDPを使い、テストやシミュレーションでは
+	同じプロセス内でパケットを受け渡すMemNetworkを使う。
+	どちらもUDPと同じく、届かなかったパケットや溢れたパケットは黙って捨てる。
+*/
+const (
+	MEM_QUEUE = 1024 // MemNetworkの受信キューの長さ
+)
+
+var ErrAddrInUse = errors.New("Address already in use.")
+
+// 受信側の通信路
+type PacketConn interface {
+	ReadFrom(b []byte) (int, net.Addr, error)
+	Close() error
+}
+
+// 送信側の通信路
+type Conn interface {
+	Write(b []byte) (int, error)
+	Close() error
+}
+
+// 通信路の作り方
+type Transport interface {
+	Listen(addr string) (PacketConn, error)
+	Dial(addr string) (Conn, error)
+}
+
+// UDP
+type UDPTransport struct{}
+
+// 受信の開始
+func (UDPTransport) Listen(addr string) (PacketConn, error) {
+	host, port, err := splitAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	udpAddr := &net.UDPAddr{
+		IP:   net.ParseIP(host),
+		Port: int(port),
+	}
+	return net.ListenUDP("udp", udpAddr)
+}
+
+// 送信先に接続
+func (UDPTransport) Dial(addr string) (Conn, error) {
+	return net.Dial("udp", addr)
+}
+
+// プロセス内のネットワーク
+// アドレスは"host:port"の文字列で区別するだけで、名前解決はしない
+type MemNetwork struct {
+	mu      sync.Mutex
+	conns   map[string]*memConn
+	next    int
+	sent    uint64
+	dropped uint64
+}
+
+// プロセス内のアドレス
+type memAddr string
+
+func (a memAddr) Network() string { return "mem" }
+func (a memAddr) String() string  { return string(a) }
+
+// プロセス内の受信パケット
+type memPacket struct {
+	from memAddr
+	b    []byte
+}
+
+// プロセス内の受信側の通信路
+type memConn struct {
+	net    *MemNetwork
+	addr   string
+	ch     chan memPacket
+	closed chan struct{}
+	once   sync.Once
+}
+
+// プロセス内の送信側の通信路
+type memDialer struct {
+	net  *MemNetwork
+	from memAddr
+	to   string
+}
+
+// プロセス内のネットワークの作成
+func NewMemNetwork() *MemNetwork {
+	mn := new(MemNetwork)
+	mn.conns = make(map[string]*memConn)
+	return mn
+}
+
+// 受信の開始
+func (mn *MemNetwork) Listen(addr string) (PacketConn, error) {
+	if _, _, err := splitAddr(addr); err != nil {
+		return nil, err
+	}
+	mn.mu.Lock()
+	defer mn.mu.Unlock()
+
+	if _, ok := mn.conns[addr]; ok {
+		return nil, ErrAddrInUse
+	}
+	c := &memConn{net: mn, addr: addr, ch: make(chan memPacket, MEM_QUEUE), closed: make(chan struct{})}
+	mn.conns[addr] = c
+	return c, nil
+}
+
+// 送信先に接続(送信元には使われていないアドレスを割り当てる)
+func (mn *MemNetwork) Dial(addr string) (Conn, error) {
+	if _, _, err := splitAddr(addr); err != nil {
+		return nil, err
+	}
+	mn.mu.Lock()
+	defer mn.mu.Unlock()
+
+	mn.next++
+	return &memDialer{net: mn, from: memAddr("mem:" + strconv.Itoa(mn.next)), to: addr}, nil
+}
+
+// パケットの配送
+func (mn *MemNetwork) deliver(from memAddr, to string, b []byte) {
+	mn.mu.Lock()
+	c := mn.conns[to]
+	mn.mu.Unlock()
+
+	if c == nil {
+		mn.count(false)
+		return
+	}
+	select {
+	case c.ch <- memPacket{from: from, b: b}:
+		mn.count(true)
+	case <-c.closed:
+		mn.count(false)
+	default:
+		mn.count(false)
+	}
+}
+
+// 配送数の記録
+func (mn *MemNetwork) count(ok bool) {
+	mn.mu.Lock()
+	defer mn.mu.Unlock()
+	if ok {
+		mn.sent++
+	} else {
+		mn.dropped++
+	}
+}
+
+// 配送したパケット数と捨てたパケット数
+func (mn *MemNetwork) Counts() (uint64, uint64) {
+	mn.mu.Lock()
+	defer mn.mu.Unlock()
+	return mn.sent, mn.dropped
+}
+
+// 受信
+func (c *memConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case p := <-c.ch:
+		return copy(b, p.b), p.from, nil
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+// 受信の終了
+func (c *memConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+		c.net.mu.Lock()
+		if c.net.conns[c.addr] == c {
+			delete(c.net.conns, c.addr)
+		}
+		c.net.mu.Unlock()
+	})
+	return nil
+}
+
+// 送信(受け取った側で書き換えられないようにコピーする)
+func (d *memDialer) Write(b []byte) (int, error) {
+	p := make([]byte, len(b))
+	copy(p, b)
+	d.net.deliver(d.from, d.to, p)
+	return len(b), nil
+}
+
+// 接続の終了
+func (d *memDialer) Close() error {
+	return nil
+}
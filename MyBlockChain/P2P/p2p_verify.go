@@ -0,0 +1,208 @@
+/*
+  My Block Chain: P2P address verification module
+*/
+package P2P
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+/*
+アドレスの確認(ダイヤルバック)
+	ADDSRVで通知されたアドレスや、未登録のノードがHELLOで名乗ったアドレスは
+	すぐには登録せず、未確認として保持する。そのアドレスに使い捨て鍵を付けた
+	HELLO(確認要求)を1つだけ送り、その鍵への返事(Ack)が名乗った鍵の署名付きで
+	返ってきたら登録する。
+
+	確認要求は全体でレートを制限し、1つのアドレスに送る回数にも上限を設ける。
+	返事が無い未確認のアドレスは期限が来たら消す。
+	これにより偽のアドレスを通知して、無関係のホストに通信を向けさせることを防ぐ。
+*/
+const (
+	MAX_UNVERIFIED = 256
+	UNVERIFIED_TTL = time.Minute
+	MAX_PROBES     = 3 // 1つのアドレスに送る確認要求の数
+
+	// 確認要求の送信レート(トークンバケット)
+	PROBE_RATE  = 10 // 1秒あたり
+	PROBE_BURST = 20
+)
+
+// 未確認のアドレス
+type unverifiedNode struct {
+	node   *Node
+	since  time.Time
+	probes int
+}
+
+// 未確認のアドレスの一覧
+// 同じアドレスでも名乗った鍵が違えば別に扱う
+type unverifiedSet struct {
+	mu       sync.Mutex
+	entries  map[string]*unverifiedNode
+	tokens   float64
+	refilled time.Time
+	limited  uint64
+	expired  uint64
+	clock    Clock
+}
+
+// 未確認のアドレスの統計情報
+type UnverifiedStats struct {
+	Addr   string `json:"addr"`
+	Key    string `json:"key"`
+	Age    string `json:"age"`
+	Probes int    `json:"probes"`
+}
+
+// 一覧のキー
+func unverifiedKey(addr string, key string) string {
+	return addr + "/" + key
+}
+
+// 期限切れを消す(ロックは呼び出し元で取る)
+func (us *unverifiedSet) expire(now time.Time) {
+	for k, e := range us.entries {
+		if now.Sub(e.since) > UNVERIFIED_TTL {
+			delete(us.entries, k)
+			e.node.disconnect()
+			us.expired++
+		}
+	}
+}
+
+// 確認要求を送ってよいか(ロックは呼び出し元で取る)
+func (us *unverifiedSet) allow(now time.Time) bool {
+	if us.refilled.IsZero() {
+		us.tokens = PROBE_BURST
+	} else {
+		us.tokens += now.Sub(us.refilled).Seconds() * PROBE_RATE
+		if us.tokens > PROBE_BURST {
+			us.tokens = PROBE_BURST
+		}
+	}
+	us.refilled = now
+	if us.tokens < 1 {
+		us.limited++
+		return false
+	}
+	us.tokens--
+	return true
+}
+
+// 未確認のアドレスを登録して、確認要求を送るノードを返す
+// 上限や送信レートを超えた場合はnilを返す
+func (us *unverifiedSet) probe(node *Node, p2p *P2PNetwork) *Node {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	now := clockNow(us.clock)
+	if us.entries == nil {
+		us.entries = make(map[string]*unverifiedNode)
+	}
+	us.expire(now)
+
+	k := unverifiedKey(node.me(), node.PubKey)
+	e, ok := us.entries[k]
+	if ok && e.probes >= MAX_PROBES {
+		return nil
+	}
+	if !ok && len(us.entries) >= MAX_UNVERIFIED {
+		us.limited++
+		return nil
+	}
+	if !us.allow(now) {
+		return nil
+	}
+	if !ok {
+		n := &Node{Host: node.Host, ApiPort: node.ApiPort, P2PPort: node.P2PPort, PubKey: node.PubKey}
+		n.connect(p2p)
+		e = &unverifiedNode{node: n, since: now}
+		us.entries[k] = e
+	}
+	e.probes++
+	return e.node
+}
+
+// 確認要求への返事を受け取ったノードを一覧から取り出す
+// 名乗ったアドレスの未確認のノードのうち、返事の鍵(ack)を送ったものを探す
+func (us *unverifiedSet) verified(addr string, key string, ack []byte) *Node {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	for _, k := range []string{unverifiedKey(addr, key), unverifiedKey(addr, "")} {
+		e, ok := us.entries[k]
+		if !ok {
+			continue
+		}
+		if !e.node.session.hasEphemeral(ack) {
+			continue
+		}
+		delete(us.entries, k)
+		e.node.PubKey = key
+		return e.node
+	}
+	return nil
+}
+
+// 制限で送らなかった確認要求の数と、期限切れで消した数
+func (us *unverifiedSet) counts() (uint64, uint64) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	return us.limited, us.expired
+}
+
+// 統計情報
+func (us *unverifiedSet) stats() []UnverifiedStats {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	now := clockNow(us.clock)
+	us.expire(now)
+	stats := make([]UnverifiedStats, 0, len(us.entries))
+	for _, e := range us.entries {
+		stats = append(stats, UnverifiedStats{
+			Addr:   e.node.me(),
+			Key:    e.node.PubKey,
+			Age:    now.Sub(e.since).Round(time.Second).String(),
+			Probes: e.probes,
+		})
+	}
+	return stats
+}
+
+// アドレスの確認要求を送る
+// ack には相手から受け取った使い捨て鍵を入れる(相手にとってこちらの確認になる)
+func (p2p *P2PNetwork) verify(node *Node, ack []byte) {
+	if p2p.peers.search(node.Host, node.P2PPort) != nil {
+		return
+	}
+	n := p2p.unverified.probe(node, p2p)
+	if n == nil {
+		if debug_mode {
+			fmt.Println("Probe limited:", node.me())
+		}
+		return
+	}
+	self := p2p.peers.self()
+	if self == nil {
+		return
+	}
+	priv, err := n.session.newEphemeral()
+	if err != nil {
+		fmt.Println("probe error:", n.me(), err)
+		return
+	}
+	fmt.Println("Probe:", n.me())
+	m := &HelloMsg{Node: *self, Reply: true, Eph: priv.PublicKey().Bytes(), Ack: ack}
+	if err := n.post(CMD_HELLO, p2p.Marshal(m)); err != nil {
+		fmt.Println("probe error:", n.me(), err)
+	}
+}
+
+// 未確認のアドレスの一覧
+func (p2p *P2PNetwork) Unverified() []UnverifiedStats {
+	return p2p.unverified.stats()
+}
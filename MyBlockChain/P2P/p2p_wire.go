@@ -0,0 +1,425 @@
+/*
+  My Block Chain: P2P wire format module
+*/
+package P2P
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"time"
+)
+
+/*
+フレーム形式(ビッグエンディアン)
+	magic    4byte  ネットワークの識別子(チェーンのパラメータから作る)
+	version  1byte
+	cmd      1byte
+	flags    1byte
+	length   4byte  以降の長さ
+	checksum 4byte  sha256(sha256(以降))の先頭4byte
+	pubkey   32byte 送信元の識別鍵
+	time     8byte  送信時刻(UnixNano)
+	nonce    8byte
+	sign     64byte magic〜flags、pubkey、time、nonce、payloadへの署名
+	payload         HELLO以外は 鍵ID 4byte + AES-GCMの暗号文
+	                (magic〜flags、pubkey、time、nonceを追加データにする)
+*/
+const (
+	WIRE_VERSION    = 2
+	FRAME_HEADER    = 15
+	ENVELOPE_HEADER = KEY_SIZE + 8 + 8 + ed25519.SignatureSize
+	MAX_PAYLOAD     = MAX_PACKET - FRAME_HEADER - ENVELOPE_HEADER
+
+	FLAG_BINARY = 0x01 // ペイロードがバイナリ形式
+	FLAG_SIGNED = 0x02 // 署名付き(必須)
+
+	// ペイロードの形式
+	WIRE_BINARY = 0
+	WIRE_JSON   = 1
+
+	// バイナリ形式のペイロードの先頭バイト(JSONは'{'で始まる)
+	WIRE_TAG = 0x01
+)
+
+// フレームの識別子の既定値(SetNetworkMagicで変える)
+var wire_magic = [4]byte{'M', 'B', 'C', 0x01}
+
+// ペイロードのバイナリ変換
+type Codec interface {
+	EncodeWire(w *Writer)
+	DecodeWire(r *Reader)
+}
+
+// 受信したフレームの中身
+type envelope struct {
+	cmd   int
+	flags byte
+	key   string // 送信元の識別鍵(16進)
+	ts    int64
+	nonce uint64
+	aad   []byte // 暗号化の追加データ
+	body  []byte
+}
+
+// フレームの組み立て(署名付き、sessが指定されたら暗号化する)
+// 送信時刻とノンスはnowとrndから作る
+// 1パケットに収まらないペイロードは署名や暗号化の前に断る
+func encodeFrame(id *Identity, sess *session, magic [4]byte, cmd int, msg []byte, now time.Time, rnd io.Reader) ([]byte, error) {
+	if len(msg) > MAX_PAYLOAD {
+		return nil, ErrTooLarge
+	}
+	flags := byte(FLAG_SIGNED)
+	if len(msg) > 0 && msg[0] == WIRE_TAG {
+		flags |= FLAG_BINARY
+	}
+	if sess != nil {
+		flags |= FLAG_ENCRYPTED
+	}
+
+	frame := make([]byte, FRAME_HEADER+ENVELOPE_HEADER, MAX_PACKET)
+	copy(frame[0:4], magic[:])
+	frame[4] = WIRE_VERSION
+	frame[5] = byte(cmd)
+	frame[6] = flags
+
+	env := frame[FRAME_HEADER:]
+	ts := now.UnixNano()
+	binary.BigEndian.PutUint64(env[KEY_SIZE:KEY_SIZE+8], uint64(ts))
+	copy(env[0:KEY_SIZE], id.pub)
+	if _, err := io.ReadFull(entropyOf(rnd), env[KEY_SIZE+8:KEY_SIZE+16]); err != nil {
+		return nil, err
+	}
+	nonce := binary.BigEndian.Uint64(env[KEY_SIZE+8 : KEY_SIZE+16])
+
+	body := msg
+	if sess != nil {
+		var err error
+		body, err = sess.seal(headerBytes(frame), nonce, ts, msg)
+		if err != nil {
+			return nil, err
+		}
+		// 暗号化で増えた分で収まらなくなった
+		if len(body) > MAX_PAYLOAD {
+			return nil, ErrTooLarge
+		}
+	}
+	frame = append(frame, body...)
+	binary.BigEndian.PutUint32(frame[7:11], uint32(ENVELOPE_HEADER+len(body)))
+	copy(env[KEY_SIZE+16:ENVELOPE_HEADER], id.Sign(signedBytes(frame)))
+
+	sum := checksum(frame[FRAME_HEADER:])
+	copy(frame[11:15], sum[:])
+	return frame, nil
+}
+
+// 署名と暗号化で守るヘッダ部分(magic〜flagsと、署名以外の封筒)
+func headerBytes(frame []byte) []byte {
+	b := make([]byte, 0, 7+KEY_SIZE+16)
+	b = append(b, frame[0:7]...)
+	return append(b, frame[FRAME_HEADER:FRAME_HEADER+KEY_SIZE+16]...)
+}
+
+// 署名対象(ヘッダ部分とペイロード)
+func signedBytes(frame []byte) []byte {
+	return append(headerBytes(frame), frame[FRAME_HEADER+ENVELOPE_HEADER:]...)
+}
+
+// フレームの分解と署名の検証
+func decodeFrame(frame []byte, magic [4]byte) (*envelope, error) {
+	if len(frame) < FRAME_HEADER {
+		return nil, &DecodeError{Err: ErrShortFrame}
+	}
+	if !bytes.Equal(frame[0:4], magic[:]) {
+		return nil, &DecodeError{Err: ErrBadMagic}
+	}
+	if frame[4] != WIRE_VERSION {
+		return nil, &DecodeError{Err: ErrBadVersion}
+	}
+	cmd := int(frame[5])
+	if cmd <= 0 || cmd >= MAX_CMD {
+		return nil, &DecodeError{Cmd: cmd, Err: ErrUnknownCommand}
+	}
+	length := binary.BigEndian.Uint32(frame[7:11])
+	if length > ENVELOPE_HEADER+MAX_PAYLOAD {
+		return nil, &DecodeError{Cmd: cmd, Err: ErrTooLarge}
+	}
+	if uint64(length) != uint64(len(frame)-FRAME_HEADER) || length < ENVELOPE_HEADER {
+		return nil, &DecodeError{Cmd: cmd, Err: ErrBadLength}
+	}
+	sum := checksum(frame[FRAME_HEADER:])
+	if !bytes.Equal(frame[11:15], sum[:]) {
+		return nil, &DecodeError{Cmd: cmd, Err: ErrBadChecksum}
+	}
+	if frame[6]&FLAG_SIGNED == 0 {
+		return nil, &DecodeError{Cmd: cmd, Err: ErrBadSignature, Reason: "unsigned"}
+	}
+
+	env := frame[FRAME_HEADER:]
+	pub := env[0:KEY_SIZE]
+	if !verifySig(pub, signedBytes(frame), env[KEY_SIZE+16:ENVELOPE_HEADER]) {
+		return nil, &DecodeError{Cmd: cmd, Err: ErrBadSignature}
+	}
+	return &envelope{
+		cmd:   cmd,
+		flags: frame[6],
+		key:   hex.EncodeToString(pub),
+		aad:   headerBytes(frame),
+		ts:    int64(binary.BigEndian.Uint64(env[KEY_SIZE : KEY_SIZE+8])),
+		nonce: binary.BigEndian.Uint64(env[KEY_SIZE+8 : KEY_SIZE+16]),
+		body:  env[ENVELOPE_HEADER:],
+	}, nil
+}
+
+// チェックサム
+func checksum(msg []byte) [4]byte {
+	h1 := sha256.Sum256(msg)
+	h2 := sha256.Sum256(h1[:])
+	var sum [4]byte
+	copy(sum[:], h2[:4])
+	return sum
+}
+
+// ペイロードの形式を設定(デバッグ用にJSONも選べる)
+func (p2p *P2PNetwork) SetWireFormat(format int) {
+	p2p.wire_format = format
+}
+
+// ペイロードの組み立て
+func (p2p *P2PNetwork) Marshal(v Codec) []byte {
+	if p2p.wire_format == WIRE_JSON {
+		b, _ := json.Marshal(v)
+		return b
+	}
+	w := NewWriter()
+	v.EncodeWire(w)
+	return w.Data()
+}
+
+// ペイロードの分解
+// 先頭バイトで形式を判別するので、どちらの形式でも受け取れる
+// 失敗した場合は*DecodeErrorを返す
+func Unmarshal(data []byte, v Codec) error {
+	if len(data) == 0 {
+		return &DecodeError{Err: ErrEmptyPayload}
+	}
+	if data[0] != WIRE_TAG {
+		if err := json.Unmarshal(data, v); err != nil {
+			return &DecodeError{Err: ErrBadJSON, Reason: err.Error()}
+		}
+	} else {
+		r := NewReader(data[1:])
+		v.DecodeWire(r)
+		if r.Err() != nil {
+			return &DecodeError{Err: r.Err()}
+		}
+		if r.Len() != 0 {
+			return &DecodeError{Err: ErrTrailingBytes}
+		}
+	}
+
+	// 中身の検証
+	if vv, ok := v.(validator); ok {
+		return vv.Validate()
+	}
+	return nil
+}
+
+// バイナリ形式の書き込み
+type Writer struct {
+	buf []byte
+}
+
+// バイナリ形式の書き込みの初期化
+func NewWriter() *Writer {
+	w := new(Writer)
+	w.buf = []byte{WIRE_TAG}
+	return w
+}
+
+// 書き込んだデータ
+func (w *Writer) Data() []byte {
+	return w.buf
+}
+
+// 1バイト
+func (w *Writer) Byte(v byte) {
+	w.buf = append(w.buf, v)
+}
+
+// 符号なし整数(可変長)
+func (w *Writer) Uvarint(v uint64) {
+	w.buf = binary.AppendUvarint(w.buf, v)
+}
+
+// 符号付き整数(可変長)
+func (w *Writer) Varint(v int64) {
+	w.buf = binary.AppendVarint(w.buf, v)
+}
+
+// バイト列(長さ付き)
+func (w *Writer) Bytes(b []byte) {
+	w.Uvarint(uint64(len(b)))
+	w.buf = append(w.buf, b...)
+}
+
+// 文字列(長さ付き)
+func (w *Writer) String(s string) {
+	w.Uvarint(uint64(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+// 文字列の配列
+func (w *Writer) Strings(ss []string) {
+	w.Uvarint(uint64(len(ss)))
+	for _, s := range ss {
+		w.String(s)
+	}
+}
+
+// ハッシュ値(16進文字列はバイナリにして詰める)
+func (w *Writer) Hash(h string) {
+	b, err := hex.DecodeString(h)
+	if err == nil && hex.EncodeToString(b) == h {
+		w.Byte(1)
+		w.Bytes(b)
+		return
+	}
+	w.Byte(0)
+	w.String(h)
+}
+
+// バイナリ形式の読み込み
+// 途中でエラーになったら以降の読み込みは全てゼロ値を返す
+type Reader struct {
+	buf []byte
+	pos int
+	err error
+}
+
+// バイナリ形式の読み込みの初期化
+func NewReader(b []byte) *Reader {
+	r := new(Reader)
+	r.buf = b
+	return r
+}
+
+// 読み込みエラー
+func (r *Reader) Err() error {
+	return r.err
+}
+
+// 残りのバイト数
+func (r *Reader) Len() int {
+	return len(r.buf) - r.pos
+}
+
+// エラーを記録
+func (r *Reader) fail(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+}
+
+// 1バイト
+func (r *Reader) Byte() byte {
+	if r.err != nil {
+		return 0
+	}
+	if r.Len() < 1 {
+		r.fail(ErrShortMessage)
+		return 0
+	}
+	v := r.buf[r.pos]
+	r.pos++
+	return v
+}
+
+// 符号なし整数(可変長)
+func (r *Reader) Uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.buf[r.pos:])
+	if n <= 0 {
+		r.fail(ErrBadVarint)
+		return 0
+	}
+	r.pos += n
+	return v
+}
+
+// 符号付き整数(可変長)
+func (r *Reader) Varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.buf[r.pos:])
+	if n <= 0 {
+		r.fail(ErrBadVarint)
+		return 0
+	}
+	r.pos += n
+	return v
+}
+
+// バイト列(長さ付き)
+func (r *Reader) Bytes() []byte {
+	n := r.Uvarint()
+	if r.err != nil {
+		return nil
+	}
+	if n > uint64(r.Len()) {
+		r.fail(ErrShortMessage)
+		return nil
+	}
+	b := make([]byte, n)
+	copy(b, r.buf[r.pos:r.pos+int(n)])
+	r.pos += int(n)
+	return b
+}
+
+// 文字列(長さ付き)
+func (r *Reader) String() string {
+	return string(r.Bytes())
+}
+
+// 配列の要素数
+// 1要素最低1バイトなので、残りより多い要素数はエラーにする
+func (r *Reader) Count() int {
+	n := r.Uvarint()
+	if r.err != nil {
+		return 0
+	}
+	if n > uint64(r.Len()) {
+		r.fail(ErrShortMessage)
+		return 0
+	}
+	return int(n)
+}
+
+// 文字列の配列
+func (r *Reader) Strings() []string {
+	n := r.Count()
+	ss := make([]string, 0, n)
+	for i := 0; i < n && r.err == nil; i++ {
+		ss = append(ss, r.String())
+	}
+	return ss
+}
+
+// ハッシュ値
+func (r *Reader) Hash() string {
+	switch r.Byte() {
+	case 1:
+		return hex.EncodeToString(r.Bytes())
+	case 0:
+		return r.String()
+	}
+	r.fail(ErrBadHash)
+	return ""
+}
@@ -0,0 +1,437 @@
+/*
+  My Block Chain: multi node simulator module
+*/
+package Sim
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"../Block"
+	"../P2P"
+)
+
+/*
+シミュレータ
+	1つのプロセスの中で複数のノード(P2PNetwork + BlockChain)を動かす。
+	ノード間の通信はMemNetworkで受け渡し、全ノードで1つの仮想の時計を共有する。
+	通信の遅延や障害はFaultRulesで起こし、乱数の種を固定すれば同じ障害が起きる。
+	各ノードの鍵やノンスも種から作る乱数源を使うので、同じ種なら同じ鍵になる。
+
+	シナリオはAtで仮想の時刻を指定して操作(参加、データ投入、マイニング、分断)を
+	登録し、Runで時計を進める。時計を進める前には、ノードの処理が落ち着く
+	(しばらく通信が無くなる)まで実際の時間で待つ。
+	最後にConvergedやHasDataでチェーンの状態を確認する。
+*/
+const (
+	SIM_API_PORT = 3000
+	SIM_P2P_PORT = 4000
+	SIM_LATENCY  = 10 // 通信の遅延の既定値(ms)
+
+	SETTLE_POLL  = time.Millisecond // 処理が落ち着いたか確認する間隔(実際の時間)
+	SETTLE_QUIET = 5                // この回数続けて通信が無ければ落ち着いたとみなす
+	MAX_SETTLE   = 2 * time.Second
+)
+
+// 仮想の時計の開始時刻
+var sim_epoch = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// シミュレーションのノード
+type Node struct {
+	Name  string
+	Addr  string
+	P2P   *P2P.P2PNetwork
+	Chain *Block.BlockChain
+}
+
+// シナリオの操作
+type step struct {
+	at   time.Time
+	seq  int
+	name string
+	fn   func(s *Simulator) error
+}
+
+// シミュレータ
+type Simulator struct {
+	Clock  *P2P.VirtualClock
+	Faults *P2P.FaultRules
+	Rand   *rand.Rand // シナリオで使う乱数
+	Log    []string   // 実行した操作
+	seed   int64
+	net    *P2P.MemNetwork
+	nodes  []*Node
+	steps  []*step
+	seq    int
+}
+
+// シミュレータの作成
+func New(seed int64) *Simulator {
+	s := new(Simulator)
+	s.Clock = P2P.NewVirtualClock(sim_epoch)
+	s.Faults = P2P.NewFaultRules(seed)
+	s.Faults.SetClock(s.Clock)
+	s.Faults.SetConfig(P2P.FaultConfig{LatencyMs: SIM_LATENCY})
+	s.Rand = rand.New(rand.NewSource(seed))
+	s.seed = seed
+	s.Log = make([]string, 0)
+	s.net = P2P.NewMemNetwork()
+	s.nodes = make([]*Node, 0)
+	s.steps = make([]*step, 0)
+	return s
+}
+
+// ノードの追加(まだどのノードともつながっていない)
+func (s *Simulator) AddNode(name string) (*Node, error) {
+	if s.Node(name) != nil {
+		return nil, errors.New("Node already exists:" + name)
+	}
+	host := "10.0.0." + strconv.Itoa(len(s.nodes)+1)
+
+	p2p := new(P2P.P2PNetwork)
+	p2p.SetTransport(s.Faults.Wrap(s.net))
+	p2p.SetClock(s.Clock)
+	p2p.SetEntropy(P2P.NewSeededEntropy(s.seed + int64(len(s.nodes))))
+	if _, err := p2p.Init(host, SIM_API_PORT, SIM_P2P_PORT); err != nil {
+		return nil, err
+	}
+	bc := new(Block.BlockChain)
+	if _, err := bc.Init(p2p, true); err != nil {
+		return nil, err
+	}
+	bc.Initialized()
+
+	// アクション登録(mainと同じ)
+	p2p.SetAction(P2P.CMD_NEWBLOCK, bc.NewBlock)
+	p2p.SetAction(P2P.CMD_ADDSRV, p2p.AddSrv)
+	p2p.SetAction(P2P.CMD_MININGBLOCK, bc.MiningBlock)
+	p2p.SetAction(P2P.CMD_MODIFYDATA, bc.ModifyData)
+	p2p.SetPeerAction(P2P.CMD_INV, p2p.Inv)
+	p2p.SetPeerAction(P2P.CMD_GETDATA, p2p.GetData)
+	p2p.SetInventory(bc.HasInventory, bc.GetInventory)
+	p2p.SetRequestHandler(P2P.REQ_BLOCK, bc.ServeBlock)
+	p2p.SetRequestHandler(P2P.REQ_HEADERS, bc.ServeHeaders)
+	p2p.SetRequestHandler(P2P.REQ_BLOCKS, bc.ServeBlocks)
+	p2p.SetRequestHandler(P2P.REQ_BLOB, bc.ServeBlob)
+	p2p.SetPeerRequestHandler(P2P.REQ_TIP, bc.ServeTip)
+
+	n := &Node{Name: name, Addr: host + ":" + strconv.Itoa(SIM_P2P_PORT), P2P: p2p, Chain: bc}
+	s.nodes = append(s.nodes, n)
+	return n, nil
+}
+
+// 名前でノードを探す
+func (s *Simulator) Node(name string) *Node {
+	for _, n := range s.nodes {
+		if n.Name == name {
+			return n
+		}
+	}
+	return nil
+}
+
+// 全ノード
+func (s *Simulator) Nodes() []*Node {
+	return append([]*Node{}, s.nodes...)
+}
+
+// 全ノードを停止する(停止後もチェーンの内容は参照できる)
+func (s *Simulator) Close() {
+	for _, n := range s.nodes {
+		n.Chain.Close()
+		n.P2P.Close()
+	}
+}
+
+// 開始からの経過時間
+func (s *Simulator) Elapsed() time.Duration {
+	return s.Clock.Now().Sub(sim_epoch)
+}
+
+// 開始からatの時点で行う操作を登録する
+func (s *Simulator) At(at time.Duration, name string, fn func(s *Simulator) error) {
+	s.seq++
+	s.steps = append(s.steps, &step{at: sim_epoch.Add(at), seq: s.seq, name: name, fn: fn})
+	sort.SliceStable(s.steps, func(i, j int) bool {
+		if !s.steps[i].at.Equal(s.steps[j].at) {
+			return s.steps[i].at.Before(s.steps[j].at)
+		}
+		return s.steps[i].seq < s.steps[j].seq
+	})
+}
+
+// ノードnをpeerにつなぐ
+func (s *Simulator) Join(at time.Duration, n *Node, peer *Node) {
+	s.At(at, "join "+n.Name+" "+peer.Name, func(s *Simulator) error {
+		host, port := splitSimAddr(peer.Addr)
+		_, err := n.P2P.Add(&P2P.Node{Host: host, ApiPort: SIM_API_PORT, P2PPort: port})
+		return err
+	})
+}
+
+// ノードnにデータを投入する(全ノードでマイニングする)
+func (s *Simulator) Submit(at time.Duration, n *Node, data string) {
+	s.At(at, "submit "+n.Name+" "+data, func(s *Simulator) error {
+		return n.Chain.SaveData([]byte(data))
+	})
+}
+
+// ノードnだけでマイニングする
+func (s *Simulator) Mine(at time.Duration, n *Node, data string) {
+	s.At(at, "mine "+n.Name+" "+data, func(s *Simulator) error {
+		// マイニングは時計が進むのを待つので裏で行う
+		go n.Chain.Mine([]byte(data))
+		return nil
+	})
+}
+
+// ノードのグループの間を分断する
+func (s *Simulator) Partition(at time.Duration, name string, groups ...[]*Node) {
+	s.At(at, "partition "+name, func(s *Simulator) error {
+		addrs := make([][]string, 0, len(groups))
+		for _, g := range groups {
+			a := make([]string, 0, len(g))
+			for _, n := range g {
+				a = append(a, n.Addr)
+			}
+			addrs = append(addrs, a)
+		}
+		return s.Faults.Partition(name, addrs...)
+	})
+}
+
+// 分断を解除する
+func (s *Simulator) Heal(at time.Duration, name string) {
+	s.At(at, "heal "+name, func(s *Simulator) error {
+		return s.Faults.Heal(name)
+	})
+}
+
+// 通信の障害を変更する
+func (s *Simulator) SetFaults(at time.Duration, config P2P.FaultConfig) {
+	s.At(at, "faults", func(s *Simulator) error {
+		return s.Faults.SetConfig(config)
+	})
+}
+
+// ノードnを攻撃するノードにする
+func (s *Simulator) Adversary(at time.Duration, n *Node, config Block.AdversaryConfig) {
+	s.At(at, "adversary "+n.Name+" "+config.Mode, func(s *Simulator) error {
+		return n.Chain.SetAdversary(config)
+	})
+}
+
+// ノードnが隠しているブロックを公開する
+func (s *Simulator) Release(at time.Duration, n *Node) {
+	s.At(at, "release "+n.Name, func(s *Simulator) error {
+		n.Chain.ReleaseHidden()
+		return nil
+	})
+}
+
+// ノードnの手元のブロックを直接書き換える
+func (s *Simulator) Corrupt(at time.Duration, n *Node, hight int, data string) {
+	s.At(at, "corrupt "+n.Name+" "+strconv.Itoa(hight), func(s *Simulator) error {
+		return n.Chain.Corrupt(hight, data)
+	})
+}
+
+// ノードnの鍵で署名した訂正記録を追加する
+func (s *Simulator) Amend(at time.Duration, n *Node, hight int, data string, reason string) {
+	s.At(at, "amend "+n.Name+" "+strconv.Itoa(hight), func(s *Simulator) error {
+		return n.Chain.Modify(hight, data, reason)
+	})
+}
+
+// ノードnのチェーンの外にデータを保存する(持ち主はノードnの鍵)
+func (s *Simulator) PutBlob(at time.Duration, n *Node, data string) {
+	s.At(at, "put blob "+n.Name, func(s *Simulator) error {
+		_, err := n.Chain.PutBlob([]byte(data), "")
+		return err
+	})
+}
+
+// ノードnにチェーンの外のデータを取り寄せさせる
+func (s *Simulator) FetchBlob(at time.Duration, n *Node, data string) {
+	s.At(at, "fetch blob "+n.Name, func(s *Simulator) error {
+		// 取り寄せは応答を待つので裏で行う
+		go n.Chain.GetBlob(Block.BlobHash([]byte(data)))
+		return nil
+	})
+}
+
+// ノードnの鍵で消去記録を載せる
+// wantが空でなければ、そのエラーで断られることを確認する
+func (s *Simulator) Erase(at time.Duration, n *Node, data string, reason string, want error) {
+	s.At(at, "erase "+n.Name, func(s *Simulator) error {
+		err := n.Chain.Erase(Block.BlobHash([]byte(data)), reason)
+		if want != nil {
+			if err != want {
+				return errors.New("Erasure was not refused: " + fmt.Sprint(err))
+			}
+			return nil
+		}
+		return err
+	})
+}
+
+// 開始からuntilの時点まで時計を進める
+// 操作がエラーを返したら止める
+func (s *Simulator) Run(until time.Duration) error {
+	end := sim_epoch.Add(until)
+	for {
+		s.settle()
+
+		// 次に起きること(操作かタイマ)の時刻
+		next := end
+		if t, ok := s.Clock.Next(); ok && t.Before(next) {
+			next = t
+		}
+		if len(s.steps) > 0 && !s.steps[0].at.After(next) {
+			next = s.steps[0].at
+		}
+		s.Clock.AdvanceTo(next)
+
+		for len(s.steps) > 0 && !s.steps[0].at.After(next) {
+			st := s.steps[0]
+			s.steps = s.steps[1:]
+			s.Log = append(s.Log, s.Elapsed().String()+" "+st.name)
+			if err := st.fn(s); err != nil {
+				return errors.New(st.name + ": " + err.Error())
+			}
+			s.settle()
+		}
+		if !next.Before(end) {
+			s.settle()
+			return nil
+		}
+	}
+}
+
+// ノードの処理が落ち着くまで実際の時間で待つ
+func (s *Simulator) settle() {
+	deadline := time.Now().Add(MAX_SETTLE)
+	last := s.activity()
+	quiet := 0
+	for quiet < SETTLE_QUIET && time.Now().Before(deadline) {
+		time.Sleep(SETTLE_POLL)
+		n := s.activity()
+		if n == last {
+			quiet++
+		} else {
+			quiet = 0
+			last = n
+		}
+	}
+}
+
+// 通信の量
+func (s *Simulator) activity() uint64 {
+	sent, dropped := s.net.Counts()
+	return sent + dropped + s.Faults.Stats().Sent
+}
+
+// 全ノードのチェーンの先端
+func (s *Simulator) Tips() map[string]string {
+	tips := make(map[string]string)
+	for _, n := range s.nodes {
+		hight, hash := n.Chain.Tip()
+		tips[n.Name] = strconv.Itoa(hight) + ":" + hash
+	}
+	return tips
+}
+
+// 全ノードのチェーンが一致しているか
+func (s *Simulator) Converged() error {
+	return s.ConvergedAmong(s.nodes)
+}
+
+// 指定したノードのチェーンが一致しているか
+func (s *Simulator) ConvergedAmong(nodes []*Node) error {
+	all := s.Tips()
+	tips := make(map[string]string)
+	for _, n := range nodes {
+		tips[n.Name] = all[n.Name]
+	}
+	seen := ""
+	for _, tip := range tips {
+		if seen == "" {
+			seen = tip
+		} else if tip != seen {
+			return errors.New("Chains diverged: " + formatTips(tips))
+		}
+	}
+	return nil
+}
+
+// 全ノードのチェーンにデータが載っているか
+func (s *Simulator) HasData(data string) error {
+	missing := make([]string, 0)
+	for _, n := range s.nodes {
+		if n.Chain.GetBlockByData([]byte(data)) == nil {
+			missing = append(missing, n.Name)
+		}
+	}
+	if len(missing) > 0 {
+		return errors.New("Data " + data + " missing on " + strings.Join(missing, ","))
+	}
+	return nil
+}
+
+// ノードnのチェーンのうち、攻撃するノードadvが作ったブロックの数
+func (s *Simulator) AdversaryBlocks(n *Node, adv *Node) int {
+	count := 0
+	for _, h := range n.Chain.Headers() {
+		if adv.Chain.IsAdversaryBlock(h.Hash) {
+			count++
+		}
+	}
+	return count
+}
+
+// 結果の表示
+func (s *Simulator) Dump() {
+	fmt.Println("Simulation:", s.Elapsed())
+	for _, l := range s.Log {
+		fmt.Println("  step", l)
+	}
+	fmt.Println("  tips", formatTips(s.Tips()))
+	for _, n := range s.nodes {
+		m := n.Chain.Metrics()
+		fmt.Println("  metrics", n.Name, "received", m.Received, "invalid", m.Invalid, "conflicts", m.Conflicts,
+			"replaced", m.Replaced, "reorgs", m.Reorgs, "reorged", m.Reorged, "skewed", m.Skewed, "abandoned", m.Abandoned)
+		if st := n.Chain.AdversaryStats(); st.Config.Mode != Block.ADV_HONEST || st.Mined > 0 {
+			fmt.Println("  adversary", n.Name, st.Config.Mode, "mined", st.Mined, "hidden", st.Hidden,
+				"published", st.Published, "discarded", st.Discarded, "equivocations", st.Equivocations,
+				"spammed", st.Spammed, "rewritten", st.Rewritten, "on "+s.nodes[0].Name, s.AdversaryBlocks(s.nodes[0], n))
+		}
+	}
+	st := s.Faults.Stats()
+	fmt.Println("  packets sent", st.Sent, "lost", st.Lost, "blocked", st.Blocked)
+}
+
+// 先端の一覧を名前の順に並べる
+func formatTips(tips map[string]string) string {
+	names := make([]string, 0, len(tips))
+	for name := range tips {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	s := make([]string, 0, len(names))
+	for _, name := range names {
+		s = append(s, name+"="+tips[name])
+	}
+	return strings.Join(s, " ")
+}
+
+// "host:port"の分解
+func splitSimAddr(addr string) (string, uint16) {
+	i := strings.LastIndex(addr, ":")
+	port, _ := strconv.Atoi(addr[i+1:])
+	return addr[:i], uint16(port)
+}
@@ -0,0 +1,424 @@
+/*
+  My Block Chain: simulator scenario module
+*/
+package Sim
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"../Block"
+)
+
+// シナリオ
+type Scenario struct {
+	Name        string
+	Description string
+	Setup       func(s *Simulator, nodes []*Node) time.Duration // 操作を登録して、終了時刻を返す
+	Check       func(s *Simulator, nodes []*Node) error
+}
+
+// 組み込みのシナリオ
+var Scenarios = []*Scenario{
+	{
+		Name:        "converge",
+		Description: "nodes join one by one and submit data in turn",
+		Setup: func(s *Simulator, nodes []*Node) time.Duration {
+			for i, n := range nodes[1:] {
+				s.Join(time.Duration(i)*time.Second, n, nodes[0])
+			}
+			at := 10 * time.Second
+			for i := 0; i < 3; i++ {
+				n := nodes[s.Rand.Intn(len(nodes))]
+				s.Submit(at, n, "data"+strconv.Itoa(i))
+				at += 90 * time.Second
+			}
+			return at + 60*time.Second
+		},
+		Check: func(s *Simulator, nodes []*Node) error {
+			for i := 0; i < 3; i++ {
+				if err := s.HasData("data" + strconv.Itoa(i)); err != nil {
+					return err
+				}
+			}
+			return s.Converged()
+		},
+	},
+	{
+		Name:        "sibling-race",
+		Description: "two nodes mine different data at the same time",
+		Setup: func(s *Simulator, nodes []*Node) time.Duration {
+			for i, n := range nodes[1:] {
+				s.Join(time.Duration(i)*time.Second, n, nodes[0])
+			}
+			s.Mine(10*time.Second, nodes[0], "left")
+			s.Mine(10*time.Second, nodes[len(nodes)-1], "right")
+			return 150 * time.Second
+		},
+		Check: func(s *Simulator, nodes []*Node) error {
+			return s.Converged()
+		},
+	},
+	{
+		Name:        "partition-heal",
+		Description: "the network splits in two, both sides mine, then the split heals",
+		Setup: func(s *Simulator, nodes []*Node) time.Duration {
+			for i, n := range nodes[1:] {
+				s.Join(time.Duration(i)*time.Second, n, nodes[0])
+			}
+			half := len(nodes) / 2
+			s.Partition(10*time.Second, "split", nodes[:half], nodes[half:])
+			s.Submit(20*time.Second, nodes[0], "left")
+			s.Submit(20*time.Second, nodes[len(nodes)-1], "right1")
+			s.Submit(110*time.Second, nodes[len(nodes)-1], "right2")
+			s.Heal(200*time.Second, "split")
+			return 300 * time.Second
+		},
+		Check: func(s *Simulator, nodes []*Node) error {
+			if err := s.Converged(); err != nil {
+				return err
+			}
+			// 負けた側のデータは、外れたデータとして記録されている
+			for _, data := range []string{"left", "right1", "right2"} {
+				if s.HasData(data) == nil {
+					continue
+				}
+				found := false
+				for _, n := range nodes {
+					for _, a := range n.Chain.PartitionStatus().Abandoned {
+						found = found || a.Data == data
+					}
+				}
+				if !found {
+					return errors.New("Data " + data + " lost without report")
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Name:        "repair",
+		Description: "a block is corrupted on one node and repaired from the other nodes",
+		Setup: func(s *Simulator, nodes []*Node) time.Duration {
+			for i, n := range nodes[1:] {
+				s.Join(time.Duration(i)*time.Second, n, nodes[0])
+			}
+			// 壊れるノードは全ノードに問い合わせられるようにする
+			for _, n := range nodes[2:] {
+				s.Join(time.Duration(len(nodes))*time.Second, nodes[1], n)
+			}
+			for i := 0; i < 3; i++ {
+				s.Submit(time.Duration(10+90*i)*time.Second, nodes[0], "data"+strconv.Itoa(i))
+			}
+			s.Corrupt(300*time.Second, nodes[1], 2, "tampered")
+			return 300*time.Second + 2*Block.CHECK_INTERVAL
+		},
+		Check: func(s *Simulator, nodes []*Node) error {
+			if err := s.Converged(); err != nil {
+				return err
+			}
+			if s.HasData("tampered") == nil || nodes[1].Chain.GetBlockByData([]byte("tampered")) != nil {
+				return errors.New("Corrupted block was not repaired.")
+			}
+			if _, log := nodes[1].Chain.RepairLog(); len(log) != 1 || log[0].Hight != 2 {
+				return errors.New("Repair was not logged.")
+			}
+			return nil
+		},
+	},
+	{
+		Name:        "amend",
+		Description: "two nodes amend the same data, the history stays and the latest amendment is effective",
+		Setup: func(s *Simulator, nodes []*Node) time.Duration {
+			for i, n := range nodes[1:] {
+				s.Join(time.Duration(i)*time.Second, n, nodes[0])
+			}
+			s.Submit(10*time.Second, nodes[0], "data0")
+			s.Submit(100*time.Second, nodes[0], "data1")
+			s.Amend(190*time.Second, nodes[1], 1, "data0-fixed", "typo")
+			s.Amend(280*time.Second, nodes[len(nodes)-1], 1, "data0-final", "correction")
+			return 400 * time.Second
+		},
+		Check: func(s *Simulator, nodes []*Node) error {
+			if err := s.Converged(); err != nil {
+				return err
+			}
+			if err := s.HasData("data0"); err != nil {
+				return errors.New("Original data was not kept: " + err.Error())
+			}
+			for _, n := range nodes {
+				e, err := n.Chain.Effective(1)
+				if err != nil {
+					return err
+				}
+				if e.Original != "data0" || e.Data != "data0-final" || len(e.Amendments) != 2 {
+					return errors.New("Unexpected effective data on " + n.Name + ": " + e.Data)
+				}
+				for _, ib := range n.Chain.Verify(Block.VERIFY_STATE).Invalid {
+					if ib.Reason == Block.INVALID_STATE {
+						return errors.New("Invalid amendment on " + n.Name + ": " + ib.Detail)
+					}
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Name:        "blob",
+		Description: "personal data is kept off the chain, fetched by another node, then erased by its owner",
+		Setup: func(s *Simulator, nodes []*Node) time.Duration {
+			for i, n := range nodes[1:] {
+				s.Join(time.Duration(i)*time.Second, n, nodes[0])
+			}
+			s.PutBlob(10*time.Second, nodes[0], "alice@example.com")
+			s.FetchBlob(120*time.Second, nodes[1], "alice@example.com")
+			s.Erase(150*time.Second, nodes[1], "alice@example.com", "not mine", Block.ErrNotOwner)
+			s.Erase(160*time.Second, nodes[0], "alice@example.com", "deletion request", nil)
+			return 300 * time.Second
+		},
+		Check: func(s *Simulator, nodes []*Node) error {
+			if err := s.Converged(); err != nil {
+				return err
+			}
+			hash := Block.BlobHash([]byte("alice@example.com"))
+			for _, n := range nodes {
+				if n.Chain.GetBlockByData([]byte("alice@example.com")) != nil {
+					return errors.New("Payload is on the chain of " + n.Name)
+				}
+				_, tomb, err := n.Chain.GetBlob(hash)
+				if err != Block.ErrErased || tomb == nil {
+					return errors.New("Payload was not erased on " + n.Name)
+				}
+				if tomb.Held != (n == nodes[0] || n == nodes[1]) {
+					return errors.New("Unexpected tombstone on " + n.Name)
+				}
+				if report := n.Chain.Verify(Block.VERIFY_HASH); !report.OK {
+					return errors.New("Chain is broken on " + n.Name)
+				}
+				for _, ib := range n.Chain.Verify(Block.VERIFY_STATE).Invalid {
+					if ib.Reason == Block.INVALID_STATE {
+						return errors.New("Invalid record on " + n.Name + ": " + ib.Detail)
+					}
+				}
+			}
+			return nil
+		},
+	},
+
+	// 攻撃するノードのシナリオ(最後のノードが攻撃する)
+	{
+		Name:        "selfish",
+		Description: "the last node hides two blocks and publishes them when an honest block appears",
+		Setup: func(s *Simulator, nodes []*Node) time.Duration {
+			adv := joinAll(s, nodes, Block.AdversaryConfig{Mode: Block.ADV_SELFISH})
+			s.Mine(10*time.Second, adv, "a1")
+			s.Mine(80*time.Second, adv, "a2")
+			s.Mine(150*time.Second, nodes[0], "h1")
+			return 300 * time.Second
+		},
+		Check: func(s *Simulator, nodes []*Node) error {
+			if err := s.Converged(); err != nil {
+				return err
+			}
+			adv := nodes[len(nodes)-1]
+			if n := s.AdversaryBlocks(nodes[0], adv); n != 2 {
+				return errors.New("Hidden blocks did not win: " + strconv.Itoa(n))
+			}
+			if s.HasData("h1") == nil {
+				return errors.New("Honest block survived.")
+			}
+			m := honestMetrics(nodes)
+			if m.Replaced+m.Reorged == 0 {
+				return errors.New("No honest block was replaced.")
+			}
+			return nil
+		},
+	},
+	{
+		Name:        "withhold",
+		Description: "the last node withholds its blocks and releases them too late",
+		Setup: func(s *Simulator, nodes []*Node) time.Duration {
+			adv := joinAll(s, nodes, Block.AdversaryConfig{Mode: Block.ADV_WITHHOLD})
+			for i := 0; i < 3; i++ {
+				at := time.Duration(10+70*i) * time.Second
+				s.Mine(at, nodes[0], "h"+strconv.Itoa(i))
+				if i < 2 {
+					s.Mine(at, adv, "w"+strconv.Itoa(i))
+				}
+			}
+			s.Release(220*time.Second, adv)
+			return 300 * time.Second
+		},
+		Check: func(s *Simulator, nodes []*Node) error {
+			if err := s.Converged(); err != nil {
+				return err
+			}
+			adv := nodes[len(nodes)-1]
+			if n := s.AdversaryBlocks(nodes[0], adv); n != 0 {
+				return errors.New("Withheld blocks on chain: " + strconv.Itoa(n))
+			}
+			if st := adv.Chain.AdversaryStats(); st.Discarded != 2 {
+				return errors.New("Withheld blocks not discarded: " + strconv.Itoa(st.Discarded))
+			}
+			return nil
+		},
+	},
+	{
+		Name:        "equivocate",
+		Description: "the last node sends different blocks at the same height to different peers",
+		Setup: func(s *Simulator, nodes []*Node) time.Duration {
+			adv := joinAll(s, nodes, Block.AdversaryConfig{Mode: Block.ADV_EQUIVOCATE})
+			s.Mine(10*time.Second, adv, "x")
+			return 150 * time.Second
+		},
+		Check: func(s *Simulator, nodes []*Node) error {
+			if err := s.Converged(); err != nil {
+				return err
+			}
+			if (s.HasData("x") == nil) == (s.HasData("alt:x") == nil) {
+				return errors.New("Chains do not agree on one of the blocks.")
+			}
+			if honestMetrics(nodes).Conflicts == 0 {
+				return errors.New("No conflict was seen.")
+			}
+			return nil
+		},
+	},
+	{
+		Name:        "timestamp",
+		Description: "the last node backdates its block and wins a race against an honest block",
+		Setup: func(s *Simulator, nodes []*Node) time.Duration {
+			adv := joinAll(s, nodes, Block.AdversaryConfig{Mode: Block.ADV_TIMESTAMP})
+			s.Mine(10*time.Second, nodes[0], "honest")
+			s.Mine(10*time.Second, adv, "backdated")
+			return 150 * time.Second
+		},
+		Check: func(s *Simulator, nodes []*Node) error {
+			if err := s.Converged(); err != nil {
+				return err
+			}
+			if err := s.HasData("backdated"); err != nil {
+				return err
+			}
+			if honestMetrics(nodes).Skewed == 0 {
+				return errors.New("No skewed block was seen.")
+			}
+			return nil
+		},
+	},
+	{
+		Name:        "spam",
+		Description: "the last node floods its peers with invalid blocks",
+		Setup: func(s *Simulator, nodes []*Node) time.Duration {
+			adv := joinAll(s, nodes, Block.AdversaryConfig{Mode: Block.ADV_SPAM, Spam: 20})
+			s.Mine(10*time.Second, adv, "s")
+			s.Mine(90*time.Second, nodes[0], "h")
+			return 180 * time.Second
+		},
+		Check: func(s *Simulator, nodes []*Node) error {
+			if err := s.ConvergedAmong(nodes[:len(nodes)-1]); err != nil {
+				return err
+			}
+			if honestMetrics(nodes).Invalid == 0 {
+				return errors.New("No invalid block was seen.")
+			}
+			return nil
+		},
+	},
+	{
+		Name:        "rewrite",
+		Description: "the last node has the majority of the hash power and rewrites the first block",
+		Setup: func(s *Simulator, nodes []*Node) time.Duration {
+			adv := joinAll(s, nodes, Block.AdversaryConfig{Mode: Block.ADV_REWRITE, RewriteFrom: 1, RewriteData: "forged"})
+			for i := 0; i < 3; i++ {
+				s.Mine(time.Duration(10+70*i)*time.Second, nodes[0], "d"+strconv.Itoa(i))
+			}
+			s.Mine(220*time.Second, adv, "a")
+			return 330 * time.Second
+		},
+		Check: func(s *Simulator, nodes []*Node) error {
+			if err := s.Converged(); err != nil {
+				return err
+			}
+			if err := s.HasData("forged"); err != nil {
+				return err
+			}
+			if s.HasData("d0") == nil {
+				return errors.New("Rewritten data survived.")
+			}
+			if honestMetrics(nodes).Reorgs == 0 {
+				return errors.New("No honest node reorganized.")
+			}
+			return nil
+		},
+	},
+}
+
+// 全ノードをnodes[0]につなぎ、最後のノードを攻撃するノードにする
+// 攻撃するノードは全ての正直なノードと直接つながる
+func joinAll(s *Simulator, nodes []*Node, config Block.AdversaryConfig) *Node {
+	for i, n := range nodes[1:] {
+		s.Join(time.Duration(i)*time.Second, n, nodes[0])
+	}
+	adv := nodes[len(nodes)-1]
+	for _, n := range nodes[1 : len(nodes)-1] {
+		s.Join(time.Duration(len(nodes))*time.Second, adv, n)
+	}
+	s.Adversary(5*time.Second, adv, config)
+	return adv
+}
+
+// 正直なノード(最後以外)の統計情報の合計
+func honestMetrics(nodes []*Node) Block.ChainMetrics {
+	sum := Block.ChainMetrics{}
+	for _, n := range nodes[:len(nodes)-1] {
+		m := n.Chain.Metrics()
+		sum.Received += m.Received
+		sum.Invalid += m.Invalid
+		sum.Conflicts += m.Conflicts
+		sum.Replaced += m.Replaced
+		sum.Reorgs += m.Reorgs
+		sum.Reorged += m.Reorged
+		sum.Skewed += m.Skewed
+		sum.Abandoned += m.Abandoned
+	}
+	return sum
+}
+
+// 名前でシナリオを探す
+func FindScenario(name string) *Scenario {
+	for _, sc := range Scenarios {
+		if sc.Name == name {
+			return sc
+		}
+	}
+	return nil
+}
+
+// シナリオを実行して結果を確認する
+func RunScenario(name string, seed int64, nodes int) (*Simulator, error) {
+	sc := FindScenario(name)
+	if sc == nil {
+		return nil, errors.New("Unknown scenario:" + name)
+	}
+	if nodes < 2 {
+		return nil, errors.New("At least 2 nodes are needed.")
+	}
+
+	s := New(seed)
+	defer s.Close()
+	list := make([]*Node, 0, nodes)
+	for i := 0; i < nodes; i++ {
+		n, err := s.AddNode("n" + strconv.Itoa(i))
+		if err != nil {
+			return s, err
+		}
+		list = append(list, n)
+	}
+	end := sc.Setup(s, list)
+	if err := s.Run(end); err != nil {
+		return s, err
+	}
+	return s, sc.Check(s, list)
+}
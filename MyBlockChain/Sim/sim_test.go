@@ -0,0 +1,60 @@
+/*
+  My Block Chain: simulator scenario tests
+*/
+package Sim
+
+import (
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+)
+
+/*
+組み込みのシナリオを全て、決まったseedで実行する
+	go test -race ./Sim/
+
+	シナリオは仮想時計で進むので、seedが同じなら毎回同じ結果になる。
+	失敗した時は同じseedで simulate -scenario <name> -seed <seed> を実行すれば再現できる。
+	実行後は全ノードを停止するので、goroutineは残らない。
+*/
+
+var test_seeds = []int64{1, 2}
+
+const test_nodes = 4
+
+func TestScenarios(t *testing.T) {
+	for _, sc := range Scenarios {
+		for _, seed := range test_seeds {
+			name, seed := sc.Name, seed
+			t.Run(name+"/seed="+strconv.FormatInt(seed, 10), func(t *testing.T) {
+				if _, err := RunScenario(name, seed, test_nodes); err != nil {
+					t.Fatalf("scenario %s seed %d: %v", name, seed, err)
+				}
+			})
+		}
+	}
+}
+
+func TestScenarioStopsNodes(t *testing.T) {
+	before := runtime.NumGoroutine()
+	if _, err := RunScenario(Scenarios[0].Name, 1, test_nodes); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Fatalf("goroutines left after scenario: %d > %d", n, before)
+	}
+}
+
+func TestRunScenarioErrors(t *testing.T) {
+	if _, err := RunScenario("no-such-scenario", 1, test_nodes); err == nil {
+		t.Fatal("unknown scenario accepted")
+	}
+	if _, err := RunScenario(Scenarios[0].Name, 1, 1); err == nil {
+		t.Fatal("single node accepted")
+	}
+}
@@ -4,15 +4,21 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/labstack/echo"
 	"github.com/labstack/echo/middleware"
+	"io"
 	"net/http"
+	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"MyBlockChain/Block"
 	"MyBlockChain/P2P"
+	"MyBlockChain/Sim"
 )
 
 const (
@@ -26,13 +32,31 @@ const (
 	NODELIST        = "/nodes"
 	NODE            = "/node/"
 	MALICIOUS_BLOCK = "/malicious_block/"
+	P2P_STATS       = "/p2p/stats"
+	P2P_BANS        = "/p2p/bans"
+	P2P_UNVERIFIED  = "/p2p/unverified"
+	DHT_NODES       = "/dht/nodes"
+	DHT_PROVIDERS   = "/dht/providers"
+	MEMBERSHIP      = "/membership"
+	SYNC            = "/sync"
+	PARTITION       = "/partition"
+	FAULTS          = "/faults"
+	ADVERSARY       = "/adversary"
+	METRICS         = "/metrics"
+	CHECK           = "/check"
+	VERIFY          = "/verify"
+	AMENDMENTS      = "/amendments"
+	BLOBS           = "/blobs"
 
 	debug_mode = false
 )
 
 var (
-	p2p *P2P.P2PNetwork
-	bc  *Block.BlockChain
+	p2p    *P2P.P2PNetwork
+	bc     *Block.BlockChain
+	faults *P2P.FaultRules // 障害の注入(-faultsを付けた時だけ)
+
+	adversary_api bool // 攻撃の設定(-adversaryを付けた時だけ)
 )
 
 // ブロック一覧取得
@@ -47,27 +71,73 @@ func getBlock(c echo.Context) error {
 	id := c.Param("id")
 	fmt.Println("getBlock: ", id)
 
-	// ブロック検索
+	block := findBlock(id)
+	if block != nil {
+		return c.JSON(http.StatusOK, block)
+	}
+	return echo.NewHTTPError(http.StatusNotFound, "Block is not found.id="+id)
+}
+
+// ブロック検索
+func findBlock(id string) *Block.Block {
 	// データの中身で検索
 	block := bc.GetBlockByData([]byte(id))
 	if block != nil {
-		return c.JSON(http.StatusOK, block)
+		return block
 	}
 	// indexで検索
 	index, err := strconv.Atoi(id)
-	if err == nil {
+	if err == nil && index >= 0 {
 		block := bc.GetBlockByIndex(index)
 		if block != nil {
-			return c.JSON(http.StatusOK, block)
+			return block
 		}
 	}
 	// ハッシュで検索
-	block = bc.GetBlock(id)
-	if block != nil {
-		return c.JSON(http.StatusOK, block)
+	return bc.GetBlock(id)
+}
+
+// 訂正を反映したブロックのデータを取得
+func getEffective(c echo.Context) error {
+	id := c.Param("id")
+	fmt.Println("getEffective: ", id)
+
+	block := findBlock(id)
+	if block == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Block is not found.id="+id)
 	}
+	e, err := bc.Effective(block.Hight)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return c.JSON(http.StatusOK, e)
+}
 
-	return echo.NewHTTPError(http.StatusNotFound, "Block is not found.id="+id)
+// 全てのデータの、訂正を反映した値の一覧
+func listEffective(c echo.Context) error {
+	fmt.Println("listEffective:")
+	return c.JSON(http.StatusOK, bc.EffectiveAll())
+}
+
+// 訂正記録を受け付ける
+// 署名が無ければ自ノードの鍵で署名する
+func submitAmendment(c echo.Context) error {
+	fmt.Println("submitAmendment:")
+
+	tx := new(Block.AmendmentTx)
+	if err := c.Bind(tx); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid amendment.")
+	}
+	var err error
+	if tx.Sig == "" {
+		err = bc.Modify(tx.Hight, tx.Data, tx.Reason)
+	} else {
+		err = bc.SubmitAmendment(tx)
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return c.NoContent(http.StatusOK)
 }
 
 // ネットワークに接続しているサーバ一覧を取得
@@ -77,6 +147,228 @@ func listNodes(c echo.Context) error {
 	return c.JSON(http.StatusOK, nodes)
 }
 
+// P2Pネットワークの統計情報を取得
+func getP2PStats(c echo.Context) error {
+	fmt.Println("getP2PStats:")
+	stats := p2p.Stats()
+	return c.JSON(http.StatusOK, stats)
+}
+
+// 接続禁止リストを取得
+func listBans(c echo.Context) error {
+	fmt.Println("listBans:")
+	return c.JSON(http.StatusOK, p2p.Bans())
+}
+
+type BanRequest struct {
+	ID       string `json:"id"` // 鍵(16進)または"host:port"
+	Reason   string `json:"reason"`
+	Duration string `json:"duration"` // 例: "1h"。空なら既定値
+}
+
+// ノードを接続禁止にする
+func addBan(c echo.Context) error {
+	fmt.Println("addBan:")
+
+	req := new(BanRequest)
+	if err := c.Bind(req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid ban request.")
+	}
+	d := time.Duration(0)
+	if req.Duration != "" {
+		var err error
+		d, err = time.ParseDuration(req.Duration)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid duration.")
+		}
+	}
+	if req.Reason == "" {
+		req.Reason = "manual"
+	}
+	if err := p2p.Ban(req.ID, req.Reason, d); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+// 接続禁止を解除
+func removeBan(c echo.Context) error {
+	id := c.Param("id")
+	fmt.Println("removeBan: ", id)
+
+	if err := p2p.Unban(id); err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+// 障害の注入が有効か確認
+func faultsEnabled() error {
+	if faults == nil {
+		return echo.NewHTTPError(http.StatusForbidden, "Fault injection is disabled.")
+	}
+	return nil
+}
+
+// 障害の設定と統計を取得
+func getFaults(c echo.Context) error {
+	if err := faultsEnabled(); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, faults.Stats())
+}
+
+// 障害の設定を変更
+func setFaults(c echo.Context) error {
+	fmt.Println("setFaults:")
+	if err := faultsEnabled(); err != nil {
+		return err
+	}
+	config := new(P2P.FaultConfig)
+	if err := c.Bind(config); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid fault config.")
+	}
+	if err := faults.SetConfig(*config); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return c.JSON(http.StatusOK, faults.Stats())
+}
+
+// 全ての障害を解除
+func resetFaults(c echo.Context) error {
+	fmt.Println("resetFaults:")
+	if err := faultsEnabled(); err != nil {
+		return err
+	}
+	faults.Reset()
+	return c.NoContent(http.StatusOK)
+}
+
+type PartitionRequest struct {
+	Groups [][]string `json:"groups"` // "host:port"のグループ
+}
+
+// 名前付きの分断を設定
+func addPartition(c echo.Context) error {
+	name := c.Param("name")
+	fmt.Println("addPartition: ", name)
+	if err := faultsEnabled(); err != nil {
+		return err
+	}
+	req := new(PartitionRequest)
+	if err := c.Bind(req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid partition request.")
+	}
+	if err := faults.Partition(name, req.Groups...); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+// 名前付きの分断を解除
+func removePartition(c echo.Context) error {
+	name := c.Param("name")
+	fmt.Println("removePartition: ", name)
+	if err := faultsEnabled(); err != nil {
+		return err
+	}
+	if err := faults.Heal(name); err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+// キーに近いノードを探す(キーはノードIDかハッシュ。識別鍵ならノードIDに変換する)
+func findNodes(c echo.Context) error {
+	key := c.Param("key")
+	fmt.Println("findNodes: ", key)
+
+	if c.QueryParam("pubkey") == "true" {
+		id, err := P2P.NodeID(key)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		key = id
+	}
+	nodes, err := p2p.FindNode(key)
+	if err == P2P.ErrBadKey {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, err.Error())
+	}
+	return c.JSON(http.StatusOK, nodes)
+}
+
+// ブロックやデータを持っているノードを探す
+func findProviders(c echo.Context) error {
+	hash := c.Param("hash")
+	fmt.Println("findProviders: ", hash)
+
+	nodes, err := p2p.FindProviders(hash)
+	if err == P2P.ErrBadKey {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if err == P2P.ErrNotFound {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, err.Error())
+	}
+	return c.JSON(http.StatusOK, nodes)
+}
+
+// 自ノードがデータを持っていることをDHTに登録する
+func provide(c echo.Context) error {
+	hash := c.Param("hash")
+	fmt.Println("provide: ", hash)
+
+	stored, err := p2p.Provide(hash)
+	if err == P2P.ErrBadKey {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, err.Error())
+	}
+	return c.JSON(http.StatusOK, map[string]int{"stored": stored})
+}
+
+// 確認待ちのアドレス一覧
+func listUnverified(c echo.Context) error {
+	return c.JSON(http.StatusOK, p2p.Unverified())
+}
+
+// 参加ノードの一覧を取得(hightを指定するとその高さでの一覧)
+func getMembership(c echo.Context) error {
+	hight := -1
+	if h := c.QueryParam("hight"); h != "" {
+		var err error
+		hight, err = strconv.Atoi(h)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid Hight.")
+		}
+	}
+	m := bc.Membership(hight)
+	if m == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Membership is not enabled.")
+	}
+	return c.JSON(http.StatusOK, m)
+}
+
+// 管理者が署名した参加ノードの変更を受け付ける
+func submitMembership(c echo.Context) error {
+	fmt.Println("submitMembership:")
+
+	tx := new(Block.MembershipTx)
+	if err := c.Bind(tx); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid membership transaction.")
+	}
+	if err := bc.SubmitMembership(tx); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return c.NoContent(http.StatusOK)
+}
+
 type Data struct {
 	Data string `json:"data"`
 }
@@ -121,6 +413,27 @@ func addNode(c echo.Context) error {
 		fmt.Println(id)
 		fmt.Println(err)
 	}
+	if err == P2P.ErrBanned || err == P2P.ErrNotMember {
+		return echo.NewHTTPError(http.StatusForbidden, err.Error())
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// ネットワークからサーバを削除
+func removeNode(c echo.Context) error {
+	id := c.Param("id")
+	fmt.Println("removeNode: ", id)
+
+	index, err := strconv.Atoi(id)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid node id.")
+	}
+
+	err = p2p.Remove(index)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
 
 	return c.NoContent(http.StatusOK)
 }
@@ -139,12 +452,188 @@ func initBlockChain(c echo.Context) error {
 	return c.NoContent(http.StatusOK)
 }
 
-type BlockModify struct {
-	Hight int    `json:"hight"`
+// 同期の進捗を取得
+func getSyncStatus(c echo.Context) error {
+	status := bc.SyncStatus()
+	return c.JSON(http.StatusOK, status)
+}
+
+// 分断の状態を取得
+func getPartitionStatus(c echo.Context) error {
+	status := bc.PartitionStatus()
+	return c.JSON(http.StatusOK, status)
+}
+
+// すぐに全ノードとチェーンの先端を交換して修復する
+func healPartition(c echo.Context) error {
+	status := bc.Heal()
+	return c.JSON(http.StatusOK, status)
+}
+
+// チェーンから外れたデータを再投入する
+func resubmitAbandoned(c echo.Context) error {
+	n := bc.ResubmitAbandoned()
+	return c.JSON(http.StatusOK, map[string]int{"resubmitted": n})
+}
+
+// チェーンの整合性を確認する(修復はしない)
+func checkChain(c echo.Context) error {
+	fmt.Println("checkChain:")
+	report := bc.CheckChain()
+	return c.JSON(http.StatusOK, report)
+}
+
+// チェーンの整合性を確認し、壊れていれば他のノードから修復する
+func repairChain(c echo.Context) error {
+	fmt.Println("repairChain:")
+	report := bc.CheckAndRepair()
+	return c.JSON(http.StatusOK, report)
+}
+
+// 指定したレベルでチェーンを検証する(修復はしない)
+func verifyChain(c echo.Context) error {
+	level, err := Block.ParseVerifyLevel(c.QueryParam("level"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error()+" ("+strings.Join(Block.VerifyLevels(), ", ")+")")
+	}
+	fmt.Println("verifyChain:", level)
+	report := bc.Verify(level)
+	return c.JSON(http.StatusOK, report)
+}
+
+// 最後の確認の結果と修復の記録を取得
+func listRepairs(c echo.Context) error {
+	last, repairs := bc.RepairLog()
+	return c.JSON(http.StatusOK, map[string]interface{}{"last": last, "repairs": repairs})
+}
+
+// チェーンの統計情報を取得
+func getMetrics(c echo.Context) error {
+	return c.JSON(http.StatusOK, bc.Metrics())
+}
+
+// 攻撃の設定が有効か確認
+func adversaryEnabled() error {
+	if !adversary_api {
+		return echo.NewHTTPError(http.StatusForbidden, "Adversary mode is disabled.")
+	}
+	return nil
+}
+
+// 攻撃の設定と統計を取得
+func getAdversary(c echo.Context) error {
+	if err := adversaryEnabled(); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, bc.AdversaryStats())
+}
+
+// 攻撃の設定を変更
+func setAdversary(c echo.Context) error {
+	fmt.Println("setAdversary:")
+	if err := adversaryEnabled(); err != nil {
+		return err
+	}
+	config := new(Block.AdversaryConfig)
+	if err := c.Bind(config); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid adversary config.")
+	}
+	if err := bc.SetAdversary(*config); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return c.JSON(http.StatusOK, bc.AdversaryStats())
+}
+
+// 隠しているブロックを公開する
+func releaseHidden(c echo.Context) error {
+	fmt.Println("releaseHidden:")
+	if err := adversaryEnabled(); err != nil {
+		return err
+	}
+	n := bc.ReleaseHidden()
+	return c.JSON(http.StatusOK, map[string]int{"released": n})
+}
+
+type BlobData struct {
 	Data  string `json:"data"`
+	Owner string `json:"owner"` // 消去できる鍵(空なら自ノードの鍵)
+}
+
+// チェーンの外にデータを保存し、チェーンにはハッシュだけ載せる
+func putBlob(c echo.Context) error {
+	fmt.Println("putBlob:")
+
+	data := new(BlobData)
+	if err := c.Bind(data); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid blob.")
+	}
+	ref, err := bc.PutBlob([]byte(data.Data), data.Owner)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return c.JSON(http.StatusOK, ref)
+}
+
+// チェーンの外に置いたデータの一覧
+func listBlobs(c echo.Context) error {
+	fmt.Println("listBlobs:")
+	return c.JSON(http.StatusOK, bc.Blobs())
+}
+
+// チェーンの外に置いたデータを取得(消したデータは墓標を返す)
+func getBlob(c echo.Context) error {
+	hash := c.Param("hash")
+	fmt.Println("getBlob: ", hash)
+
+	payload, tomb, err := bc.GetBlob(hash)
+	switch err {
+	case nil:
+		return c.Blob(http.StatusOK, "application/octet-stream", payload)
+	case Block.ErrErased:
+		return c.JSON(http.StatusGone, tomb)
+	case Block.ErrNoBlob, P2P.ErrNotFound, P2P.ErrNoPeer:
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+}
+
+// チェーンの外に置いたデータを消す
+// 署名が無ければ自ノードの鍵で署名する
+func eraseBlob(c echo.Context) error {
+	hash := c.Param("hash")
+	fmt.Println("eraseBlob: ", hash)
+
+	tx := new(Block.ErasureTx)
+	if err := c.Bind(tx); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid erasure.")
+	}
+	tx.Hash = hash
+	var err error
+	if tx.Sig == "" {
+		err = bc.Erase(tx.Hash, tx.Reason)
+	} else {
+		err = bc.SubmitErasure(tx)
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+// 消したデータの墓標の一覧
+func listTombstones(c echo.Context) error {
+	fmt.Println("listTombstones:")
+	return c.JSON(http.StatusOK, bc.Tombstones())
+}
+
+type BlockModify struct {
+	Hight  int    `json:"hight"`
+	Data   string `json:"data"`
+	Reason string `json:"reason"`
 }
 
 // データの書き換え
+// ブロックは書き換えず、自ノードの鍵で署名した訂正記録を追加する
 func maliciousBlock(c echo.Context) error {
 	fmt.Println("maliciousBlock:")
 
@@ -156,24 +645,153 @@ func maliciousBlock(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "Invalid data.")
 	}
 
-	bc.Modify(data.Hight, data.Data)
+	if data.Reason == "" {
+		data.Reason = "modify"
+	}
+	err = bc.Modify(data.Hight, data.Data, data.Reason)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
 
 	return c.NoContent(http.StatusOK)
 }
 
+// カンマ区切りの鍵の一覧
+func splitKeys(s string) []string {
+	keys := make([]string, 0)
+	for _, k := range strings.Split(s, ",") {
+		k = strings.ToLower(strings.TrimSpace(k))
+		if k != "" {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
 // バージョン番号を返す
 func requestHandler(c echo.Context) error {
 	return c.String(http.StatusOK, "My Block Chain Ver0.1")
 }
 
+// 参加ノードの変更トランザクションを作るコマンド
+// 例: MyBlockChain membership -admin-key admin.key -op add -key <node key> -seq 1
+func membershipCommand(args []string) int {
+	fs := flag.NewFlagSet("membership", flag.ExitOnError)
+	keyfile := fs.String("admin-key", "admin.key", "admin key file (created if missing)")
+	op := fs.String("op", Block.MEMBER_ADD, "add, remove, add_admin or remove_admin")
+	key := fs.String("key", "", "target node key")
+	seq := fs.Int("seq", 1, "membership sequence number (current seq + 1)")
+	fs.Parse(args)
+
+	admin, err := P2P.LoadIdentity(*keyfile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	tx := &Block.MembershipTx{Op: *op, Key: *key, Seq: *seq}
+	tx.Sign(admin)
+	b, _ := json.Marshal(tx)
+	fmt.Println(string(b))
+	return 0
+}
+
+// 動いているノードのチェーンを検証するコマンド
+// 結果(JSON)を標準出力に出し、失敗があれば1、検証できなければ2で終わる
+// 例: MyBlockChain verify -node 127.0.0.1:3000 -level consensus
+func verifyCommand(args []string) int {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	node := fs.String("node", HOST+":"+strconv.Itoa(API_PORT), "API address of the node")
+	level := fs.String("level", "", "verify level ("+strings.Join(Block.VerifyLevels(), ", ")+")")
+	fs.Parse(args)
+
+	if _, err := Block.ParseVerifyLevel(*level); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	client := &http.Client{Timeout: 60 * time.Second}
+	res, err := client.Get("http://" + *node + VERIFY + "?level=" + *level)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil || res.StatusCode != http.StatusOK {
+		fmt.Fprintln(os.Stderr, "Verify failed:", res.Status, string(body))
+		return 2
+	}
+	report := new(Block.IntegrityReport)
+	if err := json.Unmarshal(body, report); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	b, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Println(string(b))
+	if !report.OK {
+		return 1
+	}
+	return 0
+}
+
+// シミュレーションのサブコマンド
+func simulateCommand(args []string) int {
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	scenario := fs.String("scenario", "converge", "scenario name (-list shows all)")
+	seed := fs.Int64("seed", 1, "random seed")
+	nodes := fs.Int("nodes", 4, "number of nodes")
+	list := fs.Bool("list", false, "list scenarios")
+	fs.Parse(args)
+
+	if *list {
+		for _, sc := range Sim.Scenarios {
+			fmt.Println(sc.Name+":", sc.Description)
+		}
+		return 0
+	}
+	s, err := Sim.RunScenario(*scenario, *seed, *nodes)
+	if s != nil {
+		s.Dump()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "FAIL:", err)
+		return 1
+	}
+	fmt.Println("PASS")
+	return 0
+}
+
 // メイン処理
 func main() {
 
+	// サブコマンド
+	if len(os.Args) > 1 && os.Args[1] == "membership" {
+		os.Exit(membershipCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "simulate" {
+		os.Exit(simulateCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		os.Exit(verifyCommand(os.Args[2:]))
+	}
+
 	// オプションの解析
 	apiport := flag.Int("apiport", API_PORT, "API port number")
 	p2pport := flag.Int("p2pport", P2P_PORT, "P2P port number")
 	host := flag.String("host", HOST, "p2p port number")
 	first := flag.Bool("first", false, "first server")
+	wire := flag.String("wire", "binary", "P2P payload format (binary or json)")
+	keyfile := flag.String("key", "", "node key file (default node_<p2pport>.key)")
+	trust := flag.String("trust", "", "comma separated node keys allowed to join (empty: any)")
+	banfile := flag.String("bans", "", "ban list file (default bans_<p2pport>.json)")
+	admins := flag.String("admins", "", "comma separated admin keys (chain parameter, enables membership)")
+	members := flag.String("members", "", "comma separated initial member keys (chain parameter)")
+	network := flag.String("network", "main", "network name (nodes with different names or chain parameters can not talk)")
+	network_seed := flag.String("network-seed", "", "per-network random seed (generated on the first server, required to join)")
+	fanout := flag.Int("fanout", P2P.GOSSIP_FANOUT, "gossip fanout (0 sends to all peers)")
+	gossip_ttl := flag.Int("gossip-ttl", P2P.GOSSIP_TTL, "gossip hop limit")
+	fault := flag.Bool("faults", false, "enable fault injection API (testing only)")
+	fault_seed := flag.Int64("fault-seed", 0, "random seed for fault injection (0: current time)")
+	adv_mode := flag.String("adversary", "", "enable adversary API and start in this mode (honest, selfish, withhold, equivocate, timestamp, spam; teaching only)")
 	flag.Parse()
 
 	api_port := uint16(*apiport)
@@ -186,13 +804,70 @@ func main() {
 
 	// P2Pモジュールの初期化
 	p2p = new(P2P.P2PNetwork)
-	_, err := p2p.Init(my_host, api_port, p2p_port)
+	if *wire == "json" {
+		// デバッグ用に中身を読める形式で送る
+		p2p.SetWireFormat(P2P.WIRE_JSON)
+	}
+	// ノードの識別鍵(無ければ作る)
+	if *keyfile == "" {
+		*keyfile = "node_" + strconv.Itoa(int(p2p_port)) + ".key"
+	}
+	id, err := P2P.LoadIdentity(*keyfile)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	p2p.SetIdentity(id)
+	if err := p2p.SetTrustedKeys(strings.Split(*trust, ",")); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if *banfile == "" {
+		*banfile = "bans_" + strconv.Itoa(int(p2p_port)) + ".json"
+	}
+	if err := p2p.SetBanFile(*banfile); err != nil {
+		fmt.Println(err)
+		return
+	}
+	// 障害の注入(試験用)
+	if *fault {
+		if *fault_seed == 0 {
+			*fault_seed = time.Now().UnixNano()
+		}
+		fmt.Println("Fault injection enabled. seed:", *fault_seed)
+		faults = P2P.NewFaultRules(*fault_seed)
+		// 他のノードは別のプロセスなので、受信にも障害を起こす
+		ft := faults.Wrap(P2P.UDPTransport{})
+		ft.SetReceiveFaults(p2p.FrameSource)
+		p2p.SetTransport(ft)
+	}
+	// ネットワークごとのseed(最初のノードで作り、参加するノードに渡す)
+	if *network_seed == "" {
+		if !*first {
+			fmt.Println("-network-seed is required to join a network.")
+			return
+		}
+		if *network_seed, err = P2P.NewNetworkSeed(); err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Println("Network seed:", *network_seed, "(pass -network-seed to joining nodes)")
+	}
+	if err := P2P.ValidNetworkSeed(*network_seed); err != nil {
+		fmt.Println(err)
+		return
+	}
+	// チェーンのパラメータが違うネットワークとは通信しない
+	p2p.SetNetworkMagic(P2P.NetworkMagic(Block.ChainParams(*network, *network_seed, splitKeys(*admins), splitKeys(*members))...))
+	_, err = p2p.Init(my_host, api_port, p2p_port)
 	if err == nil {
 		fmt.Println("P2P module initialized.")
 	} else {
 		fmt.Println(err)
 		return
 	}
+	p2p.SetFanout(*fanout)
+	p2p.SetGossipTTL(*gossip_ttl)
 
 	// Block Chainモジュールの初期化
 	bc = new(Block.BlockChain)
@@ -206,6 +881,19 @@ func main() {
 	if *first {
 		bc.Initialized()
 	}
+	// 攻撃するノード(学習用)
+	if *adv_mode != "" {
+		if err := bc.SetAdversary(Block.AdversaryConfig{Mode: *adv_mode}); err != nil {
+			fmt.Println(err)
+			return
+		}
+		adversary_api = true
+	}
+	// 参加ノードの制限(全ノードで同じ値にする)
+	if err := bc.SetMembership(splitKeys(*admins), splitKeys(*members)); err != nil {
+		fmt.Println(err)
+		return
+	}
 	if debug_mode {
 		fmt.Println(p2p)
 		fmt.Println(bc)
@@ -214,9 +902,18 @@ func main() {
 	// アクション登録
 	p2p.SetAction(P2P.CMD_NEWBLOCK, bc.NewBlock)
 	p2p.SetAction(P2P.CMD_ADDSRV, p2p.AddSrv)
-	p2p.SetAction(P2P.CMD_SENDBLOCK, bc.SendBlock)
 	p2p.SetAction(P2P.CMD_MININGBLOCK, bc.MiningBlock)
 	p2p.SetAction(P2P.CMD_MODIFYDATA, bc.ModifyData)
+	p2p.SetPeerAction(P2P.CMD_INV, p2p.Inv)
+	p2p.SetPeerAction(P2P.CMD_GETDATA, p2p.GetData)
+	p2p.SetInventory(bc.HasInventory, bc.GetInventory)
+
+	// 要求ハンドラ登録
+	p2p.SetRequestHandler(P2P.REQ_BLOCK, bc.ServeBlock)
+	p2p.SetRequestHandler(P2P.REQ_HEADERS, bc.ServeHeaders)
+	p2p.SetRequestHandler(P2P.REQ_BLOCKS, bc.ServeBlocks)
+	p2p.SetRequestHandler(P2P.REQ_BLOB, bc.ServeBlob)
+	p2p.SetPeerRequestHandler(P2P.REQ_TIP, bc.ServeTip)
 
 	// Echoセットアップ
 	e := echo.New()
@@ -237,13 +934,49 @@ func main() {
 	e.GET("/", requestHandler)
 	e.GET(BLOCKLIST, listBlocks)
 	e.GET(BLOCK+":id", getBlock)
+	e.GET(BLOCK+":id/effective", getEffective)
+	e.GET(AMENDMENTS, listEffective)
+	e.POST(AMENDMENTS, submitAmendment)
+	e.GET(BLOBS, listBlobs)
+	e.POST(BLOBS, putBlob)
+	e.GET(BLOBS+"/tombstones", listTombstones)
+	e.GET(BLOBS+"/:hash", getBlob)
+	e.DELETE(BLOBS+"/:hash", eraseBlob)
 	e.POST(BLOCK, createBlock)
 	e.GET(NODELIST, listNodes)
 	e.POST(NODE, addNode)
 	e.PUT(NODE, addNode)
+	e.DELETE(NODE+":id", removeNode)
+	e.GET(P2P_STATS, getP2PStats)
+	e.GET(P2P_BANS, listBans)
+	e.GET(P2P_UNVERIFIED, listUnverified)
+	e.GET(DHT_NODES+"/:key", findNodes)
+	e.GET(DHT_PROVIDERS+"/:hash", findProviders)
+	e.POST(DHT_PROVIDERS+"/:hash", provide)
+	e.POST(P2P_BANS, addBan)
+	e.DELETE(P2P_BANS+"/:id", removeBan)
+	e.GET(MEMBERSHIP, getMembership)
+	e.POST(MEMBERSHIP, submitMembership)
 	e.POST(MALICIOUS_BLOCK, maliciousBlock)
 
 	e.POST(INIT+":id", initBlockChain)
+	e.GET(SYNC, getSyncStatus)
+	e.GET(PARTITION, getPartitionStatus)
+	e.POST(PARTITION+"/heal", healPartition)
+	e.POST(PARTITION+"/resubmit", resubmitAbandoned)
+	e.GET(FAULTS, getFaults)
+	e.PUT(FAULTS, setFaults)
+	e.DELETE(FAULTS, resetFaults)
+	e.PUT(FAULTS+"/partitions/:name", addPartition)
+	e.DELETE(FAULTS+"/partitions/:name", removePartition)
+	e.GET(METRICS, getMetrics)
+	e.GET(CHECK, checkChain)
+	e.POST(CHECK+"/repair", repairChain)
+	e.GET(VERIFY, verifyChain)
+	e.GET(CHECK+"/repairs", listRepairs)
+	e.GET(ADVERSARY, getAdversary)
+	e.PUT(ADVERSARY, setAdversary)
+	e.POST(ADVERSARY+"/release", releaseHidden)
 
 	// サーバの起動
 	e.Logger.Fatal(e.Start(my_host + ":" + strconv.FormatInt(int64(api_port), 10)))